@@ -0,0 +1,500 @@
+package main
+
+import (
+	"backstreetlinkv2/api/kms"
+	"backstreetlinkv2/api/model"
+	"backstreetlinkv2/api/reconcile"
+	"backstreetlinkv2/api/repo"
+	"backstreetlinkv2/api/service"
+	"backstreetlinkv2/config"
+	"backstreetlinkv2/db"
+	"backstreetlinkv2/db/migrations"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	zlog "github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func migrateCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	cfg, err := parseConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	action, rest := "up", fs.Args()
+	if len(rest) > 0 {
+		action, rest = rest[0], rest[1:]
+	}
+
+	dbClient, err := db.ConnectMySQL(cfg.MySQL.DSN)
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close()
+
+	migrator, err := db.NewMigrator(dbClient, migrations.Files)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "up":
+		done, err := migrator.Up(ctx)
+		printMigrations(os.Stdout, "applied", done)
+		return err
+
+	case "down":
+		steps := 1
+		if len(rest) > 0 {
+			if steps, err = strconv.Atoi(rest[0]); err != nil || steps < 1 {
+				return fmt.Errorf("down takes a positive number of steps, got %q", rest[0])
+			}
+		}
+
+		done, err := migrator.Down(ctx, steps)
+		printMigrations(os.Stdout, "reverted", done)
+		return err
+
+	case "status":
+		status, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, s := range status {
+			applied := "pending"
+			if !s.AppliedAt.IsZero() {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+
+			fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+
+		return w.Flush()
+
+	default:
+		return fmt.Errorf("unknown action %q, want up, down or status", action)
+	}
+}
+
+func printMigrations(w io.Writer, verb string, done []db.Migration) {
+	if len(done) == 0 {
+		fmt.Fprintln(w, "nothing to do")
+	}
+
+	for _, m := range done {
+		fmt.Fprintf(w, "%s %d_%s\n", verb, m.Version, m.Name)
+	}
+}
+
+// freshTables are the tables of the migrations, freshDB drops them even when a database created
+// before schema_migrations has no record of them
+var freshTables = []string{"blobs", "sources"}
+
+// freshDB reverts every migration, drops the tables left then applies the migrations again,
+// the data is lost
+func freshDB(ctx context.Context, dbClient *sql.DB) error {
+	migrator, err := db.NewMigrator(dbClient, migrations.Files)
+	if err != nil {
+		return err
+	}
+
+	if _, err := migrator.Down(ctx, 0); err != nil {
+		return err
+	}
+
+	for _, table := range freshTables {
+		if _, err := dbClient.ExecContext(ctx, "DROP TABLE IF EXISTS "+table); err != nil {
+			return err
+		}
+	}
+
+	_, err = migrator.Up(ctx)
+	return err
+}
+
+// migrateOnStart applies the pending migrations when apply is set, otherwise it refuses to
+// serve a schema the code doesn't match
+func migrateOnStart(ctx context.Context, dbClient *sql.DB, apply bool) error {
+	migrator, err := db.NewMigrator(dbClient, migrations.Files)
+	if err != nil {
+		return err
+	}
+
+	if apply {
+		done, err := migrator.Up(ctx)
+		for _, m := range done {
+			zlog.Info().Msgf("applied migration %d_%s", m.Version, m.Name)
+		}
+
+		return err
+	}
+
+	pending, err := migrator.Pending(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(pending) > 0 {
+		names := make([]string, 0, len(pending))
+		for _, m := range pending {
+			names = append(names, fmt.Sprintf("%d_%s", m.Version, m.Name))
+		}
+
+		return fmt.Errorf("%d pending migrations (%s), run `backstreetlinkv2 migrate up` or serve with -migrate",
+			len(pending), strings.Join(names, ", "))
+	}
+
+	return nil
+}
+
+func aliasCmd(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return usageError{errors.New("alias needs an action")}
+	}
+
+	action, args := args[0], args[1:]
+
+	fs := flag.NewFlagSet("alias "+action, flag.ContinueOnError)
+	jsonOutput := fs.Bool("json", false, "print the aliases as json")
+
+	var opts repo.ListOptions
+	if action == "list" {
+		fs.StringVar(&opts.Type, "type", "", "only list the LINK or the FILE aliases")
+		fs.BoolVar(&opts.BlockedOnly, "blocked", false, "only list the blocked aliases")
+		fs.StringVar(&opts.After, "after", "", "list the aliases after this one")
+		fs.IntVar(&opts.Limit, "limit", repo.DefaultListLimit, "how many aliases to list")
+	}
+
+	wantArgs := map[string]int{"list": 0, "show": 1, "delete": 1, "block": 1, "unblock": 1}
+	n, ok := wantArgs[action]
+	if !ok {
+		return fmt.Errorf("unknown action %q, want list, show, delete, block or unblock", action)
+	}
+
+	cfg, err := parseConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	// block takes an optional reason
+	if fs.NArg() != n && !(action == "block" && fs.NArg() == 2) {
+		return fmt.Errorf("alias %s takes %d argument(s), see backstreetlinkv2 help", action, n)
+	}
+
+	dbClient, err := db.ConnectMySQL(cfg.MySQL.DSN)
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close()
+
+	storage := repo.NewMYSQLRepo(dbClient)
+	alias := fs.Arg(0)
+
+	switch action {
+	case "list":
+		sources, err := storage.List(ctx, opts)
+		if err != nil {
+			return err
+		}
+
+		if *jsonOutput {
+			return printJSON(os.Stdout, sources)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ALIAS\tTYPE\tTARGET\tCREATED\tBLOCKED")
+		for _, source := range sources {
+			blocked := "-"
+			if source.BlockedAt != nil {
+				blocked = source.BlockedAt.Format(time.RFC3339)
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+				source.Alias, source.Type, target(source), source.CreatedAt.Format(time.RFC3339), blocked)
+		}
+
+		if len(sources) == opts.Limit {
+			fmt.Fprintf(w, "\nmore with -after %s\n", sources[len(sources)-1].Alias)
+		}
+
+		return w.Flush()
+
+	case "show":
+		source, err := storage.Source(ctx, alias)
+		if err != nil {
+			return err
+		}
+
+		if *jsonOutput {
+			return printJSON(os.Stdout, source)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "alias\t%s\ntype\t%s\ntarget\t%s\ncreated\t%s\n",
+			source.Alias, source.Type, target(source), source.CreatedAt.Format(time.RFC3339))
+		if source.SHA256 != "" {
+			fmt.Fprintf(w, "blob\t%s\n", source.SHA256)
+
+			if key, err := storage.BlobKey(ctx, source.SHA256); err == nil && key.KeyID != "" {
+				fmt.Fprintf(w, "master key\t%s\n", key.KeyID)
+			}
+		}
+		for i, file := range source.Files {
+			fmt.Fprintf(w, "file %d\t%s\t%d bytes\tblob %s\n", i, file.Name, file.Size, file.SHA256)
+		}
+		if source.BlockedAt != nil {
+			fmt.Fprintf(w, "blocked\t%s\nreason\t%s\n", source.BlockedAt.Format(time.RFC3339), source.BlockedReason)
+		}
+		if limit := source.Limit(); limit > 0 {
+			fmt.Fprintf(w, "uses\t%d of %d\n", source.Uses, limit)
+		}
+		if source.ExhaustedAt != nil {
+			fmt.Fprintf(w, "exhausted\t%s\n", source.ExhaustedAt.Format(time.RFC3339))
+		}
+
+		return w.Flush()
+
+	case "block", "unblock":
+		if action == "block" {
+			err = storage.Block(ctx, alias, fs.Arg(1))
+		} else {
+			err = storage.Unblock(ctx, alias)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := evictAlias(ctx, cfg, alias); err != nil {
+			return err
+		}
+
+		fmt.Printf("%s %sed\n", alias, action)
+		return nil
+
+	default:
+		objects, err := newObjectScanner(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		defer objects.Close()
+
+		cache, err := newAdminCache(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		defer closeCache(cache)
+
+		out := service.NewLinkDeps(storage, objects, cache).DeleteAlias(ctx, alias)
+		if err := out.Err(); err != nil {
+			return err
+		}
+
+		fmt.Printf("%s deleted\n", alias)
+		return nil
+	}
+}
+
+func cacheCmd(ctx context.Context, args []string) error {
+	if len(args) == 0 || args[0] != "flush" {
+		fmt.Fprint(os.Stderr, usage)
+		return usageError{errors.New("cache needs the flush action")}
+	}
+
+	fs := flag.NewFlagSet("cache flush", flag.ContinueOnError)
+	cfg, err := parseConfig(fs, args[1:])
+	if err != nil {
+		return err
+	}
+
+	cache, err := newAdminCache(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer closeCache(cache)
+
+	if err := cache.Reset(); err != nil {
+		return err
+	}
+
+	fmt.Println("cache flushed")
+	return nil
+}
+
+func gcOrphansCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("gc-orphans", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only report the orphans and the dangling rows")
+	jsonOutput := fs.Bool("json", false, "print the report as json")
+	minAge := fs.Duration("min-age", 0, "skip the younger objects and rows, reconcile.min_age by default")
+
+	cfg, err := parseConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *minAge == 0 {
+		*minAge = cfg.Reconcile.MinAge
+	}
+
+	dbClient, err := db.ConnectMySQL(cfg.MySQL.DSN)
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close()
+
+	objects, err := newObjectScanner(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer objects.Close()
+
+	cache, err := newAdminCache(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer closeCache(cache)
+
+	reconciler := reconcile.New(repo.NewMYSQLRepo(dbClient), objects, cache, reconcile.Config{MinAge: *minAge})
+
+	report, err := reconciler.Run(ctx, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	if *jsonOutput {
+		return printJSON(os.Stdout, report)
+	}
+
+	verb := "deleted"
+	if report.DryRun {
+		verb = "would delete"
+	}
+
+	for _, object := range report.OrphanObjects {
+		fmt.Printf("%s orphan object %s (%d bytes)\n", verb, object.Key, object.Size)
+	}
+
+	for _, row := range report.DanglingRows {
+		fmt.Printf("%s dangling alias %s (%s)\n", verb, row.Alias, row.Filename)
+	}
+
+	for _, failure := range report.Failures {
+		fmt.Fprintf(os.Stderr, "failed %s\n", failure)
+	}
+
+	fmt.Printf("scanned %d objects and %d FILE aliases: %d orphan objects (%d bytes), %d dangling aliases\n",
+		report.ObjectsScanned, report.RowsScanned, len(report.OrphanObjects), report.OrphanBytes, len(report.DanglingRows))
+
+	if len(report.Failures) > 0 {
+		return fmt.Errorf("%d deletes failed", len(report.Failures))
+	}
+
+	return nil
+}
+
+func target(source repo.Source) string {
+	if source.Type == model.TypeFile {
+		return source.Filename
+	}
+
+	return source.RedirectTo
+}
+
+func printJSON(w io.Writer, v any) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(v)
+}
+
+func newObjectScanner(ctx context.Context, cfg config.Config) (*repo.ObjectScanner, error) {
+	return repo.NewObjectScanner(ctx, repo.ObjectConfig{
+		AccessKey: cfg.S3.AccessKey,
+		SecretKey: cfg.S3.SecretKey,
+		Endpoint:  cfg.S3.Endpoint,
+		Bucket:    cfg.S3.Bucket,
+		Region:    cfg.S3.Region,
+	})
+}
+
+// newAdminCache opens the cache the servers share. The memory cache lives inside every server,
+// a command can't reach it and the servers keep their entries until cache.ttl.
+func newAdminCache(ctx context.Context, cfg config.Config) (service.Cache, error) {
+	if cfg.Cache.Driver == config.CacheMemory {
+		fmt.Fprintf(os.Stderr, "warning: the memory cache lives in the servers, they keep their entries for up to %s,"+
+			" DELETE /api/v2/admin/cache on every server evicts them now\n", cfg.Cache.TTL)
+	}
+
+	return newCache(ctx, cfg)
+}
+
+// evictAlias drops the cached alias so a block or an unblock is seen right away
+func evictAlias(ctx context.Context, cfg config.Config, alias string) error {
+	cache, err := newAdminCache(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer closeCache(cache)
+
+	err = cache.Delete(alias)
+	if err != nil && !errors.Is(err, repo.ErrCacheNotFound) {
+		return err
+	}
+
+	return nil
+}
+
+func closeCache(cache service.Cache) {
+	if closer, ok := cache.(interface{ Close() error }); ok {
+		closer.Close()
+	}
+}
+
+func rotateKeysCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("rotate-keys", flag.ContinueOnError)
+	jsonOutput := fs.Bool("json", false, "print the report as json")
+
+	cfg, err := parseConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	ring, err := newKeyRing(cfg)
+	if err != nil {
+		return err
+	}
+
+	if ring == nil {
+		return errors.New("no master key, set sse.master_key or sse.keys_file")
+	}
+
+	dbClient, err := db.ConnectMySQL(cfg.MySQL.DSN)
+	if err != nil {
+		return err
+	}
+	defer dbClient.Close()
+
+	report, err := kms.Rotate(ctx, ring, repo.NewMYSQLRepo(dbClient))
+	if *jsonOutput {
+		if printErr := printJSON(os.Stdout, report); err == nil {
+			err = printErr
+		}
+	} else {
+		fmt.Printf("re-wrapped %d data keys with %s, %d skipped\n", report.Rewrapped, ring.CurrentID(), report.Skipped)
+	}
+
+	return err
+}
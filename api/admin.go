@@ -0,0 +1,70 @@
+package api
+
+import (
+	"backstreetlinkv2/api/service"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+func CacheEntry(svc *service.Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		param := mux.Vars(r)
+		if _, ok := param["alias"]; !ok {
+			sendProblem(w, r, statusNotFound, "not found")
+			return
+		}
+
+		output := svc.CacheEntry(r.Context(), param["alias"])
+		writeJSON(w, r, output.Code, &output)
+	}
+}
+
+func EvictCache(svc *service.Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		param := mux.Vars(r)
+		if _, ok := param["alias"]; !ok {
+			sendProblem(w, r, statusNotFound, "not found")
+			return
+		}
+
+		output := svc.EvictCache(r.Context(), param["alias"])
+		writeJSON(w, r, output.Code, &output)
+	}
+}
+
+func FlushCache(svc *service.Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		output := svc.FlushCache(r.Context())
+		writeJSON(w, r, output.Code, &output)
+	}
+}
+
+func CacheStats(svc *service.Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		output := svc.CacheStats(r.Context())
+		writeJSON(w, r, output.Code, &output)
+	}
+}
+
+func DeleteAlias(svc *service.Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		param := mux.Vars(r)
+		if _, ok := param["alias"]; !ok {
+			sendProblem(w, r, statusNotFound, "not found")
+			return
+		}
+
+		output := svc.DeleteAlias(r.Context(), param["alias"])
+		writeJSON(w, r, output.Code, &output)
+	}
+}
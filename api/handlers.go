@@ -4,19 +4,22 @@ import (
 	"backstreetlinkv2/api/helper"
 	"backstreetlinkv2/api/model"
 	"backstreetlinkv2/api/service"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/gorilla/mux"
-	"github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
 const (
-	statusBadReq      = http.StatusBadRequest
-	statusNotFound    = http.StatusNotFound
-	statusInternalErr = http.StatusInternalServerError
-	fileMaxSize       = 10 << 20
+	statusBadReq   = http.StatusBadRequest
+	statusNotFound = http.StatusNotFound
 )
 
 func CreateLink(svc *service.Deps) http.HandlerFunc {
@@ -27,27 +30,28 @@ func CreateLink(svc *service.Deps) http.HandlerFunc {
 
 		err := decodeJSONLinkRequest(r.Body, &request)
 		if err != nil {
-			w.WriteHeader(statusBadReq)
-			sendJSONErr(w, statusBadReq, err.Error())
+			helper.WriteProblem(w, r, helper.ProblemFromErr(err))
 			return
 		}
 
 		output := svc.InsertLink(r.Context(), request)
-		w.WriteHeader(output.Code)
-		if err := json.NewEncoder(w).Encode(output); err != nil {
-			log.Err(err)
-		}
+		writeJSON(w, r, output.Code, &output)
 	}
 }
 
-func CreateFile(svc *service.Deps) http.HandlerFunc {
+func CreateFile(svc *service.Deps, limits *Limits) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
+		fileMaxSize := limits.FileMaxSize()
+		if r.ContentLength > fileMaxSize {
+			sendProblem(w, r, helper.KindTooLarge, fmt.Sprintf("the request must not exceed %d bytes", fileMaxSize))
+			return
+		}
+
 		r.Body = http.MaxBytesReader(w, r.Body, fileMaxSize)
 		if err := r.ParseMultipartForm(fileMaxSize); err != nil {
-			w.WriteHeader(statusBadReq)
-			sendJSONErr(w, statusBadReq, err.Error())
+			sendProblem(w, r, multipartKind(err), err.Error())
 			return
 		}
 
@@ -58,26 +62,32 @@ func CreateFile(svc *service.Deps) http.HandlerFunc {
 		jsonReader := strings.NewReader(r.FormValue("json_field"))
 		err := decodeJSONLinkRequest(jsonReader, &request)
 		if err != nil {
-			w.WriteHeader(statusBadReq)
-			sendJSONErr(w, statusBadReq, err.Error())
+			helper.WriteProblem(w, r, helper.ProblemFromErr(err))
 			return
 		}
 
-		file, header, err := r.FormFile("file_field")
-		if err != nil {
-			w.WriteHeader(statusBadReq)
-			sendJSONErr(w, statusBadReq, err.Error())
+		headers := r.MultipartForm.File["file_field"]
+		if len(headers) == 0 {
+			sendProblem(w, r, statusBadReq, http.ErrMissingFile.Error())
 			return
 		}
 
-		request.RawFile = file
-		request.Filename = header.Filename
+		// every file_field part is a file of the alias
+		for _, header := range headers {
+			file, err := header.Open()
+			if err != nil {
+				sendProblem(w, r, statusBadReq, err.Error())
+				return
+			}
 
-		output := svc.InsertFile(r.Context(), request)
-		w.WriteHeader(output.Code)
-		if err := json.NewEncoder(w).Encode(output); err != nil {
-			log.Err(err)
+			request.Parts = append(request.Parts, model.FilePart{Filename: header.Filename, File: file})
 		}
+
+		request.RawFile = request.Parts[0].File
+		request.Filename = request.Parts[0].Filename
+
+		output := svc.InsertFile(r.Context(), request)
+		writeJSON(w, r, output.Code, &output)
 	}
 
 }
@@ -88,16 +98,14 @@ func Find(svc *service.Deps) http.HandlerFunc {
 
 		param := mux.Vars(r)
 		if _, ok := param["alias"]; !ok {
-			w.WriteHeader(statusNotFound)
-			sendJSONErr(w, statusNotFound, "not found")
+			sendProblem(w, r, statusNotFound, "not found")
 			return
 		}
 
-		output := svc.Find(r.Context(), param["alias"])
-		w.WriteHeader(output.Code)
-		if err := json.NewEncoder(w).Encode(output); err != nil {
-			log.Err(err)
-		}
+		resolve, _ := strconv.ParseBool(r.URL.Query().Get("resolve"))
+
+		output := svc.Find(r.Context(), param["alias"], service.FindOptions{Resolve: resolve})
+		writeJSON(w, r, output.Code, &output)
 	}
 }
 
@@ -105,43 +113,120 @@ func DownloadFile(svc *service.Deps) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		param := mux.Vars(r)
 		if _, ok := param["alias"]; !ok {
-			w.WriteHeader(statusNotFound)
-			w.Header().Set("Content-Type", "application/json")
-			sendJSONErr(w, statusNotFound, "not found")
+			sendProblem(w, r, statusNotFound, "not found")
 			return
 		}
 
-		output := svc.DownloadFile(r.Context(), param["alias"])
-		if output.Code >= 400 && output.Code <= 599 {
-			w.WriteHeader(output.Code)
-			w.Header().Set("Content-Type", "application/json")
-			if err := json.NewEncoder(w).Encode(output); err != nil {
-				log.Err(err)
-			}
+		query := r.URL.Query()
+		inline, _ := strconv.ParseBool(query.Get("inline"))
+
+		output := svc.DownloadFile(r.Context(), param["alias"], service.DownloadOptions{File: query.Get("file"), Inline: inline})
+		if output.Err() != nil {
+			writeJSON(w, r, output.Code, &output)
 			return
 		}
 
 		w.Header().Set("Content-Disposition", output.ContentDisposition)
+		w.Header().Set("Content-Type", output.ContentType)
+
+		// only the types that run nothing are inline, the browser must not sniff another one
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+
+		if output.Limited {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+
+		if output.WriteTo != nil {
+			// the zip is written as the files are read, a failure cuts it short
+			if err := output.WriteTo(w); err != nil {
+				zerolog.Ctx(r.Context()).Err(err).Msg("can't send the archive")
+			}
+			return
+		}
+
+		w.Header().Set("Content-Length", output.ContentLength)
+
+		if sum, err := hex.DecodeString(output.SHA256); err == nil && len(sum) > 0 {
+			w.Header().Set("ETag", `"`+output.SHA256+`"`)
+			w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum))
+		}
+
+		// the headers are gone once the copy starts, a failure can only be logged
+		_, err := io.Copy(w, output.File)
+		if err != nil {
+			zerolog.Ctx(r.Context()).Err(err).Msg("can't send the file")
+		}
+	}
+}
+
+func Preview(svc *service.Deps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		param := mux.Vars(r)
+		if _, ok := param["alias"]; !ok {
+			sendProblem(w, r, statusNotFound, "not found")
+			return
+		}
+
+		query := r.URL.Query()
+		opts := service.PreviewOptions{File: query.Get("file")}
+
+		if size := query.Get("size"); size != "" {
+			var err error
+			if opts.Size, err = strconv.Atoi(size); err != nil {
+				sendProblem(w, r, statusBadReq, service.ErrPreviewSize.Error())
+				return
+			}
+		}
+
+		output := svc.Preview(r.Context(), param["alias"], opts)
+		if output.Err() != nil {
+			writeJSON(w, r, output.Code, &output)
+			return
+		}
+
 		w.Header().Set("Content-Type", output.ContentType)
 		w.Header().Set("Content-Length", output.ContentLength)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
 
 		_, err := io.Copy(w, output.File)
 		if err != nil {
-			log.Err(err)
-			w.WriteHeader(statusInternalErr)
-			sendJSONErr(w, statusInternalErr, err.Error())
+			zerolog.Ctx(r.Context()).Err(err).Msg("can't send the preview")
 		}
 	}
 }
 
-func sendJSONErr(w io.Writer, code int, msg string) {
-	m := map[string]any{
-		"status": code,
-		"msg":    msg,
+// multipartKind tells an oversized or a non multipart body from a malformed one
+func multipartKind(err error) helper.Kind {
+	switch {
+	case errors.Is(err, http.ErrNotMultipart):
+		return helper.KindUnsupported
+	// http.MaxBytesError needs go 1.19, the message is all there is
+	case strings.Contains(err.Error(), "request body too large"):
+		return helper.KindTooLarge
+	default:
+		return helper.KindBadRequest
 	}
+}
 
-	if err := json.NewEncoder(w).Encode(m); err != nil {
-		log.Err(err)
+// sendProblem answers with a problem of the given status and the default code of that status
+func sendProblem(w http.ResponseWriter, r *http.Request, code int, detail string) {
+	helper.WriteProblem(w, r, helper.NewProblem(code, "", detail))
+}
+
+type outputErr interface {
+	Err() error
+}
+
+// writeJSON writes the service output, or its error as a problem
+func writeJSON(w http.ResponseWriter, r *http.Request, code int, output outputErr) {
+	if err := output.Err(); err != nil {
+		helper.WriteProblem(w, r, helper.ProblemFromErr(err))
+		return
+	}
+
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(output); err != nil {
+		zerolog.Ctx(r.Context()).Err(err).Msg("can't encode the response")
 	}
 }
 
@@ -150,7 +235,7 @@ func decodeJSONLinkRequest[inType helper.Request](r io.Reader, in *inType) error
 	decoder.DisallowUnknownFields()
 
 	if err := decoder.Decode(&in); err != nil {
-		return err
+		return helper.E("api.decodeJSONLinkRequest", helper.KindBadRequest, err, err.Error())
 	}
 
 	if err := helper.ValidateStruct(*in); err != nil {
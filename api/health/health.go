@@ -0,0 +1,180 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/rs/zerolog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StatusOK       = "ok"
+	StatusDegraded = "degraded"
+	StatusFailing  = "failing"
+)
+
+var (
+	ErrShuttingDown = errors.New("server is shutting down")
+)
+
+// Check reports whether a dependency is usable, it must return once ctx is done
+type Check func(ctx context.Context) error
+
+type check struct {
+	name string
+	fn   Check
+
+	// critical checks flip the readiness, the others only report a degraded status
+	critical bool
+}
+
+// Checker runs the dependency checks behind /readyz
+type Checker struct {
+	timeout      time.Duration
+	checks       []check
+	shuttingDown int32
+}
+
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout}
+}
+
+// Add registers a check that makes the server not ready when it fails
+func (c *Checker) Add(name string, fn Check) {
+	c.checks = append(c.checks, check{name: name, fn: fn, critical: true})
+}
+
+// AddOptional registers a check that is reported but never makes the server not ready,
+// e.g. the cache since every lookup falls through to the db
+func (c *Checker) AddOptional(name string, fn Check) {
+	c.checks = append(c.checks, check{name: name, fn: fn})
+}
+
+// SetShuttingDown makes the readiness fail so the load balancer stops sending traffic
+func (c *Checker) SetShuttingDown() {
+	atomic.StoreInt32(&c.shuttingDown, 1)
+}
+
+func (c *Checker) ShuttingDown() bool {
+	return atomic.LoadInt32(&c.shuttingDown) == 1
+}
+
+type CheckResult struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+	critical bool
+}
+
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// Run executes every check concurrently, each one bounded by the checker timeout
+func (c *Checker) Run(ctx context.Context) Report {
+	results := make([]CheckResult, len(c.checks))
+
+	var wg sync.WaitGroup
+	for i, chk := range c.checks {
+		wg.Add(1)
+
+		go func(i int, chk check) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := runCheck(ctx, chk.fn)
+
+			results[i] = CheckResult{
+				Status:   StatusOK,
+				Duration: time.Since(start).String(),
+				critical: chk.critical,
+			}
+
+			if err != nil {
+				results[i].Status = StatusFailing
+				results[i].Error = err.Error()
+			}
+		}(i, chk)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]CheckResult, len(c.checks))}
+
+	for i, chk := range c.checks {
+		result := results[i]
+		report.Checks[chk.name] = result
+
+		if result.Status == StatusOK {
+			continue
+		}
+
+		if result.critical {
+			report.Status = StatusFailing
+		} else if report.Status == StatusOK {
+			report.Status = StatusDegraded
+		}
+	}
+
+	if c.ShuttingDown() {
+		report.Status = StatusFailing
+		report.Checks["shutdown"] = CheckResult{Status: StatusFailing, Error: ErrShuttingDown.Error()}
+	}
+
+	return report
+}
+
+// runCheck returns as soon as ctx is done even if the check ignores it
+func runCheck(ctx context.Context, fn Check) error {
+	done := make(chan error, 1)
+
+	go func() {
+		done <- fn(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Live answers as long as the process is able to serve http
+func (c *Checker) Live() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		if err := json.NewEncoder(w).Encode(map[string]string{"status": StatusOK}); err != nil {
+			zerolog.Ctx(r.Context()).Err(err).Msg("can't encode the response")
+		}
+	}
+}
+
+// Ready answers 503 when a critical dependency fails or the server is shutting down
+func (c *Checker) Ready() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := c.Run(r.Context())
+
+		code := http.StatusOK
+		if report.Status == StatusFailing {
+			code = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			zerolog.Ctx(r.Context()).Err(err).Msg("can't encode the response")
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func ok(context.Context) error { return nil }
+
+func failing(context.Context) error { return errors.New("connection refused") }
+
+func hanging(ctx context.Context) error {
+	time.Sleep(time.Second)
+	return nil
+}
+
+func TestChecker_Ready(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		setup      func(c *Checker)
+		wantCode   int
+		wantStatus string
+	}{
+		{
+			name: "all ok",
+			setup: func(c *Checker) {
+				c.Add("mysql", ok)
+				c.AddOptional("cache", ok)
+			},
+			wantCode:   http.StatusOK,
+			wantStatus: StatusOK,
+		},
+
+		{
+			name: "optional failing",
+			setup: func(c *Checker) {
+				c.Add("mysql", ok)
+				c.AddOptional("cache", failing)
+			},
+			wantCode:   http.StatusOK,
+			wantStatus: StatusDegraded,
+		},
+
+		{
+			name: "critical failing",
+			setup: func(c *Checker) {
+				c.Add("mysql", failing)
+				c.AddOptional("cache", ok)
+			},
+			wantCode:   http.StatusServiceUnavailable,
+			wantStatus: StatusFailing,
+		},
+
+		{
+			name: "critical timeout",
+			setup: func(c *Checker) {
+				c.Add("s3", hanging)
+			},
+			wantCode:   http.StatusServiceUnavailable,
+			wantStatus: StatusFailing,
+		},
+
+		{
+			name: "shutting down",
+			setup: func(c *Checker) {
+				c.Add("mysql", ok)
+				c.SetShuttingDown()
+			},
+			wantCode:   http.StatusServiceUnavailable,
+			wantStatus: StatusFailing,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			checker := NewChecker(50 * time.Millisecond)
+			tt.setup(checker)
+
+			rec := httptest.NewRecorder()
+			checker.Ready()(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			if rec.Code != tt.wantCode {
+				t.Errorf("code = %d, want %d", rec.Code, tt.wantCode)
+			}
+
+			var report Report
+			if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+				t.Fatalf("can't decode the report: %v", err)
+			}
+
+			if report.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", report.Status, tt.wantStatus)
+			}
+		})
+	}
+}
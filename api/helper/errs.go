@@ -1,6 +1,8 @@
 package helper
 
 import (
+	"context"
+	"errors"
 	"net/http"
 )
 
@@ -14,9 +16,18 @@ type (
 
 // common error status code
 const (
-	KindNotFound   = http.StatusNotFound
-	KindBadRequest = http.StatusBadRequest
-	KindUnexpected = http.StatusInternalServerError
+	KindBadRequest   = http.StatusBadRequest
+	KindUnauthorized = http.StatusUnauthorized
+	KindForbidden    = http.StatusForbidden
+	KindNotFound     = http.StatusNotFound
+	KindConflict     = http.StatusConflict
+	KindGone         = http.StatusGone
+	KindTooLarge     = http.StatusRequestEntityTooLarge
+	KindUnsupported  = http.StatusUnsupportedMediaType
+	KindRateLimited  = http.StatusTooManyRequests
+	KindUnexpected   = http.StatusInternalServerError
+	KindUnavailable  = http.StatusServiceUnavailable
+	KindTimeout      = http.StatusGatewayTimeout
 )
 
 type Error struct {
@@ -30,6 +41,11 @@ func (e Error) Error() string {
 	return e.ClientMsg
 }
 
+// Unwrap lets errors.Is and errors.As reach the wrapped error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
 func E(op Op, kind Kind, err Err, clientMsg string) error {
 	return &Error{
 		Op:        op,
@@ -69,17 +85,21 @@ func TraceErr(err error) []error {
 	}
 }
 
+// GetKind returns the first kind set along the chain of *Error,
+// an error without kind is a timeout when a deadline was hit and unexpected otherwise
 func GetKind(err error) Kind {
-	for {
-		e, ok := err.(*Error)
-		if !ok {
-			return KindUnexpected
-		}
-
+	var e *Error
+	for errors.As(err, &e) {
 		if e.Kind != 0 {
 			return e.Kind
 		}
 
-		err = e
+		err = e.Err
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return KindTimeout
 	}
+
+	return KindUnexpected
 }
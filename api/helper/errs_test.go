@@ -0,0 +1,112 @@
+package helper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+var errRoot = errors.New("root cause")
+
+func TestGetKind(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want Kind
+	}{
+		{
+			name: "direct",
+			err:  E("repo.Insert", KindConflict, errRoot, "taken"),
+			want: KindConflict,
+		},
+		{
+			name: "outer kind wins",
+			err:  E("service.Insert", KindGone, E("repo.Insert", KindNotFound, errRoot, "missing"), "expired"),
+			want: KindGone,
+		},
+		{
+			name: "nested without kind",
+			err:  E("service.Insert", 0, E("repo.Insert", KindTooLarge, errRoot, "too big"), "too big"),
+			want: KindTooLarge,
+		},
+		{
+			name: "no kind at all",
+			err:  E("service.Insert", 0, E("repo.Insert", 0, errRoot, "oops"), "oops"),
+			want: KindUnexpected,
+		},
+		{
+			name: "wrapped by fmt",
+			err:  fmt.Errorf("handler: %w", E("repo.Get", KindUnavailable, errRoot, "down")),
+			want: KindUnavailable,
+		},
+		{
+			name: "deadline",
+			err:  fmt.Errorf("query: %w", context.DeadlineExceeded),
+			want: KindTimeout,
+		},
+		{
+			name: "plain error",
+			err:  errRoot,
+			want: KindUnexpected,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done := make(chan Kind, 1)
+			go func() { done <- GetKind(tt.err) }()
+
+			select {
+			case got := <-done:
+				if got != tt.want {
+					t.Errorf("GetKind() = %d, want %d", got, tt.want)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("GetKind() doesn't return")
+			}
+		})
+	}
+}
+
+func TestError_Unwrap(t *testing.T) {
+	err := E("service.Find", KindNotFound, E("repo.Get", KindNotFound, errRoot, "not found"), "not found")
+
+	if !errors.Is(err, errRoot) {
+		t.Errorf("errors.Is() should find the root cause")
+	}
+
+	var e *Error
+	if !errors.As(fmt.Errorf("wrapped: %w", err), &e) || e.Op != "service.Find" {
+		t.Errorf("errors.As() = %+v, want the outer *Error", e)
+	}
+
+	if ops := Ops(err); len(ops) != 2 || ops[1] != "repo.Get" {
+		t.Errorf("Ops() = %v", ops)
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		kind Kind
+		want string
+	}{
+		{KindConflict, CodeConflict},
+		{KindGone, CodeGone},
+		{KindTooLarge, CodeTooLarge},
+		{KindUnsupported, CodeUnsupported},
+		{KindUnauthorized, CodeUnauthorized},
+		{KindForbidden, CodeForbidden},
+		{KindUnavailable, CodeUnavailable},
+		{KindTimeout, CodeTimeout},
+		{418, CodeBadRequest},
+		{502, CodeInternal},
+	}
+
+	for _, tt := range tests {
+		if got := ErrorCode(tt.kind); got != tt.want {
+			t.Errorf("ErrorCode(%d) = %q, want %q", tt.kind, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package helper
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-playground/validator/v10"
+	"github.com/rs/zerolog"
+	"net/http"
+)
+
+const (
+	ProblemContentType = "application/problem+json"
+	problemTypeBase    = "https://backstreet.link/problems/"
+)
+
+// stable error codes, clients should match on them instead of the message
+const (
+	CodeBadRequest   = "bad_request"
+	CodeValidation   = "validation_failed"
+	CodeUnauthorized = "unauthorized"
+	CodeForbidden    = "forbidden"
+	CodeNotFound     = "not_found"
+	CodeConflict     = "conflict"
+	CodeGone         = "gone"
+	CodeTooLarge     = "payload_too_large"
+	CodeUnsupported  = "unsupported_media_type"
+	CodeRateLimited  = "rate_limited"
+	CodeInternal     = "internal_error"
+	CodeUnavailable  = "unavailable"
+	CodeTimeout      = "timeout"
+)
+
+var statusCodes = map[Kind]string{
+	KindBadRequest:   CodeBadRequest,
+	KindUnauthorized: CodeUnauthorized,
+	KindForbidden:    CodeForbidden,
+	KindNotFound:     CodeNotFound,
+	KindConflict:     CodeConflict,
+	KindGone:         CodeGone,
+	KindTooLarge:     CodeTooLarge,
+	KindUnsupported:  CodeUnsupported,
+	KindRateLimited:  CodeRateLimited,
+	KindUnexpected:   CodeInternal,
+	KindUnavailable:  CodeUnavailable,
+	KindTimeout:      CodeTimeout,
+}
+
+// ErrorCode maps a kind, which is also the http status, to its error code
+func ErrorCode(kind Kind) string {
+	if code, ok := statusCodes[kind]; ok {
+		return code
+	}
+
+	if kind >= 500 {
+		return CodeInternal
+	}
+
+	return CodeBadRequest
+}
+
+// Problem is the RFC 7807 body of every error response
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Code      string       `json:"code"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+	Fields    []FieldError `json:"fields,omitempty"`
+}
+
+// NewProblem builds the problem of the given status, code defaults to the one of the status
+func NewProblem(status int, code, detail string) Problem {
+	if code == "" {
+		code = ErrorCode(status)
+	}
+
+	return Problem{
+		Type:   problemTypeBase + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+		Detail: detail,
+	}
+}
+
+// ProblemFromErr classifies err by its kind, validation errors are detailed per field
+func ProblemFromErr(err error) Problem {
+	var validationErrs validator.ValidationErrors
+	if errors.As(err, &validationErrs) {
+		problem := NewProblem(http.StatusBadRequest, CodeValidation, "the request has invalid fields")
+		problem.Fields = FieldErrors(validationErrs)
+
+		return problem
+	}
+
+	// only the client message of an *Error is safe to show
+	kind := GetKind(err)
+
+	var e *Error
+	if !errors.As(err, &e) {
+		return NewProblem(kind, "", http.StatusText(kind))
+	}
+
+	return NewProblem(kind, "", e.Error())
+}
+
+// WriteProblem sends the problem with the path and the request id it belongs to
+func WriteProblem(w http.ResponseWriter, r *http.Request, problem Problem) {
+	problem.Instance = r.URL.Path
+	problem.RequestID = RequestID(r.Context())
+
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(problem.Status)
+
+	if err := json.NewEncoder(w).Encode(problem); err != nil {
+		zerolog.Ctx(r.Context()).Err(err).Msg("can't encode the response")
+	}
+}
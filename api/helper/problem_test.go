@@ -0,0 +1,118 @@
+package helper
+
+import (
+	"backstreetlinkv2/api/model"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProblemFromErr(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+		wantDetail string
+	}{
+		{
+			name:       "helper error",
+			err:        E("repo.Get", KindNotFound, errors.New("sql: no rows"), "alias not found"),
+			wantStatus: http.StatusNotFound,
+			wantCode:   CodeNotFound,
+			wantDetail: "alias not found",
+		},
+		{
+			name:       "unknown error hides its message",
+			err:        errors.New("dial tcp 10.0.0.1:3306: connection refused"),
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   CodeInternal,
+			wantDetail: http.StatusText(http.StatusInternalServerError),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problem := ProblemFromErr(tt.err)
+
+			if problem.Status != tt.wantStatus || problem.Code != tt.wantCode || problem.Detail != tt.wantDetail {
+				t.Errorf("ProblemFromErr() = %+v, want status %d, code %s, detail %q", problem, tt.wantStatus, tt.wantCode, tt.wantDetail)
+			}
+
+			if problem.Type != problemTypeBase+tt.wantCode {
+				t.Errorf("Type = %q", problem.Type)
+			}
+		})
+	}
+}
+
+func TestProblemFromErr_Validation(t *testing.T) {
+	err := ValidateStruct(model.ShortenRequest{Alias: "abc", Type: model.TypeLink, RedirectTo: "not an url"})
+
+	problem := ProblemFromErr(err)
+	if problem.Status != http.StatusBadRequest || problem.Code != CodeValidation {
+		t.Fatalf("ProblemFromErr() = %+v, want a validation problem", problem)
+	}
+
+	want := []FieldError{
+		{Field: "alias", Rule: "min", Message: "must be at least 5 characters long"},
+		{Field: "redirect_to", Rule: "url", Message: "must be a valid url"},
+	}
+
+	if len(problem.Fields) != len(want) {
+		t.Fatalf("Fields = %+v, want %+v", problem.Fields, want)
+	}
+
+	for i := range want {
+		if problem.Fields[i] != want[i] {
+			t.Errorf("Fields[%d] = %+v, want %+v", i, problem.Fields[i], want[i])
+		}
+	}
+}
+
+func TestProblemFromErr_NestedValidation(t *testing.T) {
+	err := ValidateStruct(model.ShortenFileRequest{
+		Alias:      "myreport",
+		Type:       model.TypeFile,
+		Encryption: &model.Encryption{Algorithm: model.AlgorithmAESGCMChunked, Nonce: "AAAAAAAAAAAAAAAA", ChunkSize: 10},
+	})
+
+	want := FieldError{Field: "encryption.chunk_size", Rule: "min", Message: "must be at least 1024"}
+	if problem := ProblemFromErr(err); len(problem.Fields) != 1 || problem.Fields[0] != want {
+		t.Errorf("Fields = %+v, want [%+v]", problem.Fields, want)
+	}
+}
+
+func TestWriteProblem(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/api/v2/find/someone", nil)
+	req = req.WithContext(WithRequestID(context.Background(), "req-1"))
+	rec := httptest.NewRecorder()
+
+	WriteProblem(rec, req, NewProblem(http.StatusTooManyRequests, "", "slow down"))
+
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Content-Type") != ProblemContentType {
+		t.Fatalf("status = %d, content type = %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	var got Problem
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := Problem{
+		Type:      problemTypeBase + CodeRateLimited,
+		Title:     "Too Many Requests",
+		Status:    http.StatusTooManyRequests,
+		Code:      CodeRateLimited,
+		Detail:    "slow down",
+		Instance:  "/api/v2/find/someone",
+		RequestID: "req-1",
+	}
+
+	if got.Type != want.Type || got.Title != want.Title || got.Code != want.Code || got.Instance != want.Instance || got.RequestID != want.RequestID {
+		t.Errorf("WriteProblem() body = %+v, want %+v", got, want)
+	}
+}
@@ -2,16 +2,34 @@ package helper
 
 import (
 	"backstreetlinkv2/api/model"
+	"fmt"
 	"github.com/go-playground/validator/v10"
+	"reflect"
+	"strings"
 )
 
 type Request interface {
 	model.ShortenRequest | model.ShortenFileRequest
 }
 
-func ValidateStruct[T Request](data T) error {
-	validate := validator.New()
+var validate = newValidator()
+
+// newValidator reports the fields by their json name so the details match the request body
+func newValidator() *validator.Validate {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+
+		return name
+	})
+
+	return v
+}
 
+func ValidateStruct[T Request](data T) error {
 	err := validate.Struct(data)
 
 	if err != nil {
@@ -20,3 +38,61 @@ func ValidateStruct[T Request](data T) error {
 
 	return nil
 }
+
+// FieldError is the validation failure of one field of the request
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// FieldErrors translates the validator errors into messages meant for the client
+func FieldErrors(errs validator.ValidationErrors) []FieldError {
+	out := make([]FieldError, 0, len(errs))
+
+	for _, e := range errs {
+		// the namespace starts with the struct name, a nested field is reported as encryption.nonce
+		_, field, _ := strings.Cut(e.Namespace(), ".")
+
+		out = append(out, FieldError{
+			Field:   field,
+			Rule:    e.Tag(),
+			Message: fieldMessage(e),
+		})
+	}
+
+	return out
+}
+
+func fieldMessage(e validator.FieldError) string {
+	switch e.Tag() {
+	case "required":
+		return "is required"
+	case "min":
+		if e.Kind() == reflect.Int {
+			return fmt.Sprintf("must be at least %s", e.Param())
+		}
+		return fmt.Sprintf("must be at least %s characters long", e.Param())
+	case "max":
+		if e.Kind() == reflect.Int {
+			return fmt.Sprintf("must be at most %s", e.Param())
+		}
+		return fmt.Sprintf("must be at most %s characters long", e.Param())
+	case "alphanum":
+		return "must only contain letters and digits"
+	case "url":
+		return "must be a valid url"
+	case "eq":
+		return fmt.Sprintf("must be %s", e.Param())
+	case "oneof":
+		return fmt.Sprintf("must be one of %s", e.Param())
+	case "len":
+		return fmt.Sprintf("must be %s characters long", e.Param())
+	case "hexadecimal":
+		return "must be hexadecimal"
+	case "base64":
+		return "must be base64"
+	default:
+		return fmt.Sprintf("fails the %s rule", e.Tag())
+	}
+}
@@ -0,0 +1,161 @@
+// Package kms wraps the data keys of the objects encrypted with SSE-C.
+//
+// Every blob has its own random data key, S3 encrypts the object with it and only its
+// wrapped form, sealed by a master key, is stored with the blob. Rotating a master key
+// re-wraps the data keys, the objects are left as they are.
+package kms
+
+import (
+	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/api/model"
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DataKeySize is the size of the AES-256 keys S3 encrypts the objects with
+const DataKeySize = 32
+
+var (
+	ErrUnknownKey = errors.New("unknown master key")
+	ErrUnwrap     = errors.New("the data key can't be unwrapped")
+)
+
+// KeyRing seals the data keys, a real kms or the Local stand-in
+type KeyRing interface {
+	// CurrentID is the master key Wrap uses
+	CurrentID() string
+	Wrap(ctx context.Context, dataKey []byte) (model.DataKey, error)
+	Unwrap(ctx context.Context, key model.DataKey) ([]byte, error)
+}
+
+// MasterKey is a key of the ring, 32 bytes
+type MasterKey struct {
+	ID  string
+	Key []byte
+}
+
+// Local keeps the master keys in memory, the last one given wraps the new data keys
+type Local struct {
+	keys    map[string]cipher.AEAD
+	current string
+}
+
+func NewLocal(keys []MasterKey) (*Local, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("kms: no master key")
+	}
+
+	l := &Local{keys: make(map[string]cipher.AEAD, len(keys))}
+
+	for _, key := range keys {
+		if key.ID == "" || strings.ContainsAny(key.ID, " \t\n") {
+			return nil, fmt.Errorf("kms: invalid master key id %q", key.ID)
+		}
+
+		if len(key.Key) != DataKeySize {
+			return nil, fmt.Errorf("kms: master key %s must be %d bytes, got %d", key.ID, DataKeySize, len(key.Key))
+		}
+
+		block, err := aes.NewCipher(key.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		l.keys[key.ID] = aead
+		l.current = key.ID
+	}
+
+	return l, nil
+}
+
+// ReadKeys parses a keys file, one "<id> <base64 key>" per line, the blank lines and
+// the lines starting with # are skipped
+func ReadKeys(r io.Reader) ([]MasterKey, error) {
+	var keys []MasterKey
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("kms: line %d: want <id> <base64 key>", line)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("kms: line %d: the key is not base64: %w", line, err)
+		}
+
+		keys = append(keys, MasterKey{ID: fields[0], Key: key})
+	}
+
+	return keys, scanner.Err()
+}
+
+func (l *Local) CurrentID() string {
+	return l.current
+}
+
+// Wrap seals dataKey with the current master key, the id is the additional data
+// so a wrapped key can't be passed off as sealed by another master key
+func (l *Local) Wrap(_ context.Context, dataKey []byte) (model.DataKey, error) {
+	const op = helper.Op("kms.Local.Wrap")
+
+	nonce := make([]byte, l.keys[l.current].NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return model.DataKey{}, helper.E(op, helper.KindUnexpected, err, "can't wrap the data key")
+	}
+
+	wrapped := l.keys[l.current].Seal(nonce, nonce, dataKey, []byte(l.current))
+
+	return model.DataKey{KeyID: l.current, Wrapped: wrapped}, nil
+}
+
+func (l *Local) Unwrap(_ context.Context, key model.DataKey) ([]byte, error) {
+	const op = helper.Op("kms.Local.Unwrap")
+
+	aead, ok := l.keys[key.KeyID]
+	if !ok {
+		return nil, helper.E(op, helper.KindUnexpected, ErrUnknownKey, fmt.Sprintf("master key %q is not in the ring", key.KeyID))
+	}
+
+	if len(key.Wrapped) < aead.NonceSize() {
+		return nil, helper.E(op, helper.KindUnexpected, ErrUnwrap, ErrUnwrap.Error())
+	}
+
+	nonce, sealed := key.Wrapped[:aead.NonceSize()], key.Wrapped[aead.NonceSize():]
+
+	dataKey, err := aead.Open(nil, nonce, sealed, []byte(key.KeyID))
+	if err != nil {
+		return nil, helper.E(op, helper.KindUnexpected, ErrUnwrap, ErrUnwrap.Error())
+	}
+
+	return dataKey, nil
+}
+
+// NewDataKey returns a random data key for a new object
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, DataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
@@ -0,0 +1,173 @@
+package kms
+
+import (
+	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/api/model"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func masterKey(id string, b byte) MasterKey {
+	return MasterKey{ID: id, Key: bytes.Repeat([]byte{b}, DataKeySize)}
+}
+
+func TestLocal_Wrap(t *testing.T) {
+	ctx := context.Background()
+
+	old, err := NewLocal([]MasterKey{masterKey("old", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ring, err := NewLocal([]MasterKey{masterKey("old", 1), masterKey("new", 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataKey, _ := NewDataKey()
+
+	wrapped, err := old.Wrap(ctx, dataKey)
+	if err != nil || wrapped.KeyID != "old" {
+		t.Fatalf("Wrap() = %+v, %v", wrapped, err)
+	}
+
+	// the ring still reads the keys of its older master keys
+	got, err := ring.Unwrap(ctx, wrapped)
+	if err != nil || !bytes.Equal(got, dataKey) {
+		t.Fatalf("Unwrap() = %x, %v, want %x", got, err, dataKey)
+	}
+
+	if ring.CurrentID() != "new" {
+		t.Errorf("CurrentID() = %s, want new", ring.CurrentID())
+	}
+
+	forged := model.DataKey{KeyID: "new", Wrapped: wrapped.Wrapped}
+	if _, err := ring.Unwrap(ctx, forged); !errors.Is(err, ErrUnwrap) {
+		t.Errorf("Unwrap() under another id error = %v, want ErrUnwrap", err)
+	}
+
+	if _, err := old.Unwrap(ctx, model.DataKey{KeyID: "new", Wrapped: wrapped.Wrapped}); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Unwrap() with a missing master key error = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestReadKeys(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, DataKeySize))
+
+	tests := []struct {
+		name    string
+		file    string
+		wantIDs []string
+		wantErr bool
+	}{
+		{name: "keys", file: "# rotated on 2024-05-01\n2024-01 " + key + "\n\n2024-05 " + key + "\n", wantIDs: []string{"2024-01", "2024-05"}},
+		{name: "missing key", file: "2024-01\n", wantErr: true},
+		{name: "not base64", file: "2024-01 !!!\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := ReadKeys(strings.NewReader(tt.file))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var ids []string
+			for _, key := range keys {
+				ids = append(ids, key.ID)
+			}
+
+			if strings.Join(ids, ",") != strings.Join(tt.wantIDs, ",") {
+				t.Errorf("ReadKeys() ids = %v, want %v", ids, tt.wantIDs)
+			}
+		})
+	}
+}
+
+type fakeStore struct {
+	blobs map[string]model.DataKey
+
+	// deleted is removed right before its rewrap, as by a concurrent delete
+	deleted string
+}
+
+func (f *fakeStore) StaleKeys(_ context.Context, currentID, after string, limit int) ([]model.Blob, error) {
+	var hashes []string
+	for hash, key := range f.blobs {
+		if hash > after && key.KeyID != currentID {
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Strings(hashes)
+
+	if len(hashes) > limit {
+		hashes = hashes[:limit]
+	}
+
+	blobs := make([]model.Blob, len(hashes))
+	for i, hash := range hashes {
+		blobs[i] = model.Blob{SHA256: hash, Key: f.blobs[hash]}
+	}
+
+	return blobs, nil
+}
+
+func (f *fakeStore) Rewrap(_ context.Context, hash string, old, key model.DataKey) error {
+	if hash == f.deleted {
+		delete(f.blobs, hash)
+	}
+
+	current, ok := f.blobs[hash]
+	if !ok || current.KeyID != old.KeyID || !bytes.Equal(current.Wrapped, old.Wrapped) {
+		return helper.E("fakeStore.Rewrap", helper.KindConflict, errors.New("changed"), "changed")
+	}
+
+	f.blobs[hash] = key
+	return nil
+}
+
+func TestRotate(t *testing.T) {
+	ctx := context.Background()
+
+	old, _ := NewLocal([]MasterKey{masterKey("old", 1)})
+	ring, _ := NewLocal([]MasterKey{masterKey("old", 1), masterKey("new", 2)})
+
+	store := &fakeStore{blobs: map[string]model.DataKey{}, deleted: "blob-042"}
+	dataKeys := map[string][]byte{}
+
+	// more than a batch so the pages are followed
+	for i := 0; i < rotateBatch+20; i++ {
+		hash := fmt.Sprintf("blob-%03d", i)
+		dataKeys[hash], _ = NewDataKey()
+
+		w := old
+		if i%10 == 0 {
+			w = ring
+		}
+
+		store.blobs[hash], _ = w.Wrap(ctx, dataKeys[hash])
+	}
+
+	report, err := Rotate(ctx, ring, store)
+	if err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+
+	if report.Rewrapped != 107 || report.Skipped != 1 {
+		t.Errorf("Rotate() = %+v, want 107 rewrapped and 1 skipped", report)
+	}
+
+	newOnly, _ := NewLocal([]MasterKey{masterKey("new", 2)})
+	for hash, key := range store.blobs {
+		got, err := newOnly.Unwrap(ctx, key)
+		if err != nil || !bytes.Equal(got, dataKeys[hash]) {
+			t.Fatalf("blob %s: Unwrap() = %x, %v, want its data key", hash, got, err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package kms
+
+import (
+	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/api/model"
+	"context"
+)
+
+const rotateBatch = 100
+
+// Store keeps the wrapped data keys of the blobs, repo.MYSQLRepo is one
+type Store interface {
+	// StaleKeys returns the blobs after the hash after whose key isn't wrapped by currentID
+	StaleKeys(ctx context.Context, currentID, after string, limit int) ([]model.Blob, error)
+
+	// Rewrap replaces the key of the blob if it still is old, KindConflict otherwise
+	Rewrap(ctx context.Context, hash string, old, key model.DataKey) error
+}
+
+// RotateReport counts the data keys handled by Rotate
+type RotateReport struct {
+	Rewrapped int `json:"rewrapped"`
+
+	// Skipped are the blobs deleted or rotated by someone else meanwhile
+	Skipped int `json:"skipped"`
+}
+
+// Rotate re-wraps with the current master key the data keys wrapped by the others, the
+// objects keep their data key so nothing is uploaded again. The old master keys can be
+// dropped from the ring once it is done.
+func Rotate(ctx context.Context, ring KeyRing, store Store) (RotateReport, error) {
+	const op = helper.Op("kms.Rotate")
+
+	var report RotateReport
+	after := ""
+
+	for {
+		blobs, err := store.StaleKeys(ctx, ring.CurrentID(), after, rotateBatch)
+		if err != nil {
+			return report, helper.E(op, helper.GetKind(err), err, "can't list the keys to rotate")
+		}
+
+		for _, blob := range blobs {
+			dataKey, err := ring.Unwrap(ctx, blob.Key)
+			if err != nil {
+				return report, helper.E(op, helper.GetKind(err), err, "can't unwrap the key of blob "+blob.SHA256)
+			}
+
+			key, err := ring.Wrap(ctx, dataKey)
+			if err != nil {
+				return report, helper.E(op, helper.GetKind(err), err, "can't wrap the key of blob "+blob.SHA256)
+			}
+
+			err = store.Rewrap(ctx, blob.SHA256, blob.Key, key)
+			if helper.GetKind(err) == helper.KindConflict {
+				report.Skipped++
+				continue
+			}
+
+			if err != nil {
+				return report, helper.E(op, helper.GetKind(err), err, "can't store the key of blob "+blob.SHA256)
+			}
+
+			report.Rewrapped++
+		}
+
+		if len(blobs) < rotateBatch {
+			return report, nil
+		}
+
+		after = blobs[len(blobs)-1].SHA256
+	}
+}
@@ -0,0 +1,21 @@
+package api
+
+import "sync/atomic"
+
+// Limits are the request limits of the handlers, they can be changed while the server runs
+type Limits struct {
+	fileMaxSize int64
+}
+
+func NewLimits(fileMaxSize int64) *Limits {
+	return &Limits{fileMaxSize: fileMaxSize}
+}
+
+// FileMaxSize is the biggest multipart body accepted by CreateFile
+func (l *Limits) FileMaxSize() int64 {
+	return atomic.LoadInt64(&l.fileMaxSize)
+}
+
+func (l *Limits) SetFileMaxSize(size int64) {
+	atomic.StoreInt64(&l.fileMaxSize, size)
+}
@@ -0,0 +1,165 @@
+package metrics
+
+import (
+	"database/sql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const namespace = "backstreet"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route template, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route template and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	rateLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_rate_limited_total",
+		Help:      "Requests rejected by the rate limiter.",
+	})
+
+	dbDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "MySQL query latency by query name.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"query"})
+
+	dbErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "db_query_errors_total",
+		Help:      "MySQL query errors by query name.",
+	}, []string{"query"})
+
+	objectDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "object_storage_duration_seconds",
+		Help:      "Object storage call latency by operation.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"operation"})
+
+	objectBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "object_storage_bytes_total",
+		Help:      "Bytes sent to (upload) and received from (download) object storage.",
+	}, []string{"operation"})
+
+	objectErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "object_storage_errors_total",
+		Help:      "Object storage errors by operation.",
+	}, []string{"operation"})
+)
+
+// Handler serves the metrics in the prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+func ObserveRequest(route, method string, code int, start time.Time) {
+	httpRequests.WithLabelValues(route, method, strconv.Itoa(code)).Inc()
+	httpDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+}
+
+func IncRateLimited() {
+	rateLimited.Inc()
+}
+
+// ObserveQuery records the latency of a query, err is the error returned by the driver
+func ObserveQuery(query string, start time.Time, err error) {
+	dbDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		dbErrors.WithLabelValues(query).Inc()
+	}
+}
+
+// ObserveObject records an object storage call, size is the bytes moved by it
+func ObserveObject(operation string, start time.Time, size int64, err error) {
+	objectDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		objectErrors.WithLabelValues(operation).Inc()
+		return
+	}
+
+	if size > 0 {
+		objectBytes.WithLabelValues(operation).Add(float64(size))
+	}
+}
+
+// RegisterDB exports the connection pool stats of db
+func RegisterDB(db *sql.DB, name string) error {
+	return prometheus.Register(collectors.NewDBStatsCollector(db, name))
+}
+
+// CacheCounters mirrors the cache statistics, it lives here so the metrics don't depend on the repo
+type CacheCounters struct {
+	Hits        int64
+	Misses      int64
+	Collisions  int64
+	Expirations int64
+	Evictions   int64
+	Entries     int
+}
+
+// RegisterCache exports the counters returned by stats, it is called on every scrape
+func RegisterCache(stats func() CacheCounters) error {
+	return prometheus.Register(&cacheCollector{stats: stats})
+}
+
+var (
+	cacheHitsDesc        = prometheus.NewDesc(namespace+"_cache_hits_total", "Cache lookups that found the key.", nil, nil)
+	cacheMissesDesc      = prometheus.NewDesc(namespace+"_cache_misses_total", "Cache lookups that missed the key.", nil, nil)
+	cacheCollisionsDesc  = prometheus.NewDesc(namespace+"_cache_collisions_total", "Cache key collisions.", nil, nil)
+	cacheExpirationsDesc = prometheus.NewDesc(namespace+"_cache_expirations_total", "Cache entries removed because they expired.", nil, nil)
+	cacheEvictionsDesc   = prometheus.NewDesc(namespace+"_cache_evictions_total", "Cache entries removed because the cache was full.", nil, nil)
+	cacheEntriesDesc     = prometheus.NewDesc(namespace+"_cache_entries", "Entries currently in the cache.", nil, nil)
+	cacheHitRatioDesc    = prometheus.NewDesc(namespace+"_cache_hit_ratio", "Hits divided by lookups since the process started.", nil, nil)
+)
+
+type cacheCollector struct {
+	stats func() CacheCounters
+}
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheHitsDesc
+	ch <- cacheMissesDesc
+	ch <- cacheCollisionsDesc
+	ch <- cacheExpirationsDesc
+	ch <- cacheEvictionsDesc
+	ch <- cacheEntriesDesc
+	ch <- cacheHitRatioDesc
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.stats()
+
+	var ratio float64
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		ratio = float64(stats.Hits) / float64(lookups)
+	}
+
+	ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(cacheCollisionsDesc, prometheus.CounterValue, float64(stats.Collisions))
+	ch <- prometheus.MustNewConstMetric(cacheExpirationsDesc, prometheus.CounterValue, float64(stats.Expirations))
+	ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(stats.Evictions))
+	ch <- prometheus.MustNewConstMetric(cacheEntriesDesc, prometheus.GaugeValue, float64(stats.Entries))
+	ch <- prometheus.MustNewConstMetric(cacheHitRatioDesc, prometheus.GaugeValue, ratio)
+}
@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestObserveRequest(t *testing.T) {
+	ObserveRequest("/api/v2/find/{alias}", "GET", 404, time.Now())
+
+	got := testutil.ToFloat64(httpRequests.WithLabelValues("/api/v2/find/{alias}", "GET", "404"))
+	if got != 1 {
+		t.Errorf("http_requests_total = %v, want 1", got)
+	}
+}
+
+func TestCacheCollector(t *testing.T) {
+	collector := &cacheCollector{stats: func() CacheCounters {
+		return CacheCounters{Hits: 3, Misses: 1, Entries: 2}
+	}}
+
+	expected := `
+# HELP backstreet_cache_hit_ratio Hits divided by lookups since the process started.
+# TYPE backstreet_cache_hit_ratio gauge
+backstreet_cache_hit_ratio 0.75
+`
+
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "backstreet_cache_hit_ratio"); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,25 +1,41 @@
 package middleware
 
 import (
+	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/api/metrics"
+	"backstreetlinkv2/api/tracing"
 	"backstreetlinkv2/pkg"
-	"encoding/json"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"github.com/gorilla/mux"
 	"github.com/rs/cors"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/semconv/v1.17.0/httpconv"
+	"go.opentelemetry.io/otel/trace"
+	"math"
+	"net"
 	"net/http"
 	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/time/rate"
 )
 
-var limiter = rate.NewLimiter(rate.Every(time.Second), 3)
-
 // Recoverer will recover the program when panic is triggered
 func Recoverer(next http.Handler) http.Handler {
 	f := func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if rvr := recover(); rvr != nil {
-				log.Error().
+				zerolog.Ctx(r.Context()).Error().
 					Stack().
 					Str("type", "recover_panic").
 					Timestamp().
@@ -32,13 +48,7 @@ func Recoverer(next http.Handler) http.Handler {
 					panic(rvr)
 				}
 
-				w.WriteHeader(http.StatusInternalServerError)
-				if err := json.NewEncoder(w).Encode(map[string]any{
-					"code": http.StatusInternalServerError,
-					"msg":  http.StatusText(http.StatusInternalServerError),
-				}); err != nil {
-					log.Err(err)
-				}
+				helper.WriteProblem(w, r, helper.NewProblem(helper.KindUnexpected, "", "the server panicked while serving the request"))
 			}
 		}()
 
@@ -65,7 +75,7 @@ func OnlyJSONRequest(next http.Handler) http.Handler {
 		header := r.Header.Get("Content-Type")
 
 		if header != "application/json" {
-			json.NewEncoder(w).Encode(map[string]string{"error": "header must be application/json"})
+			helper.WriteProblem(w, r, helper.NewProblem(helper.KindUnsupported, "", "header must be application/json"))
 			return
 		}
 
@@ -75,13 +85,30 @@ func OnlyJSONRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(f)
 }
 
+// Limiter rejects the requests above the configured rate, it is shared by the whole server
+type Limiter struct {
+	limiter *rate.Limiter
+}
+
+// NewLimiter allows rps requests per second on average with bursts of up to burst requests
+func NewLimiter(rps float64, burst int) *Limiter {
+	return &Limiter{limiter: rate.NewLimiter(rate.Limit(rps), burst)}
+}
+
+// SetPolicy changes the rate and the burst without resetting the tokens already taken
+func (l *Limiter) SetPolicy(rps float64, burst int) {
+	l.limiter.SetLimit(rate.Limit(rps))
+	l.limiter.SetBurst(burst)
+}
+
 // Limit implements the rate limiter for the server
-// The value of rate limiter is 3 request/s
-func Limit(next http.Handler) http.Handler {
+func (l *Limiter) Limit(next http.Handler) http.Handler {
 	f := func(w http.ResponseWriter, r *http.Request) {
-		if !limiter.Allow() {
-			w.WriteHeader(http.StatusTooManyRequests)
-			json.NewEncoder(w).Encode(map[string]string{"error": "too many requests, try again later"})
+		if !l.limiter.Allow() {
+			metrics.IncRateLimited()
+
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter(l.limiter.Limit())))
+			helper.WriteProblem(w, r, helper.NewProblem(helper.KindRateLimited, "", "too many requests, try again later"))
 			return
 		}
 
@@ -92,30 +119,50 @@ func Limit(next http.Handler) http.Handler {
 	return http.HandlerFunc(f)
 }
 
-func CORS(environment string) func(handler http.Handler) http.Handler {
-	if environment == "PRODUCTION" {
-		c := cors.New(cors.Options{
-			AllowedOrigins: []string{"https://backstreet.link", "https://www.backstreet.link"},
-			AllowedMethods: []string{"GET", "POST", "OPTIONS"},
-			AllowedHeaders: []string{"Content-Type", "Origin", "Authorization"},
-			Debug:          false,
-		})
+// noTokensRetryAfter is sent when the limit is 0, no token is ever earned so there is no right time
+const noTokensRetryAfter = 60
 
-		return func(handler http.Handler) http.Handler {
-			return c.Handler(handler)
-		}
+// retryAfter is the number of seconds it takes to earn a new token, at least 1
+func retryAfter(limit rate.Limit) int {
+	switch {
+	case limit == rate.Inf:
+		return 1
+	case limit <= 0:
+		return noTokensRetryAfter
 	}
 
-	c := cors.New(cors.Options{
-		AllowedOrigins: []string{"*"},
+	return int(math.Max(1, math.Ceil(1/float64(limit))))
+}
+
+// CORS only lets the configured origins call the api, "*" allows any origin.
+// The origins can be replaced while the server runs.
+type CORS struct {
+	policy atomic.Value // *cors.Cors
+}
+
+func NewCORS(origins []string) *CORS {
+	c := &CORS{}
+	c.SetOrigins(origins)
+
+	return c
+}
+
+// SetOrigins swaps the allowed origins, the requests in flight keep the previous ones
+func (c *CORS) SetOrigins(origins []string) {
+	c.policy.Store(cors.New(cors.Options{
+		AllowedOrigins: origins,
 		AllowedMethods: []string{"GET", "POST", "OPTIONS"},
 		AllowedHeaders: []string{"Content-Type", "Origin", "Authorization"},
 		Debug:          false,
-	})
+	}))
+}
 
-	return func(handler http.Handler) http.Handler {
-		return c.Handler(handler)
+func (c *CORS) Handler(next http.Handler) http.Handler {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		c.policy.Load().(*cors.Cors).ServeHTTP(w, r, next.ServeHTTP)
 	}
+
+	return http.HandlerFunc(f)
 }
 
 func Captcha(secretKey string) func(handler http.Handler) http.Handler {
@@ -123,12 +170,316 @@ func Captcha(secretKey string) func(handler http.Handler) http.Handler {
 		f := func(w http.ResponseWriter, r *http.Request) {
 			code, err := pkg.ValidateCaptcha(r.Context(), secretKey, r.Header.Get("CF-TURNSTILE-RESPONSE"))
 			if err != nil {
-				w.WriteHeader(code)
-				json.NewEncoder(w).Encode(map[string]any{"error": err})
+				helper.WriteProblem(w, r, helper.NewProblem(code, "", err.Error()))
 				return
 			}
+
+			handler.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(f)
+	}
+}
+
+// AdminOnly rejects the request unless it carries "Authorization: Bearer <apiKey>".
+// An empty apiKey disables every admin route.
+func AdminOnly(apiKey string) func(handler http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		f := func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			token := strings.TrimPrefix(header, "Bearer ")
+
+			if apiKey == "" || token == header || subtle.ConstantTimeCompare([]byte(token), []byte(apiKey)) != 1 {
+				helper.WriteProblem(w, r, helper.NewProblem(helper.KindUnauthorized, "", "a valid admin api key is required"))
+				return
+			}
+
+			handler.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(f)
+	}
+}
+
+const (
+	RequestIDHeader = "X-Request-ID"
+	maxRequestIDLen = 128
+)
+
+// RequestID reuses the X-Request-ID sent by the client or the proxy, or generates one.
+// The id is sent back, stored in the context and added to every log line of the request.
+func RequestID(next http.Handler) http.Handler {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+
+		logger := log.Logger.With().Str("request_id", id).Logger()
+		ctx := helper.WithRequestID(logger.WithContext(r.Context()), id)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+
+	return http.HandlerFunc(f)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// AccessLog writes one line per request once the handler is done, it wraps the router so the
+// requests no route matches are logged too. X-Forwarded-For is only believed from the trusted proxies.
+func AccessLog(proxies TrustedProxies) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		f := func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+			info, r := withRouteInfo(r)
+			next.ServeHTTP(recorder, r)
+
+			route := info.template
+			if route == "" {
+				route = r.URL.Path
+			}
+
+			logger := zerolog.Ctx(r.Context())
+
+			event := logger.Info()
+			if recorder.status >= http.StatusInternalServerError {
+				event = logger.Error()
+			}
+
+			event.
+				Str("type", "access").
+				Str("method", r.Method).
+				Str("route", route).
+				Str("path", r.URL.Path).
+				Int("status", recorder.status).
+				Int64("bytes", recorder.bytes).
+				Dur("latency", time.Since(start)).
+				Str("client_ip", proxies.ClientIP(r)).
+				Str("alias", info.alias).
+				Str("user_agent", r.UserAgent()).
+				Msg("request served")
 		}
 
 		return http.HandlerFunc(f)
 	}
 }
+
+// TrustedProxies are the networks of the proxies in front of the app, the only peers whose
+// X-Forwarded-For is believed
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies reads CIDRs or single addresses
+func ParseTrustedProxies(proxies []string) (TrustedProxies, error) {
+	var trusted TrustedProxies
+	for _, proxy := range proxies {
+		if ip := net.ParseIP(proxy); ip != nil {
+			trusted = append(trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, err
+		}
+
+		trusted = append(trusted, network)
+	}
+
+	return trusted, nil
+}
+
+func (p TrustedProxies) contains(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClientIP is the peer of the connection, or when it is a trusted proxy the last address of
+// X-Forwarded-For not added by a trusted proxy. The first addresses are whatever the client sent.
+func (p TrustedProxies) ClientIP(r *http.Request) string {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+
+	if !p.contains(addr) {
+		return addr
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+
+		addr = hop
+		if !p.contains(hop) {
+			break
+		}
+	}
+
+	return addr
+}
+
+type routeKey struct{}
+
+// routeInfo is what mux matched, mux hands it to the handlers only so Route fills it
+// for the middlewares wrapping the router
+type routeInfo struct {
+	template string
+	alias    string
+}
+
+// Route records the route template and the alias matched by mux, it is registered on the
+// router. A request mux doesn't match, a 404 or a 405, has none.
+func Route(next http.Handler) http.Handler {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		if info, ok := r.Context().Value(routeKey{}).(*routeInfo); ok {
+			if current := mux.CurrentRoute(r); current != nil {
+				if tmpl, err := current.GetPathTemplate(); err == nil {
+					info.template = tmpl
+				}
+			}
+
+			info.alias = mux.Vars(r)["alias"]
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(f)
+}
+
+// withRouteInfo returns the routeInfo Route fills, shared by the middlewares wrapping the router
+func withRouteInfo(r *http.Request) (*routeInfo, *http.Request) {
+	if info, ok := r.Context().Value(routeKey{}).(*routeInfo); ok {
+		return info, r
+	}
+
+	info := &routeInfo{}
+	return info, r.WithContext(context.WithValue(r.Context(), routeKey{}, info))
+}
+
+// Metrics records the count and latency of every request by its route template, it wraps
+// the router so the requests no route matches are counted too
+func Metrics(next http.Handler) http.Handler {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		info, r := withRouteInfo(r)
+		next.ServeHTTP(recorder, r)
+
+		route := info.template
+		if route == "" {
+			route = "unmatched"
+		}
+
+		metrics.ObserveRequest(route, r.Method, recorder.status, start)
+	}
+
+	return http.HandlerFunc(f)
+}
+
+// statusRecorder keeps the status code and the body size written by the handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if !s.wroteHeader {
+		s.status = code
+		s.wroteHeader = true
+	}
+
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Trace starts a server span for every request, continuing the trace found in the W3C headers
+func Trace(next http.Handler) http.Handler {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		// the route is known once mux matched the request, the span is renamed after it.
+		// The context of the handler derives from the one holding info for Route to fill it.
+		info, r := withRouteInfo(r)
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		ctx, span := tracing.Tracer().Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(httpconv.ServerRequest("", r)...),
+		)
+		defer span.End()
+
+		if sc := span.SpanContext(); sc.IsValid() {
+			logger := zerolog.Ctx(ctx).With().Str("trace_id", sc.TraceID().String()).Logger()
+			ctx = logger.WithContext(ctx)
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		if info.template != "" {
+			span.SetName(r.Method + " " + info.template)
+			span.SetAttributes(semconv.HTTPRouteKey.String(info.template))
+		}
+
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(recorder.status))
+		span.SetStatus(httpconv.ServerStatus(recorder.status))
+	}
+
+	return http.HandlerFunc(f)
+}
@@ -0,0 +1,321 @@
+package middleware
+
+import (
+	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/api/metrics"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = helper.RequestID(r.Context())
+	}))
+
+	t.Run("propagated", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(RequestIDHeader, "abc-123")
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		if seen != "abc-123" || rec.Header().Get(RequestIDHeader) != "abc-123" {
+			t.Errorf("request id = %q, header = %q, want abc-123", seen, rec.Header().Get(RequestIDHeader))
+		}
+	})
+
+	t.Run("generated", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(RequestIDHeader, "has spaces\n")
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		if len(seen) != 32 || rec.Header().Get(RequestIDHeader) != seen {
+			t.Errorf("request id = %q, header = %q", seen, rec.Header().Get(RequestIDHeader))
+		}
+	})
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+
+	original := log.Logger
+	log.Logger = zerolog.New(&buf)
+	t.Cleanup(func() { log.Logger = original })
+
+	propagator := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTextMapPropagator(propagator) })
+
+	proxies, err := ParseTrustedProxies([]string{"192.0.2.0/24", "10.0.0.2"})
+	if err != nil {
+		t.Fatalf("ParseTrustedProxies() error = %v", err)
+	}
+
+	router := mux.NewRouter()
+	router.Use(Route)
+	router.HandleFunc("/find/{alias}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("nope"))
+	})
+
+	handler := RequestID(Trace(AccessLog(proxies)(router)))
+
+	tests := []struct {
+		name       string
+		path       string
+		remoteAddr string
+		forwarded  string
+		want       map[string]any
+	}{
+		{
+			name:       "behind the trusted proxies",
+			path:       "/find/someone",
+			remoteAddr: "192.0.2.1:1234",
+			forwarded:  "203.0.113.9, 198.51.100.7, 10.0.0.2",
+			want: map[string]any{
+				"route":     "/find/{alias}",
+				"status":    float64(http.StatusNotFound),
+				"bytes":     float64(4),
+				"client_ip": "198.51.100.7",
+				"alias":     "someone",
+			},
+		},
+		{
+			name:       "forwarded by a client",
+			path:       "/find/someone",
+			remoteAddr: "198.51.100.7:1234",
+			forwarded:  "10.0.0.1",
+			want:       map[string]any{"client_ip": "198.51.100.7"},
+		},
+		{
+			name:       "unmatched",
+			path:       "/missing",
+			remoteAddr: "198.51.100.7:1234",
+			want: map[string]any{
+				"route":  "/missing",
+				"status": float64(http.StatusNotFound),
+				"alias":  "",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set(RequestIDHeader, "req-1")
+			req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			var line map[string]any
+			if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+				t.Fatalf("access log is not json: %v, %s", err, buf.String())
+			}
+
+			tt.want["request_id"] = "req-1"
+			tt.want["trace_id"] = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+			for key, value := range tt.want {
+				if line[key] != value {
+					t.Errorf("%s = %v, want %v", key, line[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestTrace_Route(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(trace.NewNoopTracerProvider()) })
+
+	router := mux.NewRouter()
+	router.Use(Route)
+	router.HandleFunc("/find/{alias}", func(w http.ResponseWriter, r *http.Request) {}).Methods(http.MethodGet)
+
+	handler := Trace(router)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/find/someone", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/missing", nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("ended spans = %d, want 2", len(spans))
+	}
+
+	route := func(span sdktrace.ReadOnlySpan) string {
+		for _, attr := range span.Attributes() {
+			if attr.Key == semconv.HTTPRouteKey {
+				return attr.Value.AsString()
+			}
+		}
+
+		return ""
+	}
+
+	if spans[0].Name() != "GET /find/{alias}" || route(spans[0]) != "/find/{alias}" {
+		t.Errorf("span = %q with route %q, want GET /find/{alias}", spans[0].Name(), route(spans[0]))
+	}
+
+	if spans[1].Name() != "GET" || route(spans[1]) != "" {
+		t.Errorf("span of an unmatched request = %q with route %q, want GET without route", spans[1].Name(), route(spans[1]))
+	}
+}
+
+func TestLimiter_SetPolicy(t *testing.T) {
+	limiter := NewLimiter(0.001, 1)
+	handler := limiter.Limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func() int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec.Code
+	}
+
+	if code := serve(); code != http.StatusOK {
+		t.Fatalf("first request = %d, want %d", code, http.StatusOK)
+	}
+
+	if code := serve(); code != http.StatusTooManyRequests {
+		t.Fatalf("second request = %d, want %d", code, http.StatusTooManyRequests)
+	}
+
+	limiter.SetPolicy(1000, 10)
+	time.Sleep(10 * time.Millisecond)
+
+	if code := serve(); code != http.StatusOK {
+		t.Errorf("request after SetPolicy = %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit rate.Limit
+		want  int
+	}{
+		{name: "one per second", limit: 1, want: 1},
+		{name: "one every ten seconds", limit: 0.1, want: 10},
+		{name: "one every two and a half seconds", limit: 0.4, want: 3},
+		{name: "faster than one per second", limit: 50, want: 1},
+		{name: "infinite", limit: rate.Inf, want: 1},
+		{name: "zero", limit: 0, want: noTokensRetryAfter},
+		{name: "negative", limit: -1, want: noTokensRetryAfter},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryAfter(tt.limit); got != tt.want {
+				t.Errorf("retryAfter(%v) = %d, want %d", tt.limit, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCORS_SetOrigins(t *testing.T) {
+	policy := NewCORS([]string{"https://a.example"})
+	handler := policy.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	allowed := func(origin string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Origin", origin)
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		return rec.Header().Get("Access-Control-Allow-Origin") == origin
+	}
+
+	if !allowed("https://a.example") || allowed("https://b.example") {
+		t.Fatalf("only https://a.example should be allowed")
+	}
+
+	policy.SetOrigins([]string{"https://b.example"})
+
+	if allowed("https://a.example") || !allowed("https://b.example") {
+		t.Errorf("only https://b.example should be allowed after SetOrigins")
+	}
+}
+
+func TestAdminOnly(t *testing.T) {
+	handler := AdminOnly("secret")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{name: "bearer", authorization: "Bearer secret", want: http.StatusOK},
+		{name: "no scheme", authorization: "secret", want: http.StatusUnauthorized},
+		{name: "wrong key", authorization: "Bearer other", want: http.StatusUnauthorized},
+		{name: "missing", want: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("code = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetrics_Unmatched(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(Route)
+	router.HandleFunc("/find/{alias}", func(w http.ResponseWriter, r *http.Request) {}).Methods(http.MethodGet)
+
+	handler := Metrics(router)
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/find/someone", nil),
+		httptest.NewRequest(http.MethodGet, "/missing", nil),
+		httptest.NewRequest(http.MethodPost, "/find/someone", nil),
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	for _, want := range []string{
+		`backstreet_http_requests_total{code="200",method="GET",route="/find/{alias}"} 1`,
+		`backstreet_http_requests_total{code="404",method="GET",route="unmatched"} 1`,
+		`backstreet_http_requests_total{code="405",method="POST",route="unmatched"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics miss %s", want)
+		}
+	}
+}
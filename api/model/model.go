@@ -10,6 +10,10 @@ import (
 const (
 	TypeLink = "LINK"
 	TypeFile = "FILE"
+
+	// AlgorithmAESGCMChunked is AES-256-GCM over chunks of ChunkSize bytes, each sealed with
+	// the nonce xor its index and the last one marked so a truncated file doesn't decrypt
+	AlgorithmAESGCMChunked = "AES-256-GCM-CHUNKED"
 )
 
 var (
@@ -27,13 +31,60 @@ type ShortenRequest struct {
 	Alias      string `json:"alias" validate:"required,min=5,max=30,alphanum"`
 	Type       string `json:"type" validate:"eq=LINK"`
 	RedirectTo string `json:"redirect_to" validate:"url"`
+
+	// MaxClicks is how many times the link resolves before it is gone, unlimited when zero
+	MaxClicks int `json:"max_clicks,omitempty" validate:"omitempty,min=1"`
 }
 
 type ShortenFileRequest struct {
-	Alias    string         `json:"alias" validate:"required,min=5,max=30,alphanum"`
-	Filename string         `json:"filename"`
-	Type     string         `json:"type" validate:"oneof='FILE'"`
-	RawFile  multipart.File `json:"-"`
+	Alias    string `json:"alias" validate:"required,min=5,max=30,alphanum"`
+	Filename string `json:"filename"`
+	Type     string `json:"type" validate:"oneof='FILE'"`
+
+	// SHA256 is the hex checksum the client expects, the upload is refused when the file doesn't match it
+	SHA256 string `json:"sha256,omitempty" validate:"omitempty,len=64,hexadecimal"`
+
+	// Encryption is set when the client encrypted the file, the server stores the ciphertext as is
+	Encryption *Encryption    `json:"encryption,omitempty"`
+	RawFile    multipart.File `json:"-"`
+
+	// MaxDownloads is how many times the file is served before it is deleted, unlimited when zero.
+	// BurnAfterRead deletes it after the first download.
+	MaxDownloads  int  `json:"max_downloads,omitempty" validate:"omitempty,min=1"`
+	BurnAfterRead bool `json:"burn_after_read,omitempty"`
+
+	// Parts are the files of an alias sharing several, RawFile and Filename are the first one
+	Parts []FilePart `json:"-"`
+}
+
+// FilePart is a file of the multipart request
+type FilePart struct {
+	Filename string
+	File     multipart.File
+}
+
+// FileEntry is a file of an alias sharing several, stored as a blob like a single file
+type FileEntry struct {
+	Name        string     `json:"name"`
+	Size        int64      `json:"size"`
+	SHA256      string     `json:"sha256"`
+	ContentType string     `json:"content_type,omitempty"`
+	Image       *ImageInfo `json:"image,omitempty"`
+}
+
+// ImageInfo are the dimensions of an uploaded image, read when it is stored
+type ImageInfo struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Encryption describes how a file was encrypted by the client, the key never reaches the server
+type Encryption struct {
+	Algorithm string `json:"algorithm" validate:"oneof=AES-256-GCM-CHUNKED"`
+
+	// Nonce is the base64 nonce of the first chunk
+	Nonce     string `json:"nonce" validate:"required,base64,len=16"`
+	ChunkSize int    `json:"chunk_size" validate:"min=1024,max=16777216"`
 }
 
 type ShortenResponse struct {
@@ -41,6 +92,49 @@ type ShortenResponse struct {
 	Alias      string `json:"alias"`
 	RedirectTo string `json:"redirect_to"`
 	Filename   string `json:"filename"`
+
+	// SHA256 is the hex checksum of the file, empty for the files uploaded before the deduplication
+	SHA256 string `json:"sha256,omitempty"`
+
+	Encryption *Encryption `json:"encryption,omitempty"`
+
+	// ContentType is sniffed from the file on upload, empty for the older files and the encrypted ones
+	ContentType string     `json:"content_type,omitempty"`
+	Image       *ImageInfo `json:"image,omitempty"`
+
+	// Files is the manifest of an alias sharing several files, empty for a single file
+	Files []FileEntry `json:"files,omitempty"`
+
+	MaxClicks     int  `json:"max_clicks,omitempty"`
+	MaxDownloads  int  `json:"max_downloads,omitempty"`
+	BurnAfterRead bool `json:"burn_after_read,omitempty"`
+}
+
+// Limit is how many times the alias is used before it is gone, zero when it is unlimited
+func (s ShortenResponse) Limit() int {
+	switch {
+	case s.Type == TypeLink:
+		return s.MaxClicks
+	case s.BurnAfterRead:
+		return 1
+	default:
+		return s.MaxDownloads
+	}
+}
+
+// Blob is the content of an uploaded file, stored once however many aliases point at it
+type Blob struct {
+	SHA256 string
+	Size   int64
+
+	// Key is the data key of the object encrypted with SSE-C, zero when it is stored in the clear
+	Key DataKey
+}
+
+// DataKey is the key of an object sealed by a master key, the master key stays in the key ring
+type DataKey struct {
+	KeyID   string
+	Wrapped []byte
 }
 
 func (s ShortenResponse) Value() (driver.Value, error) {
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/api/model"
+	"backstreetlinkv2/api/repo"
+	"backstreetlinkv2/api/service"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type openAPIDoc struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+func loadSpec(t *testing.T) openAPIDoc {
+	t.Helper()
+
+	var doc openAPIDoc
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		t.Fatalf("openapi.json is not valid json: %v", err)
+	}
+
+	return doc
+}
+
+func newTestRouter() *mux.Router {
+	return NewRouter(service.NewLinkDeps(nil, nil, nil), RouterConfig{Limits: NewLimits(1)})
+}
+
+func TestOpenAPI_Routes(t *testing.T) {
+	doc := loadSpec(t)
+
+	documented := map[string]bool{}
+	for path, operations := range doc.Paths {
+		for method := range operations {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	served := map[string]bool{}
+	err := newTestRouter().Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(path, "/api/v2/") {
+			return nil
+		}
+
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		for _, method := range methods {
+			served[method+" "+path] = true
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(served) == 0 {
+		t.Fatal("no route found under /api/v2")
+	}
+
+	for route := range served {
+		if !documented[route] {
+			t.Errorf("%s is served but missing from openapi.json", route)
+		}
+	}
+
+	for route := range documented {
+		if !served[route] {
+			t.Errorf("%s is in openapi.json but not served", route)
+		}
+	}
+}
+
+func TestOpenAPI_Schemas(t *testing.T) {
+	doc := loadSpec(t)
+
+	types := map[string]any{
+		"ShortenRequest":     model.ShortenRequest{},
+		"ShortenFileRequest": model.ShortenFileRequest{},
+		"ShortenResponse":    model.ShortenResponse{},
+		"FileEntry":          model.FileEntry{},
+		"ImageInfo":          model.ImageInfo{},
+		"InsertLinkOutput":   service.InsertLinkOutput{},
+		"InsertFileOutput":   service.InsertFileOutput{},
+		"FindOutput":         service.FindOutput{},
+		"CacheEntryOutput":   service.CacheEntryOutput{},
+		"EvictCacheOutput":   service.EvictCacheOutput{},
+		"FlushCacheOutput":   service.FlushCacheOutput{},
+		"CacheStatsOutput":   service.CacheStatsOutput{},
+		"DeleteAliasOutput":  service.DeleteAliasOutput{},
+		"CacheStats":         repo.CacheStats{},
+		"Problem":            helper.Problem{},
+		"FieldError":         helper.FieldError{},
+	}
+
+	for name, value := range types {
+		schema, ok := doc.Components.Schemas[name]
+		if !ok {
+			t.Errorf("schema %s is missing from openapi.json", name)
+			continue
+		}
+
+		var documented []string
+		for property := range schema.Properties {
+			documented = append(documented, property)
+		}
+		sort.Strings(documented)
+
+		fields := jsonFields(reflect.TypeOf(value))
+		sort.Strings(fields)
+
+		if !reflect.DeepEqual(documented, fields) {
+			t.Errorf("schema %s has %v, the go type has %v", name, documented, fields)
+		}
+	}
+}
+
+// jsonFields lists the names encoding/json gives to the fields of t, embedded structs are flattened
+func jsonFields(t reflect.Type) []string {
+	var names []string
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			names = append(names, jsonFields(f.Type)...)
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		names = append(names, name)
+	}
+
+	return names
+}
+
+func TestOpenAPI_Served(t *testing.T) {
+	router := newTestRouter()
+
+	for path, contentType := range map[string]string{
+		"/api/v2/openapi.json":              "application/json",
+		"/api/v2/docs":                      "text/html; charset=utf-8",
+		"/api/v2/docs/swagger-ui.css":       "text/css; charset=utf-8",
+		"/api/v2/docs/swagger-ui-bundle.js": "text/javascript; charset=utf-8",
+	} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != contentType {
+			t.Errorf("GET %s = %d %q, want 200 %q", path, rec.Code, rec.Header().Get("Content-Type"), contentType)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Package preview tells the files a browser can safely show inline and makes the
+// thumbnails of the images, in pure Go.
+package preview
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"net/http"
+)
+
+const (
+	DefaultSize = 256
+
+	// MaxPixels keeps a small file decoding into a huge image out
+	MaxPixels = 50_000_000
+
+	jpegQuality = 85
+)
+
+// Sizes are the bounding boxes of the thumbnails, each one is stored once made
+var Sizes = []int{128, 256, 512}
+
+var (
+	ErrUnsupported = errors.New("no preview for this type of file")
+	ErrTooLarge    = errors.New("the image is too large to preview")
+)
+
+// inline are the types shown by the browsers without running anything, svg and html are not
+var inline = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+	"text/plain":      true,
+	"video/mp4":       true,
+	"video/webm":      true,
+	"audio/mpeg":      true,
+	"audio/wave":      true,
+	"audio/ogg":       true,
+}
+
+var images = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// Inline tells if a file of contentType can be served inline
+func Inline(contentType string) bool {
+	return inline[mediaType(contentType)]
+}
+
+// IsImage tells if Thumbnail can decode a file of contentType
+func IsImage(contentType string) bool {
+	return images[mediaType(contentType)]
+}
+
+func mediaType(contentType string) string {
+	media, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+
+	return media
+}
+
+// Sniff returns the content type of the file and the dimensions of an image, zero otherwise.
+// r is read from its start, the caller rewinds it.
+func Sniff(r io.Reader) (contentType string, width, height int, err error) {
+	head := make([]byte, 512)
+
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", 0, 0, err
+	}
+
+	contentType = http.DetectContentType(head[:n])
+	if !IsImage(contentType) {
+		return contentType, 0, 0, nil
+	}
+
+	// a truncated or lying image is still stored, it only has no dimensions
+	config, _, err := image.DecodeConfig(io.MultiReader(bytes.NewReader(head[:n]), r))
+	if err != nil {
+		return contentType, 0, 0, nil
+	}
+
+	return contentType, config.Width, config.Height, nil
+}
+
+// ValidSize tells if size is one of Sizes
+func ValidSize(size int) bool {
+	for _, s := range Sizes {
+		if s == size {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Thumbnail scales the image down to fit in size x size, the jpegs stay jpegs and the
+// others become pngs to keep their transparency
+func Thumbnail(src []byte, size int) ([]byte, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(src))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+
+	if config.Width*config.Height > MaxPixels {
+		return nil, "", ErrTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+
+	width, height := fit(config.Width, config.Height, size)
+
+	thumb := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: jpegQuality})
+		return buf.Bytes(), "image/jpeg", err
+	}
+
+	err = png.Encode(&buf, thumb)
+	return buf.Bytes(), "image/png", err
+}
+
+// fit keeps the aspect ratio, the smaller images are not scaled up
+func fit(width, height, size int) (int, int) {
+	switch {
+	case width <= size && height <= size:
+		return width, height
+	case width >= height:
+		return size, atLeastOne(height * size / width)
+	default:
+		return atLeastOne(width * size / height), size
+	}
+}
+
+func atLeastOne(n int) int {
+	if n < 1 {
+		return 1
+	}
+
+	return n
+}
@@ -0,0 +1,103 @@
+package preview
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func encode(t *testing.T, format string, width, height int) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		img.Set(x, height/2, color.RGBA{R: 255, A: 255})
+	}
+
+	var buf bytes.Buffer
+	var err error
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, img, nil)
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestThumbnail(t *testing.T) {
+	tests := []struct {
+		name            string
+		src             []byte
+		size            int
+		wantType        string
+		wantW, wantH    int
+		wantUnsupported bool
+	}{
+		{name: "landscape png", src: encode(t, "png", 1000, 500), size: 256, wantType: "image/png", wantW: 256, wantH: 128},
+		{name: "portrait jpeg", src: encode(t, "jpeg", 300, 900), size: 128, wantType: "image/jpeg", wantW: 42, wantH: 128},
+		{name: "small image kept", src: encode(t, "png", 40, 30), size: 128, wantType: "image/png", wantW: 40, wantH: 30},
+		{name: "not an image", src: []byte("%PDF-1.4"), size: 128, wantUnsupported: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, contentType, err := Thumbnail(tt.src, tt.size)
+			if tt.wantUnsupported {
+				if !errors.Is(err, ErrUnsupported) {
+					t.Fatalf("Thumbnail() error = %v, want ErrUnsupported", err)
+				}
+				return
+			}
+
+			if err != nil || contentType != tt.wantType {
+				t.Fatalf("Thumbnail() = %s, %v, want %s", contentType, err, tt.wantType)
+			}
+
+			config, _, err := image.DecodeConfig(bytes.NewReader(data))
+			if err != nil || config.Width != tt.wantW || config.Height != tt.wantH {
+				t.Errorf("thumbnail is %dx%d, %v, want %dx%d", config.Width, config.Height, err, tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
+
+func TestSniff(t *testing.T) {
+	contentType, width, height, err := Sniff(bytes.NewReader(encode(t, "png", 64, 48)))
+	if err != nil || contentType != "image/png" || width != 64 || height != 48 {
+		t.Errorf("Sniff() = %s %dx%d, %v, want image/png 64x48", contentType, width, height, err)
+	}
+
+	contentType, width, _, err = Sniff(strings.NewReader("<html><script>alert(1)</script></html>"))
+	if err != nil || Inline(contentType) || width != 0 {
+		t.Errorf("Sniff() of html = %s, %d, %v, want a type never inline", contentType, width, err)
+	}
+}
+
+func TestInline(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{contentType: "image/png", want: true},
+		{contentType: "application/pdf", want: true},
+		{contentType: "text/plain; charset=utf-8", want: true},
+		{contentType: "text/html; charset=utf-8", want: false},
+		{contentType: "image/svg+xml", want: false},
+		{contentType: "", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := Inline(tt.contentType); got != tt.want {
+			t.Errorf("Inline(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+// Package reconcile repairs the drift between the sources table and the bucket: the objects
+// no alias points at, left by a failed insert or a failed delete, and the FILE aliases whose
+// object is missing.
+package reconcile
+
+import (
+	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/api/model"
+	"backstreetlinkv2/api/repo"
+	"context"
+	"fmt"
+	"github.com/rs/zerolog"
+	zlog "github.com/rs/zerolog/log"
+	"time"
+)
+
+const DefaultBatchSize = 500
+
+// Rows is the part of repo.MYSQLRepo the reconciler uses
+type Rows interface {
+	List(ctx context.Context, opts repo.ListOptions) ([]repo.Source, error)
+	Referenced(ctx context.Context, keys []string) (map[string]bool, error)
+	Delete(ctx context.Context, key string) ([]string, error)
+}
+
+// Objects is the part of repo.ObjectScanner the reconciler uses
+type Objects interface {
+	List(ctx context.Context, prefix string, fn func(repo.ObjectInfo) error) error
+	Stat(ctx context.Context, key string) (repo.ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Evicter drops a deleted alias from the cache, service.Cache is one
+type Evicter interface {
+	Delete(key string) error
+}
+
+type Config struct {
+	// MinAge leaves the younger objects and rows alone, an upload in flight has its row
+	// but not its object yet
+	MinAge    time.Duration
+	BatchSize int
+}
+
+// Report is the outcome of a run, what would be deleted when it is a dry run
+type Report struct {
+	DryRun         bool              `json:"dry_run"`
+	Started        time.Time         `json:"started"`
+	Finished       time.Time         `json:"finished"`
+	ObjectsScanned int               `json:"objects_scanned"`
+	RowsScanned    int               `json:"rows_scanned"`
+	OrphanObjects  []repo.ObjectInfo `json:"orphan_objects"`
+	OrphanBytes    int64             `json:"orphan_bytes"`
+	DanglingRows   []repo.Source     `json:"dangling_rows"`
+
+	// Failures are the deletes that failed, the run goes on without them
+	Failures []string `json:"failures,omitempty"`
+}
+
+type Reconciler struct {
+	rows    Rows
+	objects Objects
+	cache   Evicter
+	cfg     Config
+	now     func() time.Time
+}
+
+func New(rows Rows, objects Objects, cache Evicter, cfg Config) *Reconciler {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+
+	return &Reconciler{
+		rows:    rows,
+		objects: objects,
+		cache:   cache,
+		cfg:     cfg,
+		now:     time.Now,
+	}
+}
+
+// Run lists the whole bucket then the FILE rows, the object keys are kept in memory meanwhile.
+// The orphans are deleted batch by batch right after their rows are looked up, which keeps
+// the window where a new upload could reuse the key short.
+func (r *Reconciler) Run(ctx context.Context, dryRun bool) (report Report, err error) {
+	const op = helper.Op("reconcile.Run")
+
+	report = Report{DryRun: dryRun, Started: r.now()}
+	defer func() { report.Finished = r.now() }()
+
+	cutoff := report.Started.Add(-r.cfg.MinAge)
+
+	stored := map[string]struct{}{}
+	var batch []repo.ObjectInfo
+
+	sweep := func() error {
+		err := r.sweepObjects(ctx, batch, &report)
+		batch = batch[:0]
+
+		return err
+	}
+
+	err = r.objects.List(ctx, "", func(object repo.ObjectInfo) error {
+		report.ObjectsScanned++
+		stored[object.Key] = struct{}{}
+
+		if object.LastModified.After(cutoff) {
+			return nil
+		}
+
+		if batch = append(batch, object); len(batch) < r.cfg.BatchSize {
+			return nil
+		}
+
+		return sweep()
+	})
+	if err == nil && len(batch) > 0 {
+		err = sweep()
+	}
+	if err != nil {
+		return report, helper.E(op, helper.GetKind(err), err, "can't reconcile the objects")
+	}
+
+	opts := repo.ListOptions{Type: model.TypeFile, Limit: r.cfg.BatchSize}
+	for {
+		rows, err := r.rows.List(ctx, opts)
+		if err != nil {
+			return report, helper.E(op, helper.GetKind(err), err, "can't reconcile the rows")
+		}
+
+		for _, row := range rows {
+			report.RowsScanned++
+
+			// an exhausted row deleted its objects with its last download
+			if row.ExhaustedAt != nil {
+				continue
+			}
+
+			if allStored(stored, repo.ObjectKeys(row.ShortenResponse)) || row.CreatedAt.After(cutoff) {
+				continue
+			}
+
+			r.dropRow(ctx, row, &report)
+		}
+
+		if len(rows) < opts.Limit {
+			break
+		}
+
+		opts.After = rows[len(rows)-1].Alias
+	}
+
+	return report, nil
+}
+
+func allStored(stored map[string]struct{}, keys []string) bool {
+	for _, key := range keys {
+		if _, ok := stored[key]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sweepObjects deletes the objects of the batch no row points at, blocked rows keep their object
+func (r *Reconciler) sweepObjects(ctx context.Context, batch []repo.ObjectInfo, report *Report) error {
+	keys := make([]string, len(batch))
+	for i, object := range batch {
+		keys[i] = object.Key
+	}
+
+	referenced, err := r.rows.Referenced(ctx, keys)
+	if err != nil {
+		return err
+	}
+
+	for _, object := range batch {
+		if referenced[object.Key] {
+			continue
+		}
+
+		report.OrphanObjects = append(report.OrphanObjects, object)
+		report.OrphanBytes += object.Size
+
+		if report.DryRun {
+			continue
+		}
+
+		if err := r.objects.Delete(ctx, object.Key); err != nil {
+			report.Failures = append(report.Failures, fmt.Sprintf("object %s: %v", object.Key, err))
+		}
+	}
+
+	return nil
+}
+
+// dropRow deletes a FILE row once one of its objects is confirmed missing, it may have been uploaded since the listing
+func (r *Reconciler) dropRow(ctx context.Context, row repo.Source, report *Report) {
+	missing := false
+	for _, key := range repo.ObjectKeys(row.ShortenResponse) {
+		_, err := r.objects.Stat(ctx, key)
+		if helper.GetKind(err) == helper.KindNotFound {
+			missing = true
+			break
+		}
+
+		if err != nil {
+			report.Failures = append(report.Failures, fmt.Sprintf("row %s: %v", row.Alias, err))
+			return
+		}
+	}
+
+	if !missing {
+		return
+	}
+
+	report.DanglingRows = append(report.DanglingRows, row)
+
+	if report.DryRun {
+		return
+	}
+
+	// a blob is missing, the objects of the other files left without a reference are swept by the next run
+	if _, err := r.rows.Delete(ctx, row.Alias); err != nil && helper.GetKind(err) != helper.KindNotFound {
+		report.Failures = append(report.Failures, fmt.Sprintf("row %s: %v", row.Alias, err))
+		return
+	}
+
+	if err := r.cache.Delete(row.Alias); err != nil && helper.GetKind(err) != helper.KindNotFound {
+		report.Failures = append(report.Failures, fmt.Sprintf("cache %s: %v", row.Alias, err))
+	}
+}
+
+// Every runs the reconciler every interval until ctx is done, it fits lifecycle.Manager.Go
+func (r *Reconciler) Every(interval time.Duration, dryRun bool) func(ctx context.Context) {
+	return func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				report, err := r.Run(ctx, dryRun)
+				report.Log(zlog.Logger.With().Str("worker", "reconcile").Logger(), err)
+			}
+		}
+	}
+}
+
+// Log writes the summary of the report, every orphan and dangling row at debug level
+func (report Report) Log(logger zerolog.Logger, err error) {
+	for _, object := range report.OrphanObjects {
+		logger.Debug().Str("object", object.Key).Int64("size", object.Size).Bool("dry_run", report.DryRun).Msg("orphan object")
+	}
+
+	for _, row := range report.DanglingRows {
+		logger.Debug().Str("alias", row.Alias).Bool("dry_run", report.DryRun).Msg("dangling row")
+	}
+
+	event := logger.Info()
+	if err != nil || len(report.Failures) > 0 {
+		event = logger.Error().Err(err).Strs("failures", report.Failures)
+	}
+
+	event.
+		Bool("dry_run", report.DryRun).
+		Int("objects_scanned", report.ObjectsScanned).
+		Int("rows_scanned", report.RowsScanned).
+		Int("orphan_objects", len(report.OrphanObjects)).
+		Int64("orphan_bytes", report.OrphanBytes).
+		Int("dangling_rows", len(report.DanglingRows)).
+		Dur("took", report.Finished.Sub(report.Started)).
+		Msg("reconciliation done")
+}
@@ -0,0 +1,217 @@
+package reconcile
+
+import (
+	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/api/model"
+	"backstreetlinkv2/api/repo"
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+type fakeRows struct {
+	sources map[string]repo.Source
+	deleted []string
+}
+
+func (f *fakeRows) List(_ context.Context, opts repo.ListOptions) ([]repo.Source, error) {
+	var keys []string
+	for key, source := range f.sources {
+		if key > opts.After && (opts.Type == "" || source.Type == opts.Type) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	if len(keys) > opts.Limit {
+		keys = keys[:opts.Limit]
+	}
+
+	sources := make([]repo.Source, len(keys))
+	for i, key := range keys {
+		sources[i] = f.sources[key]
+	}
+
+	return sources, nil
+}
+
+func (f *fakeRows) Referenced(_ context.Context, keys []string) (map[string]bool, error) {
+	referenced := map[string]bool{}
+	for _, source := range f.sources {
+		if source.Type == model.TypeFile {
+			for _, key := range repo.ObjectKeys(source.ShortenResponse) {
+				referenced[key] = true
+			}
+		}
+	}
+
+	for key := range referenced {
+		if !contains(keys, key) {
+			delete(referenced, key)
+		}
+	}
+
+	return referenced, nil
+}
+
+func (f *fakeRows) Delete(_ context.Context, key string) ([]string, error) {
+	delete(f.sources, key)
+	f.deleted = append(f.deleted, key)
+
+	return nil, nil
+}
+
+func contains(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+type fakeObjects struct {
+	objects map[string]repo.ObjectInfo
+	deleted []string
+}
+
+func (f *fakeObjects) List(_ context.Context, _ string, fn func(repo.ObjectInfo) error) error {
+	var keys []string
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := fn(f.objects[key]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeObjects) Stat(_ context.Context, key string) (repo.ObjectInfo, error) {
+	object, ok := f.objects[key]
+	if !ok {
+		return object, helper.E("fakeObjects.Stat", helper.KindNotFound, repo.ErrObjectNotFound, "not found")
+	}
+
+	return object, nil
+}
+
+func (f *fakeObjects) Delete(_ context.Context, key string) error {
+	delete(f.objects, key)
+	f.deleted = append(f.deleted, key)
+
+	return nil
+}
+
+type fakeCache struct {
+	deleted []string
+}
+
+func (f *fakeCache) Delete(key string) error {
+	f.deleted = append(f.deleted, key)
+	return nil
+}
+
+func newFixture() (*fakeRows, *fakeObjects) {
+	old := now.Add(-2 * time.Hour)
+	young := now.Add(-time.Minute)
+
+	rows := &fakeRows{sources: map[string]repo.Source{
+		"kept":      {ShortenResponse: model.ShortenResponse{Alias: "kept", Type: model.TypeFile}, CreatedAt: old},
+		"shared":    {ShortenResponse: model.ShortenResponse{Alias: "shared", Type: model.TypeFile, SHA256: "abc"}, CreatedAt: old},
+		"dangling":  {ShortenResponse: model.ShortenResponse{Alias: "dangling", Type: model.TypeFile}, CreatedAt: old},
+		"uploading": {ShortenResponse: model.ShortenResponse{Alias: "uploading", Type: model.TypeFile}, CreatedAt: young},
+		"link":      {ShortenResponse: model.ShortenResponse{Alias: "link", Type: model.TypeLink}, CreatedAt: old},
+		"blocked": {
+			ShortenResponse: model.ShortenResponse{Alias: "blocked", Type: model.TypeFile},
+			CreatedAt:       old,
+			BlockedAt:       &old,
+		},
+		"exhausted": {
+			ShortenResponse: model.ShortenResponse{Alias: "exhausted", Type: model.TypeFile, BurnAfterRead: true},
+			CreatedAt:       old,
+			ExhaustedAt:     &old,
+		},
+	}}
+
+	objects := &fakeObjects{objects: map[string]repo.ObjectInfo{
+		"kept":         {Key: "kept", Size: 1, LastModified: old},
+		"blobs/abc":    {Key: "blobs/abc", Size: 1, LastModified: old},
+		"blobs/def":    {Key: "blobs/def", Size: 5, LastModified: old},
+		"blocked":      {Key: "blocked", Size: 1, LastModified: old},
+		"orphan":       {Key: "orphan", Size: 10, LastModified: old},
+		"link":         {Key: "link", Size: 20, LastModified: old},
+		"young-upload": {Key: "young-upload", Size: 30, LastModified: young},
+	}}
+
+	return rows, objects
+}
+
+func TestReconciler_Run(t *testing.T) {
+	tests := []struct {
+		name   string
+		dryRun bool
+	}{
+		{name: "dry run", dryRun: true},
+		{name: "delete", dryRun: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, objects := newFixture()
+			cache := &fakeCache{}
+
+			r := New(rows, objects, cache, Config{MinAge: time.Hour, BatchSize: 2})
+			r.now = func() time.Time { return now }
+
+			report, err := r.Run(context.Background(), tt.dryRun)
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			var orphans []string
+			for _, object := range report.OrphanObjects {
+				orphans = append(orphans, object.Key)
+			}
+
+			if want := []string{"blobs/def", "link", "orphan"}; !reflect.DeepEqual(orphans, want) {
+				t.Errorf("orphan objects = %v, want %v", orphans, want)
+			}
+
+			if report.OrphanBytes != 35 {
+				t.Errorf("orphan bytes = %d, want 35", report.OrphanBytes)
+			}
+
+			if len(report.DanglingRows) != 1 || report.DanglingRows[0].Alias != "dangling" {
+				t.Errorf("dangling rows = %+v, want dangling", report.DanglingRows)
+			}
+
+			if report.ObjectsScanned != 7 || report.RowsScanned != 6 {
+				t.Errorf("scanned %d objects and %d rows, want 7 and 6", report.ObjectsScanned, report.RowsScanned)
+			}
+
+			var wantObjects, wantRows []string
+			if !tt.dryRun {
+				wantObjects = []string{"blobs/def", "link", "orphan"}
+				wantRows = []string{"dangling"}
+			}
+
+			if !reflect.DeepEqual(objects.deleted, wantObjects) {
+				t.Errorf("deleted objects = %v, want %v", objects.deleted, wantObjects)
+			}
+
+			if !reflect.DeepEqual(rows.deleted, wantRows) || !reflect.DeepEqual(cache.deleted, wantRows) {
+				t.Errorf("deleted rows = %v and evicted %v, want %v", rows.deleted, cache.deleted, wantRows)
+			}
+		})
+	}
+}
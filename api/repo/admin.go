@@ -0,0 +1,190 @@
+package repo
+
+import (
+	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/api/metrics"
+	"backstreetlinkv2/api/model"
+	"backstreetlinkv2/api/tracing"
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultListLimit = 100
+
+	// the times are read as unix times so the scan doesn't depend on parseTime in the dsn
+	sourceColumns = `key_source, attrs, COALESCE(blob_hash, ''), UNIX_TIMESTAMP(created_at), UNIX_TIMESTAMP(blocked_at), blocked_reason, uses, UNIX_TIMESTAMP(exhausted_at)`
+)
+
+// Source is a row of the sources table with its moderation state
+type Source struct {
+	model.ShortenResponse
+	CreatedAt     time.Time  `json:"created_at"`
+	BlockedAt     *time.Time `json:"blocked_at,omitempty"`
+	BlockedReason string     `json:"blocked_reason,omitempty"`
+	Uses          int        `json:"uses,omitempty"`
+	ExhaustedAt   *time.Time `json:"exhausted_at,omitempty"`
+}
+
+// ListOptions filters the rows returned by List, the zero value lists the first DefaultListLimit rows
+type ListOptions struct {
+	// After is the last alias of the previous page
+	After       string
+	Limit       int
+	Type        string
+	BlockedOnly bool
+}
+
+// List returns the rows ordered by alias, a page after opts.After
+func (p *MYSQLRepo) List(ctx context.Context, opts ListOptions) ([]Source, error) {
+	const op = helper.Op("repo.MYSQLRepo.List")
+
+	if opts.Limit <= 0 {
+		opts.Limit = DefaultListLimit
+	}
+
+	query := strings.Builder{}
+	query.WriteString(`SELECT ` + sourceColumns + ` FROM sources WHERE key_source > ?`)
+	args := []any{opts.After}
+
+	if opts.Type != "" {
+		query.WriteString(` AND JSON_UNQUOTE(JSON_EXTRACT(attrs, '$.type')) = ?`)
+		args = append(args, opts.Type)
+	}
+
+	if opts.BlockedOnly {
+		query.WriteString(` AND blocked_at IS NOT NULL`)
+	}
+
+	query.WriteString(` ORDER BY key_source LIMIT ?`)
+	args = append(args, opts.Limit)
+
+	ctx, span := startQuerySpan(ctx, op, query.String())
+	defer span.End()
+
+	start := time.Now()
+	sources, err := p.querySources(ctx, query.String(), args...)
+	metrics.ObserveQuery("list", start, err)
+	tracing.RecordError(span, err)
+
+	if err != nil {
+		return nil, helper.E(op, kindOf(err), err, CantProcessRequest)
+	}
+
+	return sources, nil
+}
+
+// Source returns the row of key, blocked or not
+func (p *MYSQLRepo) Source(ctx context.Context, key string) (Source, error) {
+	const op = helper.Op("repo.MYSQLRepo.Source")
+	const query = `SELECT ` + sourceColumns + ` FROM sources WHERE key_source = ?`
+
+	ctx, span := startQuerySpan(ctx, op, query)
+	defer span.End()
+
+	start := time.Now()
+	sources, err := p.querySources(ctx, query, key)
+	metrics.ObserveQuery("get", start, err)
+	tracing.RecordError(span, err)
+
+	if err != nil {
+		return Source{}, helper.E(op, kindOf(err), err, CantProcessRequest)
+	}
+
+	if len(sources) == 0 {
+		return Source{}, helper.E(op, helper.KindNotFound, ErrNotFound, ErrNotFound.Error())
+	}
+
+	return sources[0], nil
+}
+
+// Block makes Get answer KindGone for key until it is unblocked, the row and its file are kept
+func (p *MYSQLRepo) Block(ctx context.Context, key, reason string) error {
+	const op = helper.Op("repo.MYSQLRepo.Block")
+	const query = `UPDATE sources SET blocked_at = COALESCE(blocked_at, CURRENT_TIMESTAMP), blocked_reason = ? WHERE key_source = ?`
+
+	return p.moderate(ctx, op, query, reason, key)
+}
+
+func (p *MYSQLRepo) Unblock(ctx context.Context, key string) error {
+	const op = helper.Op("repo.MYSQLRepo.Unblock")
+	const query = `UPDATE sources SET blocked_at = NULL, blocked_reason = '' WHERE key_source = ?`
+
+	return p.moderate(ctx, op, query, key)
+}
+
+func (p *MYSQLRepo) moderate(ctx context.Context, op helper.Op, query string, args ...any) error {
+	ctx, span := startQuerySpan(ctx, op, query)
+	defer span.End()
+
+	start := time.Now()
+	cmd, err := p.db.ExecContext(ctx, query, args...)
+	metrics.ObserveQuery("update", start, err)
+	tracing.RecordError(span, err)
+
+	if err != nil {
+		return helper.E(op, kindOf(err), err, CantProcessRequest)
+	}
+
+	rowsAffected, err := cmd.RowsAffected()
+	if err != nil {
+		return helper.E(op, helper.KindUnexpected, err, CantProcessRequest)
+	}
+
+	if rowsAffected > 0 {
+		return nil
+	}
+
+	// mysql counts the changed rows, blocking twice with the same reason changes nothing
+	var exists bool
+	err = p.db.QueryRowContext(ctx, `SELECT 1 FROM sources WHERE key_source = ?`, args[len(args)-1]).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return helper.E(op, helper.KindNotFound, ErrNotFound, ErrNotFound.Error())
+	}
+
+	if err != nil {
+		return helper.E(op, kindOf(err), err, CantProcessRequest)
+	}
+
+	return nil
+}
+
+func (p *MYSQLRepo) querySources(ctx context.Context, query string, args ...any) ([]Source, error) {
+	rows, err := p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sources []Source
+	for rows.Next() {
+		var source Source
+		var key string
+		var createdAt int64
+		var blockedAt, exhaustedAt sql.NullInt64
+
+		if err := rows.Scan(&key, &source.ShortenResponse, &source.SHA256, &createdAt, &blockedAt, &source.BlockedReason,
+			&source.Uses, &exhaustedAt); err != nil {
+			return nil, err
+		}
+
+		source.Alias = key
+		source.CreatedAt = time.Unix(createdAt, 0)
+
+		if blockedAt.Valid {
+			at := time.Unix(blockedAt.Int64, 0)
+			source.BlockedAt = &at
+		}
+
+		if exhaustedAt.Valid {
+			at := time.Unix(exhaustedAt.Int64, 0)
+			source.ExhaustedAt = &at
+		}
+
+		sources = append(sources, source)
+	}
+
+	return sources, rows.Err()
+}
@@ -0,0 +1,108 @@
+package repo
+
+import (
+	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/api/model"
+	"context"
+	"testing"
+)
+
+func TestMYSQLRepo_Block(t *testing.T) {
+	p := MYSQLRepo{testDB}
+	ctx := context.Background()
+
+	err := p.Insert(ctx, "to-block", model.ShortenResponse{
+		Alias:      "to-block",
+		Type:       model.TypeLink,
+		RedirectTo: "https://google.com",
+	})
+	if err != nil {
+		t.Fatalf("Insert() error = %v", err)
+	}
+
+	if err := p.Block(ctx, "to-block", "phishing"); err != nil {
+		t.Fatalf("Block() error = %v", err)
+	}
+
+	// blocking twice is not an error
+	if err := p.Block(ctx, "to-block", "phishing"); err != nil {
+		t.Fatalf("Block() twice error = %v", err)
+	}
+
+	if _, err := p.Get(ctx, "to-block"); helper.GetKind(err) != helper.KindGone {
+		t.Errorf("Get() of a blocked alias error = %v, want gone", err)
+	}
+
+	source, err := p.Source(ctx, "to-block")
+	if err != nil {
+		t.Fatalf("Source() error = %v", err)
+	}
+
+	if source.BlockedAt == nil || source.BlockedReason != "phishing" {
+		t.Errorf("Source() = %+v, want blocked for phishing", source)
+	}
+
+	if err := p.Unblock(ctx, "to-block"); err != nil {
+		t.Fatalf("Unblock() error = %v", err)
+	}
+
+	if _, err := p.Get(ctx, "to-block"); err != nil {
+		t.Errorf("Get() after Unblock() error = %v", err)
+	}
+
+	if err := p.Block(ctx, "never-inserted", ""); helper.GetKind(err) != helper.KindNotFound {
+		t.Errorf("Block() of a missing alias error = %v, want not found", err)
+	}
+
+	// a blocked alias can be deleted, its row is read with Source
+	if err := p.Block(ctx, "to-block", "phishing"); err != nil {
+		t.Fatalf("Block() error = %v", err)
+	}
+
+	if _, err := p.Delete(ctx, "to-block"); err != nil {
+		t.Errorf("Delete() of a blocked alias error = %v", err)
+	}
+
+	if _, err := p.Source(ctx, "to-block"); helper.GetKind(err) != helper.KindNotFound {
+		t.Errorf("Source() after Delete() error = %v, want not found", err)
+	}
+}
+
+func TestMYSQLRepo_List(t *testing.T) {
+	p := MYSQLRepo{testDB}
+	ctx := context.Background()
+
+	for _, alias := range []string{"list-a", "list-b", "list-c"} {
+		err := p.Insert(ctx, alias, model.ShortenResponse{Alias: alias, Type: model.TypeFile, Filename: alias + ".txt"})
+		if err != nil {
+			t.Fatalf("Insert() error = %v", err)
+		}
+	}
+
+	page, err := p.List(ctx, ListOptions{After: "list-", Limit: 2, Type: model.TypeFile})
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+
+	if len(page) != 2 || page[0].Alias != "list-a" || page[1].Alias != "list-b" {
+		t.Fatalf("List() = %+v, want list-a and list-b", page)
+	}
+
+	page, err = p.List(ctx, ListOptions{After: "list-b", Limit: 1, Type: model.TypeFile})
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+
+	if len(page) != 1 || page[0].Alias != "list-c" {
+		t.Errorf("List() after list-b = %+v, want list-c", page)
+	}
+
+	referenced, err := p.Referenced(ctx, []string{"list-a", "missing", BlobPrefix + "missing"})
+	if err != nil {
+		t.Fatalf("Referenced() error = %v", err)
+	}
+
+	if len(referenced) != 1 || !referenced["list-a"] {
+		t.Errorf("Referenced() = %v, want only list-a", referenced)
+	}
+}
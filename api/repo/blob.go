@@ -0,0 +1,280 @@
+package repo
+
+import (
+	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/api/metrics"
+	"backstreetlinkv2/api/model"
+	"backstreetlinkv2/api/tracing"
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/go-sql-driver/mysql"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BlobPrefix is where the deduplicated files live in the bucket, under their SHA-256
+const BlobPrefix = "blobs/"
+
+// ThumbPrefix is where the thumbnails of the blobs are kept, they live as long as their blob
+const ThumbPrefix = "thumbs/"
+
+// ThumbKey returns the key of the thumbnail of the blob fitting in size x size
+func ThumbKey(hash string, size int) string {
+	return ThumbPrefix + hash + "-" + strconv.Itoa(size)
+}
+
+// ObjectKey returns the key of the object holding the file of resp,
+// the files uploaded before the deduplication are stored under their alias
+func ObjectKey(resp model.ShortenResponse) string {
+	if resp.SHA256 == "" {
+		return resp.Alias
+	}
+
+	return BlobPrefix + resp.SHA256
+}
+
+// ObjectKeys returns the keys of the objects holding the files of resp, one per file of the manifest
+func ObjectKeys(resp model.ShortenResponse) []string {
+	if len(resp.Files) == 0 {
+		return []string{ObjectKey(resp)}
+	}
+
+	keys := make([]string, len(resp.Files))
+	for i, file := range resp.Files {
+		keys[i] = BlobPrefix + file.SHA256
+	}
+
+	return keys
+}
+
+// InsertFile inserts the row of the files and takes a reference on each blob in the same
+// transaction, the row of a single file keeps its blob in blob_hash and the others in the manifest.
+// It tells for each blob whether its row was created, the caller uploads the object of those.
+func (p *MYSQLRepo) InsertFile(ctx context.Context, key string, attrs model.ShortenResponse, blobs []model.Blob) ([]bool, error) {
+	const op = helper.Op("repo.MYSQLRepo.InsertFile")
+	const query = `INSERT INTO sources (key_source, attrs, blob_hash) VALUES (?, ?, ?)`
+
+	ctx, span := startQuerySpan(ctx, op, query)
+	defer span.End()
+
+	start := time.Now()
+	created, err := p.insertFile(ctx, key, attrs, blobs)
+	metrics.ObserveQuery("insert", start, err)
+	tracing.RecordError(span, err)
+
+	if err != nil {
+		var mysqlErr *mysql.MySQLError
+
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == UniqueConstraint {
+			return nil, helper.E(op, helper.KindConflict, ErrUnique, ErrUnique.Error())
+		}
+
+		return nil, helper.E(op, kindOf(err), err, CantProcessRequest)
+	}
+
+	return created, nil
+}
+
+func (p *MYSQLRepo) insertFile(ctx context.Context, key string, attrs model.ShortenResponse, blobs []model.Blob) ([]bool, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var blobHash string
+	if len(blobs) == 1 {
+		blobHash = blobs[0].SHA256
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO sources (key_source, attrs, blob_hash) VALUES (?, ?, ?)`, key, attrs, nullString(blobHash))
+	if err != nil {
+		return nil, err
+	}
+
+	created := make([]bool, len(blobs))
+	for i, blob := range blobs {
+		// a stored blob keeps its data key, the object is already encrypted with it
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO blobs (hash, size, refs, key_id, wrapped_key) VALUES (?, ?, 1, ?, ?) ON DUPLICATE KEY UPDATE refs = refs + 1`,
+			blob.SHA256, blob.Size, nullString(blob.Key.KeyID), blob.Key.Wrapped,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		// the upsert locks the row, a release can't drop it in between
+		var refs int
+		if err := tx.QueryRowContext(ctx, `SELECT refs FROM blobs WHERE hash = ?`, blob.SHA256).Scan(&refs); err != nil {
+			return nil, err
+		}
+
+		created[i] = refs == 1
+	}
+
+	return created, tx.Commit()
+}
+
+// release drops a reference on the blob and returns the references left, the row of an unreferenced blob is deleted
+func release(ctx context.Context, tx *sql.Tx, hash string) (int, error) {
+	if _, err := tx.ExecContext(ctx, `UPDATE blobs SET refs = refs - 1 WHERE hash = ?`, hash); err != nil {
+		return 0, err
+	}
+
+	var refs int
+	err := tx.QueryRowContext(ctx, `SELECT refs FROM blobs WHERE hash = ?`, hash).Scan(&refs)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	if refs > 0 {
+		return refs, nil
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM blobs WHERE hash = ?`, hash)
+	return 0, err
+}
+
+// Referenced tells which object keys a row points at, the blobs by their hash and the older files by their alias
+func (p *MYSQLRepo) Referenced(ctx context.Context, keys []string) (map[string]bool, error) {
+	const op = helper.Op("repo.MYSQLRepo.Referenced")
+
+	ctx, span := tracing.Start(ctx, op)
+	defer span.End()
+
+	start := time.Now()
+	referenced, err := references(ctx, p.db, keys, "")
+	metrics.ObserveQuery("referenced", start, err)
+	tracing.RecordError(span, err)
+
+	if err != nil {
+		return nil, helper.E(op, kindOf(err), err, CantProcessRequest)
+	}
+
+	return referenced, nil
+}
+
+// DeleteReleased calls del with the keys no row points at, their blobs can't be stored again until
+// it returns: an upload of the same content waits for it and then creates the row and the object anew
+func (p *MYSQLRepo) DeleteReleased(ctx context.Context, keys []string, del func(released []string)) error {
+	const op = helper.Op("repo.MYSQLRepo.DeleteReleased")
+
+	ctx, span := tracing.Start(ctx, op)
+	defer span.End()
+
+	start := time.Now()
+	err := p.deleteReleased(ctx, keys, del)
+	metrics.ObserveQuery("release", start, err)
+	tracing.RecordError(span, err)
+
+	if err != nil {
+		return helper.E(op, kindOf(err), err, CantProcessRequest)
+	}
+
+	return nil
+}
+
+func (p *MYSQLRepo) deleteReleased(ctx context.Context, keys []string, del func(released []string)) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the locking read holds the rows of the blobs and the gaps of the missing ones,
+	// the upsert of InsertFile waits on them until the transaction ends
+	referenced, err := references(ctx, tx, keys, " FOR UPDATE")
+	if err != nil {
+		return err
+	}
+
+	var released []string
+	for _, key := range keys {
+		if !referenced[key] {
+			released = append(released, key)
+		}
+	}
+
+	if len(released) > 0 {
+		del(released)
+	}
+
+	return tx.Commit()
+}
+
+// querier runs the reads on a *sql.DB or in a *sql.Tx
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// references reads which keys a row points at, lock is appended to the read of the blobs
+func references(ctx context.Context, q querier, keys []string, lock string) (map[string]bool, error) {
+	var hashes, aliases []any
+	thumbs := map[string]string{}
+	for _, key := range keys {
+		switch {
+		case strings.HasPrefix(key, BlobPrefix):
+			hashes = append(hashes, strings.TrimPrefix(key, BlobPrefix))
+
+		// a thumbnail is referenced by its blob
+		case strings.HasPrefix(key, ThumbPrefix):
+			hash, _, _ := strings.Cut(strings.TrimPrefix(key, ThumbPrefix), "-")
+			hashes = append(hashes, hash)
+			thumbs[key] = BlobPrefix + hash
+
+		default:
+			aliases = append(aliases, key)
+		}
+	}
+
+	referenced := make(map[string]bool, len(keys))
+
+	err := scanReferences(ctx, q, referenced, BlobPrefix, `SELECT hash FROM blobs WHERE hash IN `, hashes, lock)
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanReferences(ctx, q, referenced, "",
+		`SELECT key_source FROM sources WHERE blob_hash IS NULL AND JSON_UNQUOTE(JSON_EXTRACT(attrs, '$.type')) = 'FILE'
+		AND JSON_EXTRACT(attrs, '$.files') IS NULL AND exhausted_at IS NULL AND key_source IN `,
+		aliases, "",
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for thumb, blob := range thumbs {
+		referenced[thumb] = referenced[blob]
+	}
+
+	return referenced, nil
+}
+
+func scanReferences(ctx context.Context, q querier, referenced map[string]bool, prefix, query string, args []any, lock string) error {
+	if len(args) == 0 {
+		return nil
+	}
+
+	rows, err := q.QueryContext(ctx, query+`(?`+strings.Repeat(`, ?`, len(args)-1)+`)`+lock, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return err
+		}
+
+		referenced[prefix+key] = true
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,171 @@
+package repo
+
+import (
+	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/api/model"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMYSQLRepo_InsertFileSharesBlob(t *testing.T) {
+	p := MYSQLRepo{testDB}
+	ctx := context.Background()
+
+	blob := model.Blob{SHA256: strings.Repeat("ab", 32), Size: 42}
+
+	// only the first alias creates the row of the blob and uploads its object
+	for i, alias := range []string{"shared-a", "shared-b"} {
+		attrs := model.ShortenResponse{Alias: alias, Type: model.TypeFile, Filename: "report.pdf", SHA256: blob.SHA256}
+		created, err := p.InsertFile(ctx, alias, attrs, []model.Blob{blob})
+		if err != nil || !reflect.DeepEqual(created, []bool{i == 0}) {
+			t.Fatalf("InsertFile(%s) = %v, %v, want created %v", alias, created, err, i == 0)
+		}
+	}
+
+	attrs := model.ShortenResponse{Alias: "shared-a", Type: model.TypeFile, SHA256: blob.SHA256}
+	if _, err := p.InsertFile(ctx, "shared-a", attrs, []model.Blob{blob}); helper.GetKind(err) != helper.KindConflict {
+		t.Fatalf("InsertFile() of a taken alias error = %v, want conflict", err)
+	}
+
+	got, err := p.Get(ctx, "shared-b")
+	if err != nil || got.SHA256 != blob.SHA256 {
+		t.Fatalf("Get() = %+v, %v, want the blob %s", got, err, blob.SHA256)
+	}
+
+	if objects, err := p.Delete(ctx, "shared-a"); err != nil || len(objects) != 0 {
+		t.Fatalf("Delete() of the first alias = %q, %v, want the blob kept", objects, err)
+	}
+
+	if objects, err := p.Delete(ctx, "shared-b"); err != nil || !reflect.DeepEqual(objects, []string{BlobPrefix + blob.SHA256}) {
+		t.Fatalf("Delete() of the last alias = %q, %v, want %s", objects, err, BlobPrefix+blob.SHA256)
+	}
+
+	// the released object may still be in the bucket, the next upload of the content replaces it
+	attrs = model.ShortenResponse{Alias: "shared-c", Type: model.TypeFile, SHA256: blob.SHA256}
+	if created, err := p.InsertFile(ctx, "shared-c", attrs, []model.Blob{blob}); err != nil || !reflect.DeepEqual(created, []bool{true}) {
+		t.Fatalf("InsertFile() after the last delete = %v, %v, want the row created", created, err)
+	}
+
+	if _, err := p.Delete(ctx, "shared-c"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+}
+
+func TestMYSQLRepo_InsertFileManifest(t *testing.T) {
+	p := MYSQLRepo{testDB}
+	ctx := context.Background()
+
+	shared := model.Blob{SHA256: strings.Repeat("ef", 32), Size: 3}
+	own := model.Blob{SHA256: strings.Repeat("12", 32), Size: 5}
+
+	if _, err := p.InsertFile(ctx, "single", model.ShortenResponse{Alias: "single", Type: model.TypeFile, SHA256: shared.SHA256}, []model.Blob{shared}); err != nil {
+		t.Fatalf("InsertFile() error = %v", err)
+	}
+
+	attrs := model.ShortenResponse{Alias: "bundle", Type: model.TypeFile, Filename: "bundle.zip", Files: []model.FileEntry{
+		{Name: "a.txt", Size: shared.Size, SHA256: shared.SHA256},
+		{Name: "b.txt", Size: own.Size, SHA256: own.SHA256},
+	}}
+	if created, err := p.InsertFile(ctx, "bundle", attrs, []model.Blob{shared, own}); err != nil || !reflect.DeepEqual(created, []bool{false, true}) {
+		t.Fatalf("InsertFile() = %v, %v, want only the own blob created", created, err)
+	}
+
+	got, err := p.Get(ctx, "bundle")
+	if err != nil || got.SHA256 != "" || !reflect.DeepEqual(got.Files, attrs.Files) {
+		t.Fatalf("Get() = %+v, %v, want the manifest and no blob", got, err)
+	}
+
+	orphanThumb := ThumbKey(strings.Repeat("99", 32), 256)
+	referenced, err := p.Referenced(ctx, []string{"bundle", BlobPrefix + own.SHA256, ThumbKey(own.SHA256, 256), orphanThumb})
+	if err != nil || referenced["bundle"] || !referenced[BlobPrefix+own.SHA256] || !referenced[ThumbKey(own.SHA256, 256)] || referenced[orphanThumb] {
+		t.Errorf("Referenced() = %v, %v, want the blob and its thumbnail", referenced, err)
+	}
+
+	// the blob still used by the single file stays
+	if objects, err := p.Delete(ctx, "bundle"); err != nil || !reflect.DeepEqual(objects, []string{BlobPrefix + own.SHA256}) {
+		t.Fatalf("Delete() = %q, %v, want %s", objects, err, BlobPrefix+own.SHA256)
+	}
+}
+
+func TestMYSQLRepo_DeleteReleased(t *testing.T) {
+	p := MYSQLRepo{testDB}
+	ctx := context.Background()
+
+	kept := model.Blob{SHA256: strings.Repeat("34", 32), Size: 1}
+	gone := model.Blob{SHA256: strings.Repeat("56", 32), Size: 1}
+
+	for alias, blob := range map[string]model.Blob{"release-kept": kept, "release-gone": gone} {
+		attrs := model.ShortenResponse{Alias: alias, Type: model.TypeFile, SHA256: blob.SHA256}
+		if _, err := p.InsertFile(ctx, alias, attrs, []model.Blob{blob}); err != nil {
+			t.Fatalf("InsertFile(%s) error = %v", alias, err)
+		}
+	}
+
+	if _, err := p.Delete(ctx, "release-gone"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	var created []bool
+	var insertErr error
+	inserted := make(chan struct{})
+
+	err := p.DeleteReleased(ctx, []string{BlobPrefix + kept.SHA256, BlobPrefix + gone.SHA256}, func(released []string) {
+		if !reflect.DeepEqual(released, []string{BlobPrefix + gone.SHA256}) {
+			t.Errorf("DeleteReleased() released = %q, want %s", released, BlobPrefix+gone.SHA256)
+		}
+
+		// an upload of the released content waits for its objects to be deleted
+		go func() {
+			defer close(inserted)
+			attrs := model.ShortenResponse{Alias: "release-again", Type: model.TypeFile, SHA256: gone.SHA256}
+			created, insertErr = p.InsertFile(ctx, "release-again", attrs, []model.Blob{gone})
+		}()
+
+		select {
+		case <-inserted:
+			t.Error("InsertFile() of a released blob returned before its objects were deleted")
+		case <-time.After(200 * time.Millisecond):
+		}
+	})
+	if err != nil {
+		t.Fatalf("DeleteReleased() error = %v", err)
+	}
+
+	<-inserted
+	if insertErr != nil || !reflect.DeepEqual(created, []bool{true}) {
+		t.Errorf("InsertFile() after DeleteReleased() = %v, %v, want the row created", created, insertErr)
+	}
+
+	for _, alias := range []string{"release-kept", "release-again"} {
+		if _, err := p.Delete(ctx, alias); err != nil {
+			t.Fatalf("Delete(%s) error = %v", alias, err)
+		}
+	}
+}
+
+func TestObjectKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		resp model.ShortenResponse
+		want []string
+	}{
+		{name: "blob", resp: model.ShortenResponse{Alias: "somefile", SHA256: "abc"}, want: []string{"blobs/abc"}},
+		{name: "uploaded before the deduplication", resp: model.ShortenResponse{Alias: "somefile"}, want: []string{"somefile"}},
+		{
+			name: "manifest",
+			resp: model.ShortenResponse{Alias: "bundle", Files: []model.FileEntry{{Name: "a", SHA256: "abc"}, {Name: "b", SHA256: "def"}}},
+			want: []string{"blobs/abc", "blobs/def"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ObjectKeys(tt.resp); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ObjectKeys() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"github.com/allegro/bigcache/v3"
 	"github.com/rs/zerolog/log"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,24 +15,64 @@ var (
 )
 
 type Cache struct {
-	provider *bigcache.BigCache
+	provider    *bigcache.BigCache
+	hits        int64
+	misses      int64
+	expirations int64
+	evictions   int64
+}
+
+// CacheStats is a snapshot of the cache counters since the process started
+type CacheStats struct {
+	Hits        int64 `json:"hits"`
+	Misses      int64 `json:"misses"`
+	DelHits     int64 `json:"delete_hits"`
+	DelMisses   int64 `json:"delete_misses"`
+	Collisions  int64 `json:"collisions"`
+	Expirations int64 `json:"expirations"`
+	Evictions   int64 `json:"evictions"`
+	Entries     int   `json:"entries"`
+}
+
+type CacheConfig struct {
+	LifeWindow time.Duration
+
+	// Shards must be a power of two
+	Shards       int
+	MaxEntrySize int
+
+	// MaxSizeMB is the hard limit of the cache, zero means unlimited
+	MaxSizeMB int
 }
 
 func NewCache(ctx context.Context, duration time.Duration) (*Cache, error) {
+	return NewCacheWithConfig(ctx, CacheConfig{
+		LifeWindow:   duration,
+		Shards:       1024,
+		MaxEntrySize: 500,
+		MaxSizeMB:    30,
+	})
+}
+
+func NewCacheWithConfig(ctx context.Context, cfg CacheConfig) (*Cache, error) {
+	c := &Cache{}
+
 	cache, err := bigcache.New(ctx, bigcache.Config{
-		Shards:             1024,
-		LifeWindow:         duration,
+		Shards:             cfg.Shards,
+		LifeWindow:         cfg.LifeWindow,
 		CleanWindow:        1 * time.Minute,
 		MaxEntriesInWindow: 1000 * 10 * 60,
-		MaxEntrySize:       500,
-		StatsEnabled:       false,
+		MaxEntrySize:       cfg.MaxEntrySize,
+		StatsEnabled:       true,
 		Verbose:            true,
-		HardMaxCacheSize:   30,
+		HardMaxCacheSize:   cfg.MaxSizeMB,
 		OnRemoveWithReason: func(key string, entry []byte, reason bigcache.RemoveReason) {
 			switch reason {
 			case bigcache.Expired:
+				atomic.AddInt64(&c.expirations, 1)
 				log.Info().Msgf("CACHE: %s has been removed because [expired]", key)
 			case bigcache.NoSpace:
+				atomic.AddInt64(&c.evictions, 1)
 				log.Info().Msgf("CACHE: %s has been removed because [no space]", key)
 			case bigcache.Deleted:
 				log.Info().Msgf("CACHE: %s has been removed because [deleted]", key)
@@ -42,13 +83,26 @@ func NewCache(ctx context.Context, duration time.Duration) (*Cache, error) {
 		return nil, err
 	}
 
-	return &Cache{
-		provider: cache,
-	}, nil
+	c.provider = cache
+
+	return c, nil
 }
 
 func (c *Cache) Get(key string) ([]byte, error) {
-	const op = helper.Op("Cache.Set")
+	value, err := c.Peek(key)
+	switch {
+	case err == nil:
+		atomic.AddInt64(&c.hits, 1)
+	case errors.Is(err, ErrCacheNotFound):
+		atomic.AddInt64(&c.misses, 1)
+	}
+
+	return value, err
+}
+
+// Peek reads the entry without counting a hit or a miss
+func (c *Cache) Peek(key string) ([]byte, error) {
+	const op = helper.Op("Cache.Peek")
 
 	value, err := c.provider.Get(key)
 	if err != nil {
@@ -69,3 +123,45 @@ func (c *Cache) Set(key string, value []byte) error {
 
 	return nil
 }
+
+func (c *Cache) Delete(key string) error {
+	if err := c.provider.Delete(key); err != nil && !errors.Is(err, bigcache.ErrEntryNotFound) {
+		return helper.E(helper.Op("Cache.Delete"), helper.KindUnexpected, err, "can't delete from server")
+	}
+
+	return nil
+}
+
+// Reset removes every entry, the counters are kept
+func (c *Cache) Reset() error {
+	if err := c.provider.Reset(); err != nil {
+		return helper.E(helper.Op("Cache.Reset"), helper.KindUnexpected, err, "can't flush the cache")
+	}
+
+	return nil
+}
+
+func (c *Cache) Stats() CacheStats {
+	stats := c.provider.Stats()
+
+	return CacheStats{
+		Hits:        atomic.LoadInt64(&c.hits),
+		Misses:      atomic.LoadInt64(&c.misses),
+		DelHits:     stats.DelHits,
+		DelMisses:   stats.DelMisses,
+		Collisions:  stats.Collisions,
+		Expirations: atomic.LoadInt64(&c.expirations),
+		Evictions:   atomic.LoadInt64(&c.evictions),
+		Entries:     c.provider.Len(),
+	}
+}
+
+// Ping always succeeds, the cache lives in the process
+func (c *Cache) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close stops the background cleanup of the cache
+func (c *Cache) Close() error {
+	return c.provider.Close()
+}
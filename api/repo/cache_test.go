@@ -1,8 +1,10 @@
 package repo
 
 import (
+	"context"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestCache_Set(t *testing.T) {
@@ -92,3 +94,52 @@ func TestCache_Get(t *testing.T) {
 		})
 	}
 }
+
+func TestCache_Delete(t *testing.T) {
+	t.Parallel()
+
+	if err := testCache.Set("deletekey", []byte("test")); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	if err := testCache.Delete("deletekey"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	if _, err := testCache.Get("deletekey"); err != ErrCacheNotFound {
+		t.Errorf("Get() after delete error = %v, want %v", err, ErrCacheNotFound)
+	}
+
+	if err := testCache.Delete("deletekey"); err != nil {
+		t.Errorf("Delete() missing key error = %v", err)
+	}
+}
+
+func TestCache_Stats(t *testing.T) {
+	cache, err := NewCache(context.Background(), time.Minute)
+	if err != nil {
+		t.Fatalf("NewCache() error = %v", err)
+	}
+
+	cache.Set("foo", []byte("bar"))
+	cache.Get("foo")
+	cache.Get("foo")
+	cache.Get("baz")
+
+	// peeking counts neither a hit nor a miss
+	cache.Peek("foo")
+	cache.Peek("baz")
+
+	stats := cache.Stats()
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("Stats() = %+v, want 2 hits, 1 miss and 1 entry", stats)
+	}
+
+	if err := cache.Reset(); err != nil {
+		t.Fatalf("Reset() error = %v", err)
+	}
+
+	if stats := cache.Stats(); stats.Entries != 0 {
+		t.Errorf("Stats() after reset entries = %d, want 0", stats.Entries)
+	}
+}
@@ -0,0 +1,116 @@
+package repo
+
+import (
+	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/api/metrics"
+	"backstreetlinkv2/api/model"
+	"backstreetlinkv2/api/tracing"
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrKeyChanged = errors.New("the key of the blob changed")
+
+// BlobKey returns the wrapped data key of the blob, zero when the object is stored in the clear
+func (p *MYSQLRepo) BlobKey(ctx context.Context, hash string) (model.DataKey, error) {
+	const op = helper.Op("repo.MYSQLRepo.BlobKey")
+	const query = `SELECT COALESCE(key_id, ''), wrapped_key FROM blobs WHERE hash = ?`
+
+	var key model.DataKey
+
+	ctx, span := startQuerySpan(ctx, op, query)
+	defer span.End()
+
+	start := time.Now()
+	err := p.db.QueryRowContext(ctx, query, hash).Scan(&key.KeyID, &key.Wrapped)
+	metrics.ObserveQuery("get", start, err)
+	tracing.RecordError(span, err)
+
+	if err == sql.ErrNoRows {
+		return key, helper.E(op, helper.KindNotFound, ErrNotFound, ErrNotFound.Error())
+	}
+
+	if err != nil {
+		return key, helper.E(op, kindOf(err), err, CantProcessRequest)
+	}
+
+	return key, nil
+}
+
+// StaleKeys returns the encrypted blobs after the hash after whose data key isn't wrapped by currentID
+func (p *MYSQLRepo) StaleKeys(ctx context.Context, currentID, after string, limit int) ([]model.Blob, error) {
+	const op = helper.Op("repo.MYSQLRepo.StaleKeys")
+	const query = `SELECT hash, size, key_id, wrapped_key FROM blobs
+		WHERE key_id IS NOT NULL AND key_id <> ? AND hash > ? ORDER BY hash LIMIT ?`
+
+	ctx, span := startQuerySpan(ctx, op, query)
+	defer span.End()
+
+	start := time.Now()
+	blobs, err := p.queryBlobs(ctx, query, currentID, after, limit)
+	metrics.ObserveQuery("list", start, err)
+	tracing.RecordError(span, err)
+
+	if err != nil {
+		return nil, helper.E(op, kindOf(err), err, CantProcessRequest)
+	}
+
+	return blobs, nil
+}
+
+func (p *MYSQLRepo) queryBlobs(ctx context.Context, query string, args ...any) ([]model.Blob, error) {
+	rows, err := p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blobs []model.Blob
+	for rows.Next() {
+		var blob model.Blob
+		if err := rows.Scan(&blob.SHA256, &blob.Size, &blob.Key.KeyID, &blob.Key.Wrapped); err != nil {
+			return nil, err
+		}
+
+		blobs = append(blobs, blob)
+	}
+
+	return blobs, rows.Err()
+}
+
+// Rewrap replaces the data key of the blob with the same key wrapped anew, only if it still
+// is old, a blob deleted or rotated meanwhile gives KindConflict
+func (p *MYSQLRepo) Rewrap(ctx context.Context, hash string, old, key model.DataKey) error {
+	const op = helper.Op("repo.MYSQLRepo.Rewrap")
+	const query = `UPDATE blobs SET key_id = ?, wrapped_key = ? WHERE hash = ? AND key_id = ? AND wrapped_key = ?`
+
+	ctx, span := startQuerySpan(ctx, op, query)
+	defer span.End()
+
+	start := time.Now()
+	cmd, err := p.db.ExecContext(ctx, query, key.KeyID, key.Wrapped, hash, old.KeyID, old.Wrapped)
+	metrics.ObserveQuery("update", start, err)
+	tracing.RecordError(span, err)
+
+	if err != nil {
+		return helper.E(op, kindOf(err), err, CantProcessRequest)
+	}
+
+	rowsAffected, err := cmd.RowsAffected()
+	if err != nil {
+		return helper.E(op, helper.KindUnexpected, err, CantProcessRequest)
+	}
+
+	if rowsAffected == 0 {
+		return helper.E(op, helper.KindConflict, ErrKeyChanged, ErrKeyChanged.Error())
+	}
+
+	return nil
+}
+
+// nullString stores an empty string as NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
@@ -0,0 +1,52 @@
+package repo
+
+import (
+	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/api/model"
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestMYSQLRepo_Rewrap(t *testing.T) {
+	p := MYSQLRepo{testDB}
+	ctx := context.Background()
+
+	old := model.DataKey{KeyID: "old", Wrapped: []byte("wrapped by old")}
+	blob := model.Blob{SHA256: strings.Repeat("cd", 32), Size: 42, Key: old}
+
+	attrs := model.ShortenResponse{Alias: "encrypted", Type: model.TypeFile, SHA256: blob.SHA256}
+	if _, err := p.InsertFile(ctx, "encrypted", attrs, []model.Blob{blob}); err != nil {
+		t.Fatalf("InsertFile() error = %v", err)
+	}
+
+	// a second upload of the content keeps the key the object is encrypted with
+	other := blob
+	other.Key = model.DataKey{KeyID: "new", Wrapped: []byte("another key")}
+	if _, err := p.InsertFile(ctx, "encrypted2", model.ShortenResponse{Alias: "encrypted2", Type: model.TypeFile, SHA256: blob.SHA256}, []model.Blob{other}); err != nil {
+		t.Fatalf("InsertFile() error = %v", err)
+	}
+
+	if got, err := p.BlobKey(ctx, blob.SHA256); err != nil || got.KeyID != "old" || !bytes.Equal(got.Wrapped, old.Wrapped) {
+		t.Fatalf("BlobKey() = %+v, %v, want %+v", got, err, old)
+	}
+
+	stale, err := p.StaleKeys(ctx, "new", "", 10)
+	if err != nil || len(stale) != 1 || stale[0].SHA256 != blob.SHA256 {
+		t.Fatalf("StaleKeys() = %+v, %v, want the blob", stale, err)
+	}
+
+	rotated := model.DataKey{KeyID: "new", Wrapped: []byte("wrapped by new")}
+	if err := p.Rewrap(ctx, blob.SHA256, old, rotated); err != nil {
+		t.Fatalf("Rewrap() error = %v", err)
+	}
+
+	if err := p.Rewrap(ctx, blob.SHA256, old, rotated); helper.GetKind(err) != helper.KindConflict {
+		t.Errorf("second Rewrap() error = %v, want conflict", err)
+	}
+
+	if stale, err := p.StaleKeys(ctx, "new", "", 10); err != nil || len(stale) != 0 {
+		t.Errorf("StaleKeys() after the rotation = %+v, %v, want none", stale, err)
+	}
+}
@@ -83,9 +83,13 @@ func setupDB() (func() error, error) {
 		return nil, err
 	}
 
-	_, err = testDB.ExecContext(ctx, migrations.UpCmd)
+	migrator, err := db.NewMigrator(testDB, migrations.Files)
 	if err != nil {
-		log.Fatalf("cant create table: %v", err)
+		return nil, err
+	}
+
+	if _, err := migrator.Up(ctx); err != nil {
+		log.Fatalf("cant migrate: %v", err)
 	}
 
 	cleanup := func() error {
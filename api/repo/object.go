@@ -2,23 +2,34 @@ package repo
 
 import (
 	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/api/metrics"
+	"backstreetlinkv2/api/tracing"
 	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"go.opentelemetry.io/otel/attribute"
 	"io"
+	"net/http"
+	"time"
 )
 
 var (
-	ErrNoObjectID = errors.New("object id is not found/empty")
+	ErrNoObjectID     = errors.New("object id is not found/empty")
+	ErrObjectNotFound = errors.New("file not found")
 )
 
 type ObjectScanner struct {
 	client     *s3.Client
 	bucketName string
+	transport  *http.Transport
 }
 
 type ObjectConfig struct {
@@ -26,6 +37,7 @@ type ObjectConfig struct {
 	SecretKey string
 	Endpoint  string
 	Bucket    string
+	Region    string
 }
 
 func NewObjectScanner(ctx context.Context, cfg ObjectConfig) (*ObjectScanner, error) {
@@ -37,11 +49,18 @@ func NewObjectScanner(ctx context.Context, cfg ObjectConfig) (*ObjectScanner, er
 		return aws.Endpoint{
 			PartitionID:   "aws",
 			URL:           cfg.Endpoint,
-			SigningRegion: "de",
+			SigningRegion: cfg.Region,
 		}, nil
 	})
 
-	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithCredentialsProvider(creds), config.WithEndpointResolverWithOptions(customResolver))
+	obj.transport = http.DefaultTransport.(*http.Transport).Clone()
+	httpClient := &http.Client{Transport: obj.transport}
+
+	awsCfg, err := config.LoadDefaultConfig(ctx,
+		config.WithCredentialsProvider(creds),
+		config.WithEndpointResolverWithOptions(customResolver),
+		config.WithHTTPClient(httpClient),
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -51,20 +70,72 @@ func NewObjectScanner(ctx context.Context, cfg ObjectConfig) (*ObjectScanner, er
 	return obj, nil
 }
 
-func (o *ObjectScanner) Upload(ctx context.Context, filename string, fileToUpload io.ReadCloser) error {
+// PutOptions are the optional parts of an upload
+type PutOptions struct {
+	// Checksum is the hex SHA-256 of the file, the storage refuses a body altered on the way
+	Checksum string
+
+	// CustomerKey encrypts the object with SSE-C instead of the bucket key, Get needs it back
+	CustomerKey []byte
+
+	// ContentType is sent back by Get, the storage default when empty
+	ContentType string
+}
+
+// sseCustomer returns the SSE-C headers of key: the algorithm, the key and its md5, all base64
+func sseCustomer(key []byte) (*string, *string, *string) {
+	sum := md5.Sum(key)
+
+	return aws.String("AES256"),
+		aws.String(base64.StdEncoding.EncodeToString(key)),
+		aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// Upload stores the file under filename, encrypted with the bucket key unless opts has a customer key
+func (o *ObjectScanner) Upload(ctx context.Context, filename string, fileToUpload io.ReadCloser, opts PutOptions) error {
 	const op = helper.Op("repo.ObjectScanner.Upload")
 
 	defer fileToUpload.Close()
 
-	output, err := o.client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:               aws.String(o.bucketName),
-		Key:                  aws.String(filename),
-		Body:                 fileToUpload,
-		ServerSideEncryption: types.ServerSideEncryptionAes256,
-	})
+	ctx, span := tracing.Start(ctx, op, attribute.String("object.key", filename))
+	defer span.End()
+
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(o.bucketName),
+		Key:    aws.String(filename),
+		Body:   fileToUpload,
+	}
+
+	// SSE-C and the bucket key exclude each other
+	if opts.CustomerKey != nil {
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = sseCustomer(opts.CustomerKey)
+	} else {
+		input.ServerSideEncryption = types.ServerSideEncryptionAes256
+	}
+
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+
+	if opts.Checksum != "" {
+		sum, err := hex.DecodeString(opts.Checksum)
+		if err != nil {
+			return helper.E(op, helper.KindUnexpected, err, CantProcessRequest)
+		}
+
+		input.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+		input.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(sum))
+	}
+
+	size := sizeOf(fileToUpload)
+	start := time.Now()
+	output, err := o.client.PutObject(ctx, input)
+	metrics.ObserveObject("upload", start, size, err)
+	tracing.RecordError(span, err)
+	span.SetAttributes(attribute.Int64("object.size", size))
 
 	if err != nil {
-		return helper.E(op, helper.KindUnexpected, err, CantProcessRequest)
+		return helper.E(op, objectKindOf(err), err, CantProcessRequest)
 	}
 
 	if output.ETag == nil {
@@ -74,29 +145,135 @@ func (o *ObjectScanner) Upload(ctx context.Context, filename string, fileToUploa
 	return nil
 }
 
+// Delete removes the object, a missing object is not an error
+func (o *ObjectScanner) Delete(ctx context.Context, filename string) error {
+	const op = helper.Op("repo.ObjectScanner.Delete")
+
+	ctx, span := tracing.Start(ctx, op, attribute.String("object.key", filename))
+	defer span.End()
+
+	start := time.Now()
+	_, err := o.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(o.bucketName),
+		Key:    aws.String(filename),
+	})
+	metrics.ObserveObject("delete", start, 0, err)
+	tracing.RecordError(span, err)
+
+	if err != nil && objectKindOf(err) != helper.KindNotFound {
+		return helper.E(op, objectKindOf(err), err, CantProcessRequest)
+	}
+
+	return nil
+}
+
+// Ping checks that the bucket exists and the credentials can reach it
+func (o *ObjectScanner) Ping(ctx context.Context) error {
+	const op = helper.Op("repo.ObjectScanner.Ping")
+
+	_, err := o.client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(o.bucketName),
+	})
+	if err != nil {
+		return helper.E(op, objectKindOf(err), err, CantProcessRequest)
+	}
+
+	return nil
+}
+
+// Close drops the idle connections, the in flight calls are left to finish
+func (o *ObjectScanner) Close() error {
+	o.transport.CloseIdleConnections()
+	return nil
+}
+
+// objectKindOf classifies the s3 errors, throttling and unavailable storage are retryable by the client
+func objectKindOf(err error) helper.Kind {
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return helper.KindNotFound
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NotFound", "NoSuchKey":
+			return helper.KindNotFound
+		case "SlowDown", "ServiceUnavailable", "RequestTimeout":
+			return helper.KindUnavailable
+		}
+	}
+
+	return kindOf(err)
+}
+
+// sizeOf returns the remaining bytes of a seekable body, 0 when it can't tell
+func sizeOf(body io.Reader) int64 {
+	seeker, ok := body.(io.Seeker)
+	if !ok {
+		return 0
+	}
+
+	current, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0
+	}
+
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0
+	}
+
+	if _, err := seeker.Seek(current, io.SeekStart); err != nil {
+		return 0
+	}
+
+	return end - current
+}
+
 type FileStat struct {
 	ContentType   string
 	ContentLength int64
 	Fill          string
 }
 
-func (o *ObjectScanner) Get(ctx context.Context, filename string, to io.Writer) (FileStat, error) {
+// Get writes the object to to, customerKey is the key of an object uploaded with SSE-C, nil otherwise
+func (o *ObjectScanner) Get(ctx context.Context, filename string, to io.Writer, customerKey []byte) (FileStat, error) {
 	const op = helper.Op("repo.ObjectScanner.Get")
 
+	ctx, span := tracing.Start(ctx, op, attribute.String("object.key", filename))
+	defer span.End()
+
 	objectInput := &s3.GetObjectInput{
-		Bucket:               aws.String(o.bucketName),
-		Key:                  aws.String(filename),
-		SSECustomerAlgorithm: aws.String("AES256"),
+		Bucket: aws.String(o.bucketName),
+		Key:    aws.String(filename),
+	}
+
+	if customerKey != nil {
+		objectInput.SSECustomerAlgorithm, objectInput.SSECustomerKey, objectInput.SSECustomerKeyMD5 = sseCustomer(customerKey)
 	}
 
+	start := time.Now()
 	object, err := o.client.GetObject(ctx, objectInput)
 	if err != nil {
-		return FileStat{}, helper.E(op, helper.KindUnexpected, err, CantProcessRequest)
+		metrics.ObserveObject("download", start, 0, err)
+		tracing.RecordError(span, err)
+
+		kind := objectKindOf(err)
+		if kind == helper.KindNotFound {
+			return FileStat{}, helper.E(op, kind, ErrObjectNotFound, ErrObjectNotFound.Error())
+		}
+
+		return FileStat{}, helper.E(op, kind, err, CantProcessRequest)
 	}
 
 	defer object.Body.Close()
 
-	_, err = io.Copy(to, object.Body)
+	written, err := io.Copy(to, object.Body)
+	metrics.ObserveObject("download", start, written, err)
+	tracing.RecordError(span, err)
+	span.SetAttributes(attribute.Int64("object.size", written))
+
 	if err != nil {
 		return FileStat{}, helper.E(op, helper.KindUnexpected, err, CantProcessRequest)
 	}
@@ -108,3 +285,82 @@ func (o *ObjectScanner) Get(ctx context.Context, filename string, to io.Writer)
 
 	return fs, nil
 }
+
+// ObjectInfo describes an object of the bucket
+type ObjectInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// List calls fn for every object whose key starts with prefix, page by page, until fn returns an error
+func (o *ObjectScanner) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	const op = helper.Op("repo.ObjectScanner.List")
+
+	ctx, span := tracing.Start(ctx, op, attribute.String("object.prefix", prefix))
+	defer span.End()
+
+	paginator := s3.NewListObjectsV2Paginator(o.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(o.bucketName),
+		Prefix: aws.String(prefix),
+	})
+
+	for paginator.HasMorePages() {
+		start := time.Now()
+		page, err := paginator.NextPage(ctx)
+		metrics.ObserveObject("list", start, 0, err)
+		tracing.RecordError(span, err)
+
+		if err != nil {
+			return helper.E(op, objectKindOf(err), err, CantProcessRequest)
+		}
+
+		for _, object := range page.Contents {
+			err := fn(ObjectInfo{
+				Key:          aws.ToString(object.Key),
+				Size:         object.Size,
+				LastModified: aws.ToTime(object.LastModified),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Stat returns the metadata of the object without downloading it. The object is listed
+// rather than read with HeadObject, which needs the customer key of an SSE-C object.
+func (o *ObjectScanner) Stat(ctx context.Context, filename string) (ObjectInfo, error) {
+	const op = helper.Op("repo.ObjectScanner.Stat")
+
+	ctx, span := tracing.Start(ctx, op, attribute.String("object.key", filename))
+	defer span.End()
+
+	start := time.Now()
+	page, err := o.client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(o.bucketName),
+		Prefix:  aws.String(filename),
+		MaxKeys: 1,
+	})
+	metrics.ObserveObject("stat", start, 0, err)
+	tracing.RecordError(span, err)
+
+	if err != nil {
+		return ObjectInfo{}, helper.E(op, objectKindOf(err), err, CantProcessRequest)
+	}
+
+	// the first key of the prefix is the object itself when it exists
+	if len(page.Contents) == 0 || aws.ToString(page.Contents[0].Key) != filename {
+		return ObjectInfo{}, helper.E(op, helper.KindNotFound, ErrObjectNotFound, ErrObjectNotFound.Error())
+	}
+
+	object := page.Contents[0]
+
+	return ObjectInfo{
+		Key:          filename,
+		Size:         object.Size,
+		LastModified: aws.ToTime(object.LastModified),
+	}, nil
+}
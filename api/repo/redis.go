@@ -0,0 +1,182 @@
+package repo
+
+import (
+	"backstreetlinkv2/api/helper"
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	redisOpTimeout    = 500 * time.Millisecond
+	redisResetTimeout = 30 * time.Second
+)
+
+type RedisConfig struct {
+	Addr     string
+	Username string
+	Password string
+	DB       int
+	PoolSize int
+
+	// Prefix is prepended to every key so several apps can share one redis
+	Prefix string
+
+	// TTL is applied to every entry, zero means the entry never expires
+	TTL time.Duration
+}
+
+type RedisCache struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+
+	hits      int64
+	misses    int64
+	delHits   int64
+	delMisses int64
+}
+
+func NewRedisCache(ctx context.Context, cfg RedisConfig) (*RedisCache, error) {
+	const op = helper.Op("repo.NewRedisCache")
+
+	if cfg.Addr == "" {
+		return nil, helper.E(op, helper.KindUnexpected, errors.New("redis address is empty"), CantProcessRequest)
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Addr,
+		Username: cfg.Username,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+		PoolSize: cfg.PoolSize,
+	})
+
+	// redis being down is not fatal, every call falls through to the db
+	if err := client.Ping(ctx).Err(); err != nil {
+		log.Warn().Err(err).Msgf("CACHE: redis at %s is not reachable", cfg.Addr)
+	}
+
+	return &RedisCache{
+		client: client,
+		prefix: cfg.Prefix,
+		ttl:    cfg.TTL,
+	}, nil
+}
+
+func (r *RedisCache) Get(key string) ([]byte, error) {
+	value, err := r.Peek(key)
+	if err != nil {
+		atomic.AddInt64(&r.misses, 1)
+		return nil, err
+	}
+
+	atomic.AddInt64(&r.hits, 1)
+	return value, nil
+}
+
+// Peek reads the entry without counting a hit or a miss
+func (r *RedisCache) Peek(key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	value, err := r.client.Get(ctx, r.prefix+key).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Warn().Err(err).Msgf("CACHE: redis get %s failed, treating as miss", key)
+		}
+
+		return nil, ErrCacheNotFound
+	}
+
+	return value, nil
+}
+
+func (r *RedisCache) Set(key string, value []byte) error {
+	const op = helper.Op("repo.RedisCache.Set")
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	if err := r.client.Set(ctx, r.prefix+key, value, r.ttl).Err(); err != nil {
+		return helper.E(op, kindOf(err), err, "can't store in server")
+	}
+
+	return nil
+}
+
+func (r *RedisCache) Delete(key string) error {
+	const op = helper.Op("repo.RedisCache.Delete")
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	deleted, err := r.client.Del(ctx, r.prefix+key).Result()
+	if err != nil {
+		return helper.E(op, kindOf(err), err, "can't delete from server")
+	}
+
+	if deleted > 0 {
+		atomic.AddInt64(&r.delHits, 1)
+	} else {
+		atomic.AddInt64(&r.delMisses, 1)
+	}
+
+	return nil
+}
+
+// Reset removes every key under the prefix
+func (r *RedisCache) Reset() error {
+	const op = helper.Op("repo.RedisCache.Reset")
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisResetTimeout)
+	defer cancel()
+
+	iter := r.client.Scan(ctx, 0, r.prefix+"*", 500).Iterator()
+
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+
+		if len(keys) == 500 {
+			if err := r.client.Del(ctx, keys...).Err(); err != nil {
+				return helper.E(op, kindOf(err), err, "can't flush the cache")
+			}
+
+			keys = keys[:0]
+		}
+	}
+
+	if err := iter.Err(); err != nil {
+		return helper.E(op, kindOf(err), err, "can't flush the cache")
+	}
+
+	if len(keys) > 0 {
+		if err := r.client.Del(ctx, keys...).Err(); err != nil {
+			return helper.E(op, kindOf(err), err, "can't flush the cache")
+		}
+	}
+
+	return nil
+}
+
+// Stats only counts the calls made by this process
+func (r *RedisCache) Stats() CacheStats {
+	return CacheStats{
+		Hits:      atomic.LoadInt64(&r.hits),
+		Misses:    atomic.LoadInt64(&r.misses),
+		DelHits:   atomic.LoadInt64(&r.delHits),
+		DelMisses: atomic.LoadInt64(&r.delMisses),
+	}
+}
+
+func (r *RedisCache) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
+func (r *RedisCache) Close() error {
+	return r.client.Close()
+}
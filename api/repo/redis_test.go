@@ -0,0 +1,170 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRedisCache(t *testing.T, ttl time.Duration) (*RedisCache, *miniredis.Miniredis) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+
+	cache, err := NewRedisCache(context.Background(), RedisConfig{
+		Addr:   server.Addr(),
+		Prefix: "test:",
+		TTL:    ttl,
+	})
+	if err != nil {
+		t.Fatalf("NewRedisCache() error = %v", err)
+	}
+
+	t.Cleanup(func() {
+		cache.Close()
+	})
+
+	return cache, server
+}
+
+func TestRedisCache_Get(t *testing.T) {
+	t.Parallel()
+
+	cache, _ := newTestRedisCache(t, time.Minute)
+
+	if err := cache.Set("somekey", []byte("test")); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		key     string
+		want    []byte
+		wantErr error
+	}{
+		{
+			name:    "test success",
+			key:     "somekey",
+			want:    []byte("test"),
+			wantErr: nil,
+		},
+
+		{
+			name:    "test failed",
+			key:     "somekey123",
+			want:    nil,
+			wantErr: ErrCacheNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cache.Get(tt.key)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Get() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Get() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedisCache_SetPrefixAndTTL(t *testing.T) {
+	t.Parallel()
+
+	cache, server := newTestRedisCache(t, time.Minute)
+
+	if err := cache.Set("foo", []byte("bar")); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	if !server.Exists("test:foo") {
+		t.Fatalf("expected key to be stored with prefix")
+	}
+
+	if ttl := server.TTL("test:foo"); ttl != time.Minute {
+		t.Errorf("TTL = %v, want %v", ttl, time.Minute)
+	}
+
+	server.FastForward(2 * time.Minute)
+
+	if _, err := cache.Get("foo"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("Get() after expiry error = %v, want %v", err, ErrCacheNotFound)
+	}
+}
+
+func TestRedisCache_ServerDown(t *testing.T) {
+	t.Parallel()
+
+	cache, server := newTestRedisCache(t, time.Minute)
+	server.Close()
+
+	if _, err := cache.Get("foo"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("Get() error = %v, want %v", err, ErrCacheNotFound)
+	}
+
+	if err := cache.Set("foo", []byte("bar")); err == nil {
+		t.Errorf("Set() expected error when redis is down")
+	}
+}
+
+func TestRedisCache_Delete(t *testing.T) {
+	t.Parallel()
+
+	cache, _ := newTestRedisCache(t, time.Minute)
+
+	if err := cache.Set("foo", []byte("bar")); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	if err := cache.Delete("foo"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	if _, err := cache.Get("foo"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("Get() after delete error = %v, want %v", err, ErrCacheNotFound)
+	}
+
+	if err := cache.Delete("foo"); err != nil {
+		t.Errorf("Delete() missing key error = %v", err)
+	}
+}
+
+func TestRedisCache_ResetAndStats(t *testing.T) {
+	t.Parallel()
+
+	cache, server := newTestRedisCache(t, time.Minute)
+
+	server.Set("other:key", "untouched")
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := cache.Set(key, []byte(key)); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+
+	cache.Get("a")
+	cache.Get("missing")
+
+	if err := cache.Reset(); err != nil {
+		t.Fatalf("Reset() error = %v", err)
+	}
+
+	if _, err := cache.Get("b"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("Get() after reset error = %v, want %v", err, ErrCacheNotFound)
+	}
+
+	if !server.Exists("other:key") {
+		t.Errorf("Reset() removed a key outside of the prefix")
+	}
+
+	stats := cache.Stats()
+	if stats.Hits != 1 || stats.Misses != 2 {
+		t.Errorf("Stats() = %+v, want 1 hit and 2 misses", stats)
+	}
+}
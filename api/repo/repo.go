@@ -2,17 +2,26 @@ package repo
 
 import (
 	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/api/metrics"
 	"backstreetlinkv2/api/model"
+	"backstreetlinkv2/api/tracing"
 	"context"
 	"database/sql"
-	"github.com/go-sql-driver/mysql"
+	"database/sql/driver"
 	"errors"
+	"github.com/go-sql-driver/mysql"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"net"
+	"time"
 )
 
 var (
 	ErrUnique         = errors.New("link already taken")
 	ErrNotFound       = errors.New("not found")
 	ErrNoRowsAffected = errors.New("no rows affected")
+	ErrBlocked        = errors.New("this alias has been blocked")
+	ErrExhausted      = errors.New("this alias has reached its download limit")
 )
 
 const (
@@ -28,22 +37,29 @@ func (p *MYSQLRepo) Insert(ctx context.Context, key string, dataSource any) erro
 	const op = helper.Op("repo.MYSQLRepo.Insert")
 	const query = `INSERT INTO sources (key_source, attrs) VALUES (?, ?)`
 
+	ctx, span := startQuerySpan(ctx, op, query)
+	defer span.End()
+
+	start := time.Now()
 	cmd, err := p.db.ExecContext(ctx, query, key, dataSource)
+	metrics.ObserveQuery("insert", start, err)
+	tracing.RecordError(span, err)
+
 	if err != nil {
 		var mysqlErr *mysql.MySQLError
 
 		if errors.As(err, &mysqlErr) {
 			if mysqlErr.Number == UniqueConstraint {
-				return helper.E(op, helper.KindBadRequest, ErrUnique, ErrUnique.Error())
+				return helper.E(op, helper.KindConflict, ErrUnique, ErrUnique.Error())
 			}
 		}
 
-		return helper.E(op, helper.KindUnexpected, err, CantProcessRequest)
+		return helper.E(op, kindOf(err), err, CantProcessRequest)
 	}
 
 	rowsAffected, err := cmd.RowsAffected()
 	if err != nil {
-		helper.E(op, helper.KindUnexpected, err, CantProcessRequest)
+		return helper.E(op, helper.KindUnexpected, err, CantProcessRequest)
 	}
 
 	if rowsAffected == 0 {
@@ -55,23 +71,268 @@ func (p *MYSQLRepo) Insert(ctx context.Context, key string, dataSource any) erro
 
 func (p *MYSQLRepo) Get(ctx context.Context, key string) (model.ShortenResponse, error) {
 	const op = helper.Op("repo.MYSQLRepo.Get")
-	const query = `SELECT attrs FROM sources WHERE key_source = ?`
+	const query = `SELECT attrs, COALESCE(blob_hash, ''), blocked_at IS NOT NULL, exhausted_at IS NOT NULL
+		FROM sources WHERE key_source = ?`
 
 	var resp model.ShortenResponse
+	var blobHash string
+	var blocked, exhausted bool
+
+	ctx, span := startQuerySpan(ctx, op, query)
+	defer span.End()
 
-	err := p.db.QueryRowContext(ctx, query, key).Scan(&resp)
+	start := time.Now()
+	err := p.db.QueryRowContext(ctx, query, key).Scan(&resp, &blobHash, &blocked, &exhausted)
+	metrics.ObserveQuery("get", start, ignoreNoRows(err))
+	tracing.RecordError(span, ignoreNoRows(err))
 
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return resp, helper.E(op, helper.KindNotFound, ErrNotFound, ErrNotFound.Error())
 		}
 
-		return resp, helper.E(op, helper.KindUnexpected, err, CantProcessRequest)
+		return resp, helper.E(op, kindOf(err), err, CantProcessRequest)
 	}
 
+	if blocked {
+		return model.ShortenResponse{}, helper.E(op, helper.KindGone, ErrBlocked, ErrBlocked.Error())
+	}
+
+	if exhausted {
+		return model.ShortenResponse{}, helper.E(op, helper.KindGone, ErrExhausted, ErrExhausted.Error())
+	}
+
+	resp.SHA256 = blobHash
 	return resp, nil
 }
 
+// Delete removes the row of key and returns the objects no row points at anymore, none when
+// the row is a link or its blobs are still shared. The caller deletes the objects, an upload of the
+// same content afterwards creates a new blob row and uploads its object again, see InsertFile.
+func (p *MYSQLRepo) Delete(ctx context.Context, key string) ([]string, error) {
+	const op = helper.Op("repo.MYSQLRepo.Delete")
+	const query = `DELETE FROM sources WHERE key_source = ?`
+
+	ctx, span := startQuerySpan(ctx, op, query)
+	defer span.End()
+
+	start := time.Now()
+	objects, err := p.delete(ctx, key)
+	metrics.ObserveQuery("delete", start, ignoreNoRows(err))
+	tracing.RecordError(span, ignoreNoRows(err))
+
+	if err == sql.ErrNoRows {
+		return nil, helper.E(op, helper.KindNotFound, ErrNotFound, ErrNotFound.Error())
+	}
+
+	if err != nil {
+		return nil, helper.E(op, kindOf(err), err, CantProcessRequest)
+	}
+
+	return objects, nil
+}
+
+func (p *MYSQLRepo) delete(ctx context.Context, key string) ([]string, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var attrs model.ShortenResponse
+	var blobHash sql.NullString
+	var exhausted bool
+
+	err = tx.QueryRowContext(ctx, `SELECT attrs, blob_hash, exhausted_at IS NOT NULL FROM sources WHERE key_source = ? FOR UPDATE`, key).
+		Scan(&attrs, &blobHash, &exhausted)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM sources WHERE key_source = ?`, key); err != nil {
+		return nil, err
+	}
+
+	// an exhausted row released its blobs with its last download
+	if exhausted {
+		return nil, tx.Commit()
+	}
+
+	objects, err := releaseAll(ctx, tx, key, attrs, blobHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, tx.Commit()
+}
+
+// releaseAll releases the blobs of the row of key and returns the objects no row points at anymore
+func releaseAll(ctx context.Context, tx *sql.Tx, key string, attrs model.ShortenResponse, blobHash sql.NullString) ([]string, error) {
+	var hashes []string
+	switch {
+	case blobHash.Valid:
+		hashes = []string{blobHash.String}
+
+	case len(attrs.Files) > 0:
+		for _, file := range attrs.Files {
+			hashes = append(hashes, file.SHA256)
+		}
+
+	case attrs.Type == model.TypeFile:
+		return []string{key}, nil
+	}
+
+	var objects []string
+	for _, hash := range hashes {
+		refs, err := release(ctx, tx, hash)
+		if err != nil {
+			return nil, err
+		}
+
+		// the same content twice in an alias is released twice, its object is listed once
+		if refs <= 0 && !contains(objects, BlobPrefix+hash) {
+			objects = append(objects, BlobPrefix+hash)
+		}
+	}
+
+	return objects, nil
+}
+
+// Consume counts a use of key against the limit in its attrs and returns the uses left, -1 when
+// it has no limit. The last one allowed releases the blobs like Delete and returns the objects
+// to delete, the row is kept so Get answers KindGone. The row is locked while counting,
+// concurrent uses never go past the limit.
+func (p *MYSQLRepo) Consume(ctx context.Context, key string) (int, []string, error) {
+	const op = helper.Op("repo.MYSQLRepo.Consume")
+	const query = `UPDATE sources SET uses = uses + 1 WHERE key_source = ?`
+
+	ctx, span := startQuerySpan(ctx, op, query)
+	defer span.End()
+
+	start := time.Now()
+	left, objects, err := p.consume(ctx, key)
+	metrics.ObserveQuery("consume", start, ignoreGone(err))
+	tracing.RecordError(span, ignoreGone(err))
+
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, nil, helper.E(op, helper.KindNotFound, ErrNotFound, ErrNotFound.Error())
+	case errors.Is(err, ErrBlocked) || errors.Is(err, ErrExhausted):
+		return 0, nil, helper.E(op, helper.KindGone, err, err.Error())
+	case err != nil:
+		return 0, nil, helper.E(op, kindOf(err), err, CantProcessRequest)
+	}
+
+	return left, objects, nil
+}
+
+func (p *MYSQLRepo) consume(ctx context.Context, key string) (int, []string, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	var attrs model.ShortenResponse
+	var blobHash sql.NullString
+	var uses int
+	var blocked, exhausted bool
+
+	err = tx.QueryRowContext(ctx, `SELECT attrs, blob_hash, uses, blocked_at IS NOT NULL, exhausted_at IS NOT NULL
+		FROM sources WHERE key_source = ? FOR UPDATE`, key).
+		Scan(&attrs, &blobHash, &uses, &blocked, &exhausted)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	switch {
+	case blocked:
+		return 0, nil, ErrBlocked
+	case exhausted:
+		return 0, nil, ErrExhausted
+	}
+
+	limit := attrs.Limit()
+	if limit == 0 {
+		return -1, nil, tx.Commit()
+	}
+
+	uses++
+	if uses < limit {
+		if _, err := tx.ExecContext(ctx, `UPDATE sources SET uses = ? WHERE key_source = ?`, uses, key); err != nil {
+			return 0, nil, err
+		}
+
+		return limit - uses, nil, tx.Commit()
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE sources SET uses = ?, exhausted_at = CURRENT_TIMESTAMP, blob_hash = NULL WHERE key_source = ?`, uses, key,
+	); err != nil {
+		return 0, nil, err
+	}
+
+	objects, err := releaseAll(ctx, tx, key, attrs, blobHash)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return 0, objects, tx.Commit()
+}
+
+func contains(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+func startQuerySpan(ctx context.Context, op helper.Op, query string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, op,
+		semconv.DBSystemMySQL,
+		semconv.DBStatementKey.String(query),
+	)
+}
+
+// ignoreNoRows keeps a missing row from being counted as a failed query
+func ignoreNoRows(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+
+	return err
+}
+
+// ignoreGone keeps a missing, blocked or exhausted row from being counted as a failed query
+func ignoreGone(err error) error {
+	if errors.Is(err, ErrBlocked) || errors.Is(err, ErrExhausted) {
+		return nil
+	}
+
+	return ignoreNoRows(err)
+}
+
+// kindOf tells a dependency that is down or too slow from an unexpected failure
+func kindOf(err error) helper.Kind {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) {
+		return helper.KindUnavailable
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return helper.KindTimeout
+		}
+
+		return helper.KindUnavailable
+	}
+
+	return helper.GetKind(err)
+}
+
 func NewMYSQLRepo(db *sql.DB) *MYSQLRepo {
 	return &MYSQLRepo{db: db}
 }
@@ -1,8 +1,11 @@
 package repo
 
 import (
+	"backstreetlinkv2/api/helper"
 	"backstreetlinkv2/api/model"
 	"context"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -59,3 +62,70 @@ func TestMYSQLRepo_Insert(t *testing.T) {
 		})
 	}
 }
+
+func TestMYSQLRepo_Delete(t *testing.T) {
+	p := MYSQLRepo{testDB}
+	ctx := context.Background()
+
+	err := p.Insert(ctx, "to-delete", model.ShortenRequest{
+		Alias:      "to-delete",
+		Type:       "LINK",
+		RedirectTo: "https://google.com",
+	})
+	if err != nil {
+		t.Fatalf("Insert() error = %v", err)
+	}
+
+	if objects, err := p.Delete(ctx, "to-delete"); err != nil || len(objects) != 0 {
+		t.Fatalf("Delete() = %q, %v, want no object to delete", objects, err)
+	}
+
+	if _, err := p.Get(ctx, "to-delete"); helper.GetKind(err) != helper.KindNotFound {
+		t.Errorf("Get() after Delete() error = %v, want not found", err)
+	}
+
+	if _, err := p.Delete(ctx, "to-delete"); helper.GetKind(err) != helper.KindNotFound {
+		t.Errorf("Delete() of a missing alias error = %v, want not found", err)
+	}
+}
+
+func TestMYSQLRepo_Consume(t *testing.T) {
+	p := MYSQLRepo{testDB}
+	ctx := context.Background()
+
+	blob := model.Blob{SHA256: strings.Repeat("ab", 32), Size: 6}
+	attrs := model.ShortenResponse{Alias: "burnt", Type: model.TypeFile, SHA256: blob.SHA256, MaxDownloads: 2}
+	if _, err := p.InsertFile(ctx, "burnt", attrs, []model.Blob{blob}); err != nil {
+		t.Fatalf("InsertFile() error = %v", err)
+	}
+
+	if left, objects, err := p.Consume(ctx, "burnt"); err != nil || left != 1 || len(objects) != 0 {
+		t.Fatalf("Consume() = %d, %q, %v, want 1 left", left, objects, err)
+	}
+
+	if left, objects, err := p.Consume(ctx, "burnt"); err != nil || left != 0 || !reflect.DeepEqual(objects, []string{BlobPrefix + blob.SHA256}) {
+		t.Fatalf("last Consume() = %d, %q, %v, want the blob released", left, objects, err)
+	}
+
+	if _, _, err := p.Consume(ctx, "burnt"); helper.GetKind(err) != helper.KindGone {
+		t.Errorf("Consume() of an exhausted alias error = %v, want gone", err)
+	}
+
+	if _, err := p.Get(ctx, "burnt"); helper.GetKind(err) != helper.KindGone {
+		t.Errorf("Get() of an exhausted alias error = %v, want gone", err)
+	}
+
+	source, err := p.Source(ctx, "burnt")
+	if err != nil || source.Uses != 2 || source.ExhaustedAt == nil {
+		t.Errorf("Source() = %+v, %v, want 2 uses and exhausted", source, err)
+	}
+
+	// the blobs went with the last download
+	if objects, err := p.Delete(ctx, "burnt"); err != nil || len(objects) != 0 {
+		t.Errorf("Delete() = %q, %v, want no object to delete", objects, err)
+	}
+
+	if _, _, err := p.Consume(ctx, "burnt"); helper.GetKind(err) != helper.KindNotFound {
+		t.Errorf("Consume() of a missing alias error = %v, want not found", err)
+	}
+}
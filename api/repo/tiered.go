@@ -0,0 +1,349 @@
+package repo
+
+import (
+	"backstreetlinkv2/api/helper"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// CacheBackend is anything that can act as the shared second tier
+type CacheBackend interface {
+	Get(key string) ([]byte, error)
+	Set(key string, val []byte) error
+	Delete(key string) error
+	Reset() error
+}
+
+// flushAllKey is published when the whole cache is flushed
+const flushAllKey = ""
+
+// resubscribeInterval is how often a replica tries to subscribe again while redis is down
+var resubscribeInterval = 5 * time.Second
+
+// Invalidator broadcasts key evictions to the other replicas
+type Invalidator interface {
+	Publish(ctx context.Context, key string) error
+	Subscribe(ctx context.Context, onEvict func(key string)) error
+}
+
+// TieredCache keeps hot entries in the process (L1) in front of a shared cache (L2).
+// The L1 lifetime should be shorter than the L2 one, it is the staleness window
+// when an invalidation message gets lost.
+type TieredCache struct {
+	l1          *Cache
+	l2          CacheBackend
+	invalidator Invalidator
+	unsubscribe context.CancelFunc
+
+	// subscribed is set once the invalidations are received, L1 is bypassed before
+	// as nothing would evict the entries changed by the other replicas
+	subscribed int32
+}
+
+// NewTieredCache doesn't fail when redis is down, the subscription is retried in the
+// background and every call goes to L2 meanwhile
+func NewTieredCache(ctx context.Context, l1 *Cache, l2 CacheBackend, invalidator Invalidator) (*TieredCache, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	t := &TieredCache{
+		l1:          l1,
+		l2:          l2,
+		invalidator: invalidator,
+		unsubscribe: cancel,
+	}
+
+	if invalidator == nil {
+		t.subscribed = 1
+		return t, nil
+	}
+
+	if err := t.subscribe(ctx); err != nil {
+		log.Warn().Err(err).Msg("CACHE: can't subscribe to the invalidations, L1 is bypassed until it can")
+		go t.resubscribe(ctx)
+	}
+
+	return t, nil
+}
+
+func (t *TieredCache) subscribe(ctx context.Context) error {
+	err := t.invalidator.Subscribe(ctx, func(key string) {
+		if key == flushAllKey {
+			if err := t.l1.Reset(); err != nil {
+				log.Warn().Err(err).Msg("CACHE: can't flush L1")
+			}
+
+			return
+		}
+
+		if err := t.l1.Delete(key); err != nil {
+			log.Warn().Err(err).Msgf("CACHE: can't evict %s from L1", key)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&t.subscribed, 1)
+	return nil
+}
+
+func (t *TieredCache) resubscribe(ctx context.Context) {
+	ticker := time.NewTicker(resubscribeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			if err := t.subscribe(ctx); err != nil {
+				log.Debug().Err(err).Msg("CACHE: still can't subscribe to the invalidations")
+				continue
+			}
+
+			log.Info().Msg("CACHE: subscribed to the invalidations, L1 is used again")
+			return
+		}
+	}
+}
+
+// useL1 tells if L1 can be read and filled, only once the invalidations are received
+func (t *TieredCache) useL1() bool {
+	return atomic.LoadInt32(&t.subscribed) == 1
+}
+
+func (t *TieredCache) Get(key string) ([]byte, error) {
+	const op = helper.Op("repo.TieredCache.Get")
+
+	if t.useL1() {
+		value, err := t.l1.Get(key)
+		if err == nil {
+			return value, nil
+		}
+
+		if !errors.Is(err, ErrCacheNotFound) {
+			log.Warn().Err(err).Msgf("CACHE: L1 get %s failed", key)
+		}
+	}
+
+	value, err := t.l2.Get(key)
+	if err != nil {
+		if errors.Is(err, ErrCacheNotFound) {
+			return nil, ErrCacheNotFound
+		}
+
+		return nil, helper.E(op, helper.GetKind(err), err, err.Error())
+	}
+
+	if !t.useL1() {
+		return value, nil
+	}
+
+	if err := t.l1.Set(key, value); err != nil {
+		log.Warn().Err(err).Msgf("CACHE: can't promote %s to L1", key)
+	}
+
+	return value, nil
+}
+
+// Peek reads the entry from L1 then L2 without counting it nor promoting it
+func (t *TieredCache) Peek(key string) ([]byte, error) {
+	const op = helper.Op("repo.TieredCache.Peek")
+
+	if t.useL1() {
+		if value, err := t.l1.Peek(key); err == nil {
+			return value, nil
+		}
+	}
+
+	get := t.l2.Get
+	if peeker, ok := t.l2.(interface{ Peek(string) ([]byte, error) }); ok {
+		get = peeker.Peek
+	}
+
+	value, err := get(key)
+	if err != nil {
+		if errors.Is(err, ErrCacheNotFound) {
+			return nil, ErrCacheNotFound
+		}
+
+		return nil, helper.E(op, helper.GetKind(err), err, err.Error())
+	}
+
+	return value, nil
+}
+
+func (t *TieredCache) Set(key string, value []byte) error {
+	const op = helper.Op("repo.TieredCache.Set")
+
+	if err := t.l2.Set(key, value); err != nil {
+		return helper.E(op, helper.GetKind(err), err, err.Error())
+	}
+
+	if t.useL1() {
+		if err := t.l1.Set(key, value); err != nil {
+			return helper.E(op, helper.GetKind(err), err, err.Error())
+		}
+	}
+
+	// the other replicas may hold an older value in their L1
+	t.publish(key)
+
+	return nil
+}
+
+func (t *TieredCache) Delete(key string) error {
+	const op = helper.Op("repo.TieredCache.Delete")
+
+	if err := t.l1.Delete(key); err != nil {
+		return helper.E(op, helper.GetKind(err), err, err.Error())
+	}
+
+	if err := t.l2.Delete(key); err != nil {
+		return helper.E(op, helper.GetKind(err), err, err.Error())
+	}
+
+	t.publish(key)
+
+	return nil
+}
+
+func (t *TieredCache) Reset() error {
+	const op = helper.Op("repo.TieredCache.Reset")
+
+	if err := t.l2.Reset(); err != nil {
+		return helper.E(op, helper.GetKind(err), err, err.Error())
+	}
+
+	if err := t.l1.Reset(); err != nil {
+		return helper.E(op, helper.GetKind(err), err, err.Error())
+	}
+
+	t.publish(flushAllKey)
+
+	return nil
+}
+
+// Stats counts an L1 miss that is found in L2 as a hit
+func (t *TieredCache) Stats() CacheStats {
+	stats := t.l1.Stats()
+
+	l2, ok := t.l2.(interface{ Stats() CacheStats })
+	if !ok {
+		return stats
+	}
+
+	l2Stats := l2.Stats()
+	stats.Hits += l2Stats.Hits
+	stats.Misses = l2Stats.Misses
+	stats.DelHits += l2Stats.DelHits
+	stats.DelMisses += l2Stats.DelMisses
+
+	return stats
+}
+
+// Ping checks the shared tier, the in process one can't fail
+func (t *TieredCache) Ping(ctx context.Context) error {
+	if pinger, ok := t.l2.(interface{ Ping(context.Context) error }); ok {
+		return pinger.Ping(ctx)
+	}
+
+	return nil
+}
+
+// Close stops listening for invalidations and closes both tiers
+func (t *TieredCache) Close() error {
+	t.unsubscribe()
+
+	if err := t.l1.Close(); err != nil {
+		return err
+	}
+
+	if closer, ok := t.l2.(interface{ Close() error }); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+func (t *TieredCache) publish(key string) {
+	if t.invalidator == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	if err := t.invalidator.Publish(ctx, key); err != nil {
+		log.Warn().Err(err).Msgf("CACHE: can't publish invalidation of %s", key)
+	}
+}
+
+// RedisInvalidator sends invalidations through a redis pub/sub channel.
+// Every message carries the sender id so a replica ignores its own messages.
+type RedisInvalidator struct {
+	client  *redis.Client
+	channel string
+	origin  string
+}
+
+func NewRedisInvalidator(cache *RedisCache, channel string) (*RedisInvalidator, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	return &RedisInvalidator{
+		client:  cache.client,
+		channel: cache.prefix + channel,
+		origin:  hex.EncodeToString(id),
+	}, nil
+}
+
+func (r *RedisInvalidator) Publish(ctx context.Context, key string) error {
+	return r.client.Publish(ctx, r.channel, r.origin+"|"+key).Err()
+}
+
+func (r *RedisInvalidator) Subscribe(ctx context.Context, onEvict func(key string)) error {
+	sub := r.client.Subscribe(ctx, r.channel)
+
+	// wait for the confirmation so no message published after this call is missed
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return err
+	}
+
+	go func() {
+		defer sub.Close()
+
+		messages := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+
+				origin, key, found := strings.Cut(msg.Payload, "|")
+				if !found || origin == r.origin {
+					continue
+				}
+
+				onEvict(key)
+			}
+		}
+	}()
+
+	return nil
+}
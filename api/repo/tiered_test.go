@@ -0,0 +1,185 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestReplica(t *testing.T, ctx context.Context, server *miniredis.Miniredis) (*TieredCache, *Cache) {
+	t.Helper()
+
+	l1, err := NewCache(ctx, time.Minute)
+	if err != nil {
+		t.Fatalf("NewCache() error = %v", err)
+	}
+
+	l2, err := NewRedisCache(ctx, RedisConfig{Addr: server.Addr(), Prefix: "test:", TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("NewRedisCache() error = %v", err)
+	}
+	t.Cleanup(func() { l2.Close() })
+
+	invalidator, err := NewRedisInvalidator(l2, "invalidate")
+	if err != nil {
+		t.Fatalf("NewRedisInvalidator() error = %v", err)
+	}
+
+	tiered, err := NewTieredCache(ctx, l1, l2, invalidator)
+	if err != nil {
+		t.Fatalf("NewTieredCache() error = %v", err)
+	}
+
+	return tiered, l1
+}
+
+func TestTieredCache_Promotion(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	server := miniredis.RunT(t)
+	first, _ := newTestReplica(t, ctx, server)
+	second, secondL1 := newTestReplica(t, ctx, server)
+
+	if err := first.Set("foo", []byte("bar")); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	if _, err := secondL1.Get("foo"); !errors.Is(err, ErrCacheNotFound) {
+		t.Fatalf("L1 of other replica should be empty, got err = %v", err)
+	}
+
+	got, err := second.Get("foo")
+	if err != nil || string(got) != "bar" {
+		t.Fatalf("Get() = %s, %v", got, err)
+	}
+
+	if got, err := secondL1.Get("foo"); err != nil || string(got) != "bar" {
+		t.Errorf("L2 hit should be promoted to L1, got %s, %v", got, err)
+	}
+}
+
+func TestTieredCache_DeleteInvalidatesOtherReplicas(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	server := miniredis.RunT(t)
+	first, firstL1 := newTestReplica(t, ctx, server)
+	second, secondL1 := newTestReplica(t, ctx, server)
+
+	if err := first.Set("foo", []byte("bar")); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	if _, err := second.Get("foo"); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+
+	if err := first.Delete("foo"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	if _, err := firstL1.Get("foo"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("own L1 should be evicted, got err = %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, err := secondL1.Get("foo")
+		if errors.Is(err, ErrCacheNotFound) {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("L1 of other replica was not invalidated")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := second.Get("foo"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("Get() after delete error = %v, want %v", err, ErrCacheNotFound)
+	}
+}
+
+// downInvalidator fails to subscribe until up is set
+type downInvalidator struct {
+	up int32
+}
+
+func (d *downInvalidator) Publish(context.Context, string) error {
+	return nil
+}
+
+func (d *downInvalidator) Subscribe(context.Context, func(key string)) error {
+	if atomic.LoadInt32(&d.up) == 0 {
+		return errors.New("connection refused")
+	}
+
+	return nil
+}
+
+func TestTieredCache_RedisDownAtStart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	interval := resubscribeInterval
+	resubscribeInterval = 10 * time.Millisecond
+	t.Cleanup(func() { resubscribeInterval = interval })
+
+	l1, err := NewCache(ctx, time.Minute)
+	if err != nil {
+		t.Fatalf("NewCache() error = %v", err)
+	}
+
+	l2, err := NewRedisCache(ctx, RedisConfig{Addr: miniredis.RunT(t).Addr(), TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("NewRedisCache() error = %v", err)
+	}
+	t.Cleanup(func() { l2.Close() })
+
+	invalidator := &downInvalidator{}
+	tiered, err := NewTieredCache(ctx, l1, l2, invalidator)
+	if err != nil {
+		t.Fatalf("NewTieredCache() error = %v, want the cache without L1", err)
+	}
+
+	if err := tiered.Set("foo", []byte("bar")); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	if got, err := tiered.Get("foo"); err != nil || string(got) != "bar" {
+		t.Fatalf("Get() = %s, %v, want it from L2", got, err)
+	}
+
+	if _, err := l1.Get("foo"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("L1 is filled without the invalidations, err = %v", err)
+	}
+
+	atomic.StoreInt32(&invalidator.up, 1)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !tiered.useL1() {
+		if time.Now().After(deadline) {
+			t.Fatalf("the subscription was not retried")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := tiered.Get("foo"); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+
+	if got, err := l1.Get("foo"); err != nil || string(got) != "bar" {
+		t.Errorf("L2 hit should be promoted to L1 once subscribed, got %s, %v", got, err)
+	}
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"backstreetlinkv2/api/middleware"
+	"backstreetlinkv2/api/service"
+	"expvar"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+type RouterConfig struct {
+	Limits      *Limits
+	AdminAPIKey string
+
+	// Middlewares wrap every route, in the given order. They don't see the requests no route
+	// matches, the ones that must wrap the router instead.
+	Middlewares []mux.MiddlewareFunc
+}
+
+// NewRouter registers the routes of the api, every route under /api/v2 is described by openapi.json
+func NewRouter(svc *service.Deps, cfg RouterConfig) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(middleware.Route)
+	router.Use(cfg.Middlewares...)
+
+	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}).Methods(http.MethodGet)
+
+	r := router.PathPrefix("/api/v2").Subrouter()
+	r.HandleFunc("/link", CreateLink(svc)).Methods(http.MethodPost)
+	r.HandleFunc("/file", CreateFile(svc, cfg.Limits)).Methods(http.MethodPost)
+	r.HandleFunc("/download-file/{alias}", DownloadFile(svc)).Methods(http.MethodGet)
+	r.HandleFunc("/preview/{alias}", Preview(svc)).Methods(http.MethodGet)
+	r.HandleFunc("/find/{alias}", Find(svc)).Methods(http.MethodGet)
+	r.HandleFunc("/openapi.json", OpenAPI()).Methods(http.MethodGet)
+	r.HandleFunc("/docs", SwaggerUI()).Methods(http.MethodGet)
+	r.HandleFunc("/docs/{asset}", SwaggerAssets()).Methods(http.MethodGet)
+
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(middleware.AdminOnly(cfg.AdminAPIKey))
+	admin.HandleFunc("/cache/stats", CacheStats(svc)).Methods(http.MethodGet)
+	admin.HandleFunc("/cache/{alias}", CacheEntry(svc)).Methods(http.MethodGet)
+	admin.HandleFunc("/cache/{alias}", EvictCache(svc)).Methods(http.MethodDelete)
+	admin.HandleFunc("/cache", FlushCache(svc)).Methods(http.MethodDelete)
+	admin.HandleFunc("/alias/{alias}", DeleteAlias(svc)).Methods(http.MethodDelete)
+	admin.Handle("/vars", expvar.Handler()).Methods(http.MethodGet)
+
+	return router
+}
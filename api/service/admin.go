@@ -0,0 +1,228 @@
+package service
+
+import (
+	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/api/model"
+	"backstreetlinkv2/api/preview"
+	"backstreetlinkv2/api/repo"
+	"backstreetlinkv2/api/tracing"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/rs/zerolog"
+	"strings"
+)
+
+var (
+	ErrNoCacheStats = errors.New("cache does not keep statistics")
+)
+
+type CacheEntryOutput struct {
+	CommonResponse
+	Alias    string                 `json:"alias"`
+	Cached   bool                   `json:"cached"`
+	Negative bool                   `json:"negative"`
+	Response *model.ShortenResponse `json:"response,omitempty"`
+}
+
+// CacheEntry shows what the cache holds for the alias without touching the storage nor
+// counting a hit or a miss
+func (d *Deps) CacheEntry(ctx context.Context, key string) CacheEntryOutput {
+	const op = helper.Op("CacheEntry")
+	var out CacheEntryOutput
+
+	ctx, span := tracing.Start(ctx, "service.CacheEntry")
+	defer finish(ctx, span, &out.CommonResponse)
+
+	out.Alias = key
+
+	cached, err := d.cachePeek(ctx, key)
+	if errors.Is(err, repo.ErrCacheNotFound) {
+		out.SetOK()
+		return out
+	}
+
+	if err != nil {
+		out.SetErr(helper.E(op, helper.GetKind(err), err, err.Error()))
+		return out
+	}
+
+	out.Cached = true
+
+	if _, ok := decodeNotFound(cached); ok {
+		out.Negative = true
+		out.SetOK()
+		return out
+	}
+
+	var resp model.ShortenResponse
+	if err := json.Unmarshal(cached, &resp); err != nil {
+		out.SetErr(helper.E(op, helper.KindUnexpected, err, `can't get your data`))
+		return out
+	}
+
+	out.Response = &resp
+
+	out.SetOK()
+	return out
+}
+
+type EvictCacheOutput struct {
+	CommonResponse
+	Alias string `json:"alias"`
+}
+
+func (d *Deps) EvictCache(ctx context.Context, key string) EvictCacheOutput {
+	const op = helper.Op("EvictCache")
+	var out EvictCacheOutput
+
+	ctx, span := tracing.Start(ctx, "service.EvictCache")
+	defer finish(ctx, span, &out.CommonResponse)
+
+	if err := d.cacheDelete(ctx, key); err != nil {
+		out.SetErr(helper.E(op, helper.GetKind(err), err, err.Error()))
+		return out
+	}
+
+	out.Alias = key
+
+	out.SetOK()
+	return out
+}
+
+type FlushCacheOutput struct {
+	CommonResponse
+}
+
+func (d *Deps) FlushCache(ctx context.Context) FlushCacheOutput {
+	const op = helper.Op("FlushCache")
+	var out FlushCacheOutput
+
+	ctx, span := tracing.Start(ctx, "service.FlushCache")
+	defer finish(ctx, span, &out.CommonResponse)
+
+	if err := d.cacheReset(ctx); err != nil {
+		out.SetErr(helper.E(op, helper.GetKind(err), err, err.Error()))
+		return out
+	}
+
+	out.SetOK()
+	return out
+}
+
+type CacheStatsOutput struct {
+	CommonResponse
+	Stats    repo.CacheStats `json:"stats"`
+	HitRatio float64         `json:"hit_ratio"`
+}
+
+func (d *Deps) CacheStats(ctx context.Context) CacheStatsOutput {
+	const op = helper.Op("CacheStats")
+	var out CacheStatsOutput
+
+	ctx, span := tracing.Start(ctx, "service.CacheStats")
+	defer finish(ctx, span, &out.CommonResponse)
+
+	statser, ok := d.cache.(CacheStatser)
+	if !ok {
+		out.SetErr(helper.E(op, helper.KindNotFound, ErrNoCacheStats, ErrNoCacheStats.Error()))
+		return out
+	}
+
+	out.Stats = statser.Stats()
+	if lookups := out.Stats.Hits + out.Stats.Misses; lookups > 0 {
+		out.HitRatio = float64(out.Stats.Hits) / float64(lookups)
+	}
+
+	out.SetOK()
+	return out
+}
+
+type DeleteAliasOutput struct {
+	CommonResponse
+	Alias string `json:"alias"`
+	Type  string `json:"type"`
+}
+
+// DeleteAlias removes the alias, its file and its cache entry. The row goes first so the alias
+// stops resolving even when the object can't be deleted, the orphan is left to the gc.
+func (d *Deps) DeleteAlias(ctx context.Context, key string) DeleteAliasOutput {
+	const op = helper.Op("DeleteAlias")
+	var out DeleteAliasOutput
+
+	ctx, span := tracing.Start(ctx, "service.DeleteAlias")
+	defer finish(ctx, span, &out.CommonResponse)
+
+	record, err := d.source(ctx, key)
+	if err != nil {
+		out.SetErr(helper.E(op, helper.GetKind(err), err, err.Error()))
+		return out
+	}
+
+	objects, err := d.storage.Delete(ctx, key)
+	if err != nil {
+		out.SetErr(helper.E(op, helper.GetKind(err), err, err.Error()))
+		return out
+	}
+
+	if err := d.cacheDelete(ctx, key); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("alias", key).Msg("cant evict the deleted alias from cache")
+	}
+
+	// a blob still shared by another alias is kept
+	d.deleteObjects(ctx, key, objects)
+
+	out.Alias = key
+	out.Type = record.Type
+
+	out.SetOK()
+	return out
+}
+
+// source reads the row of key, Get answers gone for the blocked and the exhausted aliases, the
+// ones a moderator deletes
+func (d *Deps) source(ctx context.Context, key string) (model.ShortenResponse, error) {
+	storage, ok := d.storage.(SourceStorage)
+	if !ok {
+		return d.storage.Get(ctx, key)
+	}
+
+	source, err := storage.Source(ctx, key)
+	return source.ShortenResponse, err
+}
+
+// deleteObjects deletes the objects released by the alias and the thumbnails of the blobs. A blob
+// stored again since its release is kept, an upload of its content waits until the delete is done.
+// The reconciler sweeps the ones that fail.
+func (d *Deps) deleteObjects(ctx context.Context, alias string, objects []string) {
+	storage, ok := d.storage.(ReleaseStorage)
+	if !ok || len(objects) == 0 {
+		d.deleteKeys(ctx, alias, objects)
+		return
+	}
+
+	err := storage.DeleteReleased(ctx, objects, func(released []string) {
+		d.deleteKeys(ctx, alias, released)
+	})
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("alias", alias).Msg("cant check the released objects, the reconciler deletes them")
+	}
+}
+
+// deleteKeys deletes the objects and the thumbnails of the blobs among them
+func (d *Deps) deleteKeys(ctx context.Context, alias string, objects []string) {
+	for _, object := range objects {
+		keys := []string{object}
+		if hash := strings.TrimPrefix(object, repo.BlobPrefix); hash != object {
+			for _, size := range preview.Sizes {
+				keys = append(keys, repo.ThumbKey(hash, size))
+			}
+		}
+
+		for _, key := range keys {
+			if err := d.uploader.Delete(ctx, key); err != nil {
+				zerolog.Ctx(ctx).Warn().Err(err).Str("alias", alias).Str("object", key).Msg("cant delete the object of the deleted alias")
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package service
+
+import (
+	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/api/model"
+	"backstreetlinkv2/api/repo"
+	"backstreetlinkv2/api/tracing"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"strconv"
+	"time"
+)
+
+// NegativeCacheTTL is how long a missing alias is remembered,
+// kept short so a freshly created alias on another replica shows up quickly
+const NegativeCacheTTL = 30 * time.Second
+
+// notFoundMarker prefixes the value stored for a missing alias,
+// the expiry is kept in the value because the cache has no per entry ttl
+var notFoundMarker = []byte("\x00notfound:")
+
+func encodeNotFound(now time.Time) []byte {
+	expiresAt := strconv.FormatInt(now.Add(NegativeCacheTTL).UnixNano(), 10)
+	return append(append([]byte{}, notFoundMarker...), expiresAt...)
+}
+
+func decodeNotFound(val []byte) (time.Time, bool) {
+	if !bytes.HasPrefix(val, notFoundMarker) {
+		return time.Time{}, false
+	}
+
+	nano, err := strconv.ParseInt(string(val[len(notFoundMarker):]), 10, 64)
+	if err != nil {
+		return time.Time{}, true
+	}
+
+	return time.Unix(0, nano), true
+}
+
+func (d *Deps) cacheGet(ctx context.Context, key string) ([]byte, error) {
+	_, span := tracing.Start(ctx, "cache.Get", attribute.String("cache.key", key))
+	defer span.End()
+
+	value, err := d.cache.Get(key)
+	span.SetAttributes(attribute.Bool("cache.hit", err == nil))
+
+	if err != nil && !errors.Is(err, repo.ErrCacheNotFound) {
+		tracing.RecordError(span, err)
+	}
+
+	return value, err
+}
+
+// cachePeek reads the entry without touching the counters of the cache, when it can
+func (d *Deps) cachePeek(ctx context.Context, key string) ([]byte, error) {
+	_, span := tracing.Start(ctx, "cache.Peek", attribute.String("cache.key", key))
+	defer span.End()
+
+	get := d.cache.Get
+	if peeker, ok := d.cache.(CachePeeker); ok {
+		get = peeker.Peek
+	}
+
+	value, err := get(key)
+	span.SetAttributes(attribute.Bool("cache.hit", err == nil))
+
+	if err != nil && !errors.Is(err, repo.ErrCacheNotFound) {
+		tracing.RecordError(span, err)
+	}
+
+	return value, err
+}
+
+func (d *Deps) cacheSet(ctx context.Context, key string, value []byte) error {
+	_, span := tracing.Start(ctx, "cache.Set", attribute.String("cache.key", key))
+
+	err := d.cache.Set(key, value)
+	tracing.End(span, err)
+
+	return err
+}
+
+func (d *Deps) cacheDelete(ctx context.Context, key string) error {
+	_, span := tracing.Start(ctx, "cache.Delete", attribute.String("cache.key", key))
+
+	err := d.cache.Delete(key)
+	tracing.End(span, err)
+
+	return err
+}
+
+func (d *Deps) cacheReset(ctx context.Context) error {
+	_, span := tracing.Start(ctx, "cache.Reset")
+
+	err := d.cache.Reset()
+	tracing.End(span, err)
+
+	return err
+}
+
+// lookup reads the alias through the cache, concurrent misses for the same key share one db query
+func (d *Deps) lookup(ctx context.Context, key string) (model.ShortenResponse, error) {
+	const op = helper.Op("service.lookup")
+
+	cached, err := d.cacheGet(ctx, key)
+	if err != nil && !errors.Is(err, repo.ErrCacheNotFound) {
+		return model.ShortenResponse{}, helper.E(op, helper.GetKind(err), err, err.Error())
+	}
+
+	if err == nil {
+		if expiresAt, ok := decodeNotFound(cached); ok {
+			if time.Now().Before(expiresAt) {
+				return model.ShortenResponse{}, helper.E(op, helper.KindNotFound, repo.ErrNotFound, repo.ErrNotFound.Error())
+			}
+		} else {
+			var resp model.ShortenResponse
+			if err := json.Unmarshal(cached, &resp); err == nil {
+				return resp, nil
+			}
+
+			zerolog.Ctx(ctx).Warn().Str("key", key).Msg("corrupted cache entry, reading from storage")
+		}
+	}
+
+	result, err, _ := d.group.Do(key, func() (any, error) {
+		resp, err := d.storage.Get(ctx, key)
+		if err != nil {
+			if helper.GetKind(err) == helper.KindNotFound {
+				if err := d.cacheSet(ctx, key, encodeNotFound(time.Now())); err != nil {
+					zerolog.Ctx(ctx).Warn().Err(err).Msg("cant store negative entry to cache in lookup")
+				}
+			}
+
+			return resp, err
+		}
+
+		marshalled, err := json.Marshal(resp)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("cant marshal lookup")
+			return resp, nil
+		}
+
+		if err := d.cacheSet(ctx, key, marshalled); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("cant store to cache in lookup")
+		}
+
+		return resp, nil
+	})
+
+	if err != nil {
+		return model.ShortenResponse{}, err
+	}
+
+	return result.(model.ShortenResponse), nil
+}
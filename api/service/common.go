@@ -2,13 +2,17 @@ package service
 
 import (
 	"backstreetlinkv2/api/helper"
-	"github.com/rs/zerolog/log"
+	"backstreetlinkv2/api/tracing"
+	"context"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/trace"
 	"strings"
 )
 
 type CommonResponse struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
+	err     error
 }
 
 func (c *CommonResponse) Set(code int, msg string) {
@@ -21,15 +25,28 @@ func (c *CommonResponse) SetOK() {
 	c.Message = "OK"
 }
 
+// Err returns the error given to SetErr, nil when the call succeeded
+func (c *CommonResponse) Err() error {
+	return c.err
+}
+
 func (c *CommonResponse) SetErr(err error) {
-	ops := helper.Ops(err)
+	c.err = err
 	c.Code = helper.GetKind(err)
 	c.Message = err.Error()
+}
 
-	log.Debug().
-		Int("status", c.Code).
-		Str("trace", strings.Join(ops, " - ")).
-		Errs("errs", helper.TraceErr(err)).
-		Msg(err.Error())
+// finish logs the error of the call, if any, with the request logger and ends its span
+func finish(ctx context.Context, span trace.Span, c *CommonResponse) {
+	defer tracing.End(span, c.err)
+
+	if c.err == nil {
+		return
+	}
 
+	zerolog.Ctx(ctx).Debug().
+		Int("status", c.Code).
+		Str("trace", strings.Join(helper.Ops(c.err), " - ")).
+		Errs("errs", helper.TraceErr(c.err)).
+		Msg(c.err.Error())
 }
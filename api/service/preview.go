@@ -0,0 +1,173 @@
+package service
+
+import (
+	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/api/model"
+	"backstreetlinkv2/api/preview"
+	"backstreetlinkv2/api/repo"
+	"backstreetlinkv2/api/tracing"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+var (
+	ErrPreviewSize = fmt.Errorf("the size of a preview is one of %v", preview.Sizes)
+	ErrNoPreview   = errors.New("an encrypted file has no preview")
+	ErrLimited     = errors.New("a file with a download limit has no preview")
+)
+
+type PreviewOptions struct {
+	// File selects one of the files of an alias sharing several, the first one by default
+	File string
+
+	// Size is one of preview.Sizes, preview.DefaultSize when zero
+	Size int
+}
+
+type PreviewOutput struct {
+	CommonResponse
+	ContentType   string        `json:"-"`
+	ContentLength string        `json:"-"`
+	File          io.ReadWriter `json:"-"`
+}
+
+// thumbnail is what the singleflight group shares between the concurrent previews
+type thumbnail struct {
+	data        []byte
+	contentType string
+}
+
+// Preview serves a thumbnail of an image, made on the first request then kept in the bucket
+// next to its blob, encrypted with the same key
+func (d *Deps) Preview(ctx context.Context, key string, opts PreviewOptions) PreviewOutput {
+	const op = helper.Op("Preview")
+	var out PreviewOutput
+
+	ctx, span := tracing.Start(ctx, "service.Preview")
+	defer finish(ctx, span, &out.CommonResponse)
+
+	if opts.Size == 0 {
+		opts.Size = preview.DefaultSize
+	}
+
+	if !preview.ValidSize(opts.Size) {
+		out.SetErr(helper.E(op, helper.KindBadRequest, ErrPreviewSize, ErrPreviewSize.Error()))
+		return out
+	}
+
+	record, err := d.storage.Get(ctx, key)
+	if err != nil {
+		out.SetErr(helper.E(op, helper.GetKind(err), err, err.Error()))
+		return out
+	}
+
+	if record.Type != model.TypeFile {
+		out.SetErr(helper.E(op, helper.KindBadRequest, ErrWrongType, ErrWrongType.Error()))
+		return out
+	}
+
+	// the server never sees the content of the files encrypted by the client
+	if record.Encryption != nil {
+		out.SetErr(helper.E(op, helper.KindUnsupported, ErrNoPreview, ErrNoPreview.Error()))
+		return out
+	}
+
+	// a preview would show the file without counting it
+	if record.Limit() > 0 {
+		out.SetErr(helper.E(op, helper.KindUnsupported, ErrLimited, ErrLimited.Error()))
+		return out
+	}
+
+	if opts.File == "" && len(record.Files) > 0 {
+		opts.File = "0"
+	}
+
+	entry, object, err := selectFile(record, opts.File)
+	if err != nil {
+		out.SetErr(helper.E(op, helper.KindNotFound, err, err.Error()))
+		return out
+	}
+
+	// the older files have no type, decoding them tells
+	if entry.ContentType != "" && !preview.IsImage(entry.ContentType) {
+		out.SetErr(helper.E(op, helper.KindUnsupported, preview.ErrUnsupported, preview.ErrUnsupported.Error()))
+		return out
+	}
+
+	thumb, err := d.thumbnail(ctx, key, entry, object, opts.Size)
+	if errors.Is(err, preview.ErrUnsupported) || errors.Is(err, preview.ErrTooLarge) {
+		out.SetErr(helper.E(op, helper.KindUnsupported, err, err.Error()))
+		return out
+	}
+
+	if err != nil {
+		out.SetErr(helper.E(op, helper.GetKind(err), err, CantProcessRequest))
+		return out
+	}
+
+	out.File = bytes.NewBuffer(thumb.data)
+	out.ContentType = thumb.contentType
+	out.ContentLength = strconv.Itoa(len(thumb.data))
+
+	out.SetOK()
+	return out
+}
+
+// thumbnail reads the stored thumbnail or makes it, once however many previews ask for it.
+// The files uploaded before the checksums have no key to keep theirs under, it is made every time.
+func (d *Deps) thumbnail(ctx context.Context, alias string, entry model.FileEntry, object string, size int) (thumbnail, error) {
+	customerKey, err := d.customerKey(ctx, entry.SHA256)
+	if err != nil {
+		return thumbnail{}, err
+	}
+
+	var thumbKey string
+	if entry.SHA256 != "" {
+		thumbKey = repo.ThumbKey(entry.SHA256, size)
+
+		// the thumbnails are jpegs or pngs, they tell their type whatever the storage kept
+		buf := bytes.NewBuffer([]byte{})
+		_, err := d.uploader.Get(ctx, thumbKey, buf, customerKey)
+		if err == nil {
+			return thumbnail{data: buf.Bytes(), contentType: http.DetectContentType(buf.Bytes())}, nil
+		}
+
+		if helper.GetKind(err) != helper.KindNotFound {
+			return thumbnail{}, err
+		}
+	}
+
+	v, err, _ := d.group.Do(fmt.Sprintf("thumbnail:%s:%d", object, size), func() (any, error) {
+		src := bytes.NewBuffer([]byte{})
+		if _, err := d.getVerified(ctx, alias, object, entry.SHA256, customerKey, src); err != nil {
+			return thumbnail{}, err
+		}
+
+		data, contentType, err := preview.Thumbnail(src.Bytes(), size)
+		if err != nil {
+			return thumbnail{}, err
+		}
+
+		if thumbKey != "" {
+			sum := sha256.Sum256(data)
+			opts := repo.PutOptions{Checksum: hex.EncodeToString(sum[:]), CustomerKey: customerKey, ContentType: contentType}
+
+			// the thumbnail is served all the same, the next preview makes it again
+			if err := d.uploader.Upload(ctx, thumbKey, io.NopCloser(bytes.NewReader(data)), opts); err != nil {
+				zerolog.Ctx(ctx).Warn().Err(err).Str("object", thumbKey).Msg("cant store the thumbnail")
+			}
+		}
+
+		return thumbnail{data: data, contentType: contentType}, nil
+	})
+
+	return v.(thumbnail), err
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"backstreetlinkv2/api/model"
+	"backstreetlinkv2/api/repo"
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"testing"
+)
+
+func pngFile(t *testing.T, width, height int) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.String()
+}
+
+func TestDeps_Preview(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	uploader := &fakeUploader{objects: map[string][]byte{}}
+	deps := NewLinkDeps(newFakeStorage(), uploader, newFakeCache())
+
+	req := fileRequest("picture", pngFile(t, 1024, 768))
+	req.Filename = "picture.png"
+
+	out := deps.InsertFile(ctx, req)
+	if out.Code != http.StatusOK {
+		t.Fatalf("InsertFile() code = %d", out.Code)
+	}
+
+	found := deps.Find(ctx, "picture", FindOptions{}).Response
+	if found.ContentType != "image/png" || found.Image == nil || found.Image.Width != 1024 || found.Image.Height != 768 {
+		t.Errorf("Find() = %+v, want a 1024x768 png", found)
+	}
+
+	if got := deps.DownloadFile(ctx, "picture", DownloadOptions{Inline: true}); got.ContentDisposition != `inline; filename="picture.png"` || got.ContentType != "image/png" {
+		t.Errorf("DownloadFile() inline = %s %s, want an inline png", got.ContentDisposition, got.ContentType)
+	}
+
+	for i := 0; i < 2; i++ {
+		preview := deps.Preview(ctx, "picture", PreviewOptions{Size: 128})
+		if preview.Code != http.StatusOK || preview.ContentType != "image/png" {
+			t.Fatalf("Preview() = %d %s, want a png", preview.Code, preview.ContentType)
+		}
+
+		config, err := png.DecodeConfig(preview.File)
+		if err != nil || config.Width != 128 || config.Height != 96 {
+			t.Errorf("thumbnail is %dx%d, %v, want 128x96", config.Width, config.Height, err)
+		}
+	}
+
+	// the second preview read the thumbnail stored by the first one
+	if len(uploader.uploaded) != 2 || uploader.uploaded[1] != repo.ThumbKey(out.SHA256, 128) {
+		t.Errorf("uploaded = %v, want the file then its thumbnail once", uploader.uploaded)
+	}
+
+	if got := deps.Preview(ctx, "picture", PreviewOptions{Size: 100}); got.Code != http.StatusBadRequest {
+		t.Errorf("Preview() of a size not offered code = %d, want %d", got.Code, http.StatusBadRequest)
+	}
+
+	if got := deps.InsertFile(ctx, fileRequest("document", "just some text")); got.Code != http.StatusOK {
+		t.Fatalf("InsertFile() code = %d", got.Code)
+	}
+
+	if got := deps.Preview(ctx, "document", PreviewOptions{}); got.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Preview() of a text code = %d, want %d", got.Code, http.StatusUnsupportedMediaType)
+	}
+
+	encrypted := fileRequest("secret", pngFile(t, 10, 10))
+	encrypted.Encryption = &model.Encryption{Algorithm: model.AlgorithmAESGCMChunked}
+	if got := deps.InsertFile(ctx, encrypted); got.Code != http.StatusOK {
+		t.Fatalf("InsertFile() code = %d", got.Code)
+	}
+
+	if got := deps.Preview(ctx, "secret", PreviewOptions{}); got.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Preview() of an encrypted file code = %d, want %d", got.Code, http.StatusUnsupportedMediaType)
+	}
+
+	if got := deps.DownloadFile(ctx, "secret", DownloadOptions{Inline: true}); got.ContentDisposition != `attachment; filename="report.pdf"` {
+		t.Errorf("DownloadFile() of an encrypted file = %s, want an attachment", got.ContentDisposition)
+	}
+}
@@ -1,54 +1,147 @@
 package service
 
 import (
+	"archive/zip"
 	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/api/kms"
 	"backstreetlinkv2/api/model"
+	"backstreetlinkv2/api/preview"
 	"backstreetlinkv2/api/repo"
+	"backstreetlinkv2/api/tracing"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/singleflight"
 	"io"
+	"mime/multipart"
 	"strconv"
+	"strings"
 )
 
 var (
-	ErrWrongType = errors.New("invalid request")
+	ErrWrongType        = errors.New("invalid request")
+	ErrChecksumMismatch = errors.New("the file doesn't match its sha256")
+	ErrNoKeyStorage     = errors.New("the storage doesn't keep the data keys")
+	ErrTooManyFiles     = errors.New("too many files")
+	ErrDuplicateName    = errors.New("the files of an alias must have distinct names")
+	ErrSingleFileOnly   = errors.New("sha256 and encryption describe a single file")
+	ErrFileNotFound     = errors.New("no such file in the alias")
 )
 
 const (
 	CantProcessRequest = "can't process your request"
+
+	// MaxFiles is the most files an alias can share
+	MaxFiles = 100
 )
 
 type Storage interface {
 	Insert(ctx context.Context, key string, data any) error
+	// InsertFile tells for each blob whether its row is new, no object can be left for a new row
+	InsertFile(ctx context.Context, key string, attrs model.ShortenResponse, blobs []model.Blob) ([]bool, error)
 	Get(ctx context.Context, key string) (model.ShortenResponse, error)
+
+	// Delete returns the objects no alias points at anymore
+	Delete(ctx context.Context, key string) ([]string, error)
+}
+
+// SourceStorage is implemented by the storages reading a row whatever its state, blocked or
+// exhausted included
+type SourceStorage interface {
+	Source(ctx context.Context, key string) (repo.Source, error)
+}
+
+// ReleaseStorage is implemented by the storages that hand over the objects no row points at and
+// keep them from being stored again while they are deleted
+type ReleaseStorage interface {
+	DeleteReleased(ctx context.Context, keys []string, del func(released []string)) error
+}
+
+// KeyStorage is implemented by the storages keeping the data keys of the objects encrypted with SSE-C
+type KeyStorage interface {
+	BlobKey(ctx context.Context, hash string) (model.DataKey, error)
 }
 
 type Uploader interface {
-	Upload(ctx context.Context, filename string, file io.ReadCloser) error
-	Get(ctx context.Context, filename string, wr io.Writer) (repo.FileStat, error)
+	Upload(ctx context.Context, filename string, file io.ReadCloser, opts repo.PutOptions) error
+	Get(ctx context.Context, filename string, wr io.Writer, customerKey []byte) (repo.FileStat, error)
+	Stat(ctx context.Context, filename string) (repo.ObjectInfo, error)
+	Delete(ctx context.Context, filename string) error
 }
 
 type Cache interface {
 	Get(key string) ([]byte, error)
 	Set(key string, val []byte) error
+	Delete(key string) error
+	Reset() error
+}
+
+// CacheStatser is implemented by the caches that keep counters
+type CacheStatser interface {
+	Stats() repo.CacheStats
 }
 
+// CachePeeker is implemented by the caches that can read an entry without counting it
+type CachePeeker interface {
+	Peek(key string) ([]byte, error)
+}
+
+// VerifyPolicy tells what DownloadFile does when the object read doesn't match the stored sha256
+type VerifyPolicy string
+
+const (
+	VerifyOff     VerifyPolicy = "off"
+	VerifyWarn    VerifyPolicy = "warn"
+	VerifyEnforce VerifyPolicy = "enforce"
+)
+
 type Deps struct {
 	storage  Storage
 	uploader Uploader
 	cache    Cache
+	verify   VerifyPolicy
+	group    singleflight.Group
+
+	keys    kms.KeyRing
+	encrypt bool
+}
+
+type Option func(*Deps)
+
+// WithVerifyPolicy sets how the downloads are checked against their sha256, VerifyEnforce by default
+func WithVerifyPolicy(policy VerifyPolicy) Option {
+	return func(d *Deps) {
+		d.verify = policy
+	}
 }
 
-func NewLinkDeps(storage Storage, uploader Uploader, cache Cache) *Deps {
-	return &Deps{
+// WithKeyRing unwraps the data keys of the encrypted objects, encryptUploads encrypts the new
+// ones with SSE-C. The storage must be a KeyStorage.
+func WithKeyRing(ring kms.KeyRing, encryptUploads bool) Option {
+	return func(d *Deps) {
+		d.keys = ring
+		d.encrypt = encryptUploads
+	}
+}
+
+func NewLinkDeps(storage Storage, uploader Uploader, cache Cache, opts ...Option) *Deps {
+	d := &Deps{
 		storage:  storage,
 		uploader: uploader,
 		cache:    cache,
+		verify:   VerifyEnforce,
 	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	return d
 }
 
 type InsertLinkOutput struct {
@@ -56,17 +149,26 @@ type InsertLinkOutput struct {
 	Alias      string `json:"alias"`
 	Type       string `json:"type"`
 	RedirectTo string `json:"redirect_to"`
+	MaxClicks  int    `json:"max_clicks,omitempty"`
 }
 
 func (d *Deps) InsertLink(ctx context.Context, data model.ShortenRequest) InsertLinkOutput {
 	const op = helper.Op("InsertLink")
 	var out InsertLinkOutput
 
+	ctx, span := tracing.Start(ctx, "service.InsertLink")
+	defer finish(ctx, span, &out.CommonResponse)
+
 	if data.Type != model.TypeLink {
 		out.SetErr(helper.E(op, helper.KindBadRequest, ErrWrongType, ErrWrongType.Error()))
 		return out
 	}
 
+	if err := d.checkLimit(data.MaxClicks); err != nil {
+		out.SetErr(helper.E(op, helper.GetKind(err), err, CantProcessRequest))
+		return out
+	}
+
 	err := d.storage.Insert(ctx, data.Alias, data)
 	if err != nil {
 		out.SetErr(helper.E(op, helper.GetKind(err), err, err.Error()))
@@ -76,18 +178,19 @@ func (d *Deps) InsertLink(ctx context.Context, data model.ShortenRequest) Insert
 	defer func() {
 		marshalled, err := json.Marshal(data)
 		if err != nil {
-			log.Warn().Err(err).Msg("cant marshal InsertLink")
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("cant marshal InsertLink")
 			return
 		}
 
-		if err := d.cache.Set(data.Alias, marshalled); err != nil {
-			log.Warn().Err(err).Msg("cant store to cache in InsertLink")
+		if err := d.cacheSet(ctx, data.Alias, marshalled); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("cant store to cache in InsertLink")
 		}
 	}()
 
 	out.Alias = data.Alias
 	out.Type = data.Type
 	out.RedirectTo = data.RedirectTo
+	out.MaxClicks = data.MaxClicks
 
 	out.SetOK()
 	return out
@@ -95,86 +198,324 @@ func (d *Deps) InsertLink(ctx context.Context, data model.ShortenRequest) Insert
 
 type InsertFileOutput struct {
 	CommonResponse
-	Alias    string `json:"alias"`
-	Type     string `json:"type"`
-	Filename string `json:"filename"`
+	Alias    string            `json:"alias"`
+	Type     string            `json:"type"`
+	Filename string            `json:"filename"`
+	SHA256   string            `json:"sha256"`
+	Files    []model.FileEntry `json:"files,omitempty"`
+
+	MaxDownloads  int  `json:"max_downloads,omitempty"`
+	BurnAfterRead bool `json:"burn_after_read,omitempty"`
 }
 
 func (d *Deps) InsertFile(ctx context.Context, data model.ShortenFileRequest) InsertFileOutput {
 	const op = helper.Op("InsertFile")
 	var out InsertFileOutput
 
+	ctx, span := tracing.Start(ctx, "service.InsertFile")
+	defer finish(ctx, span, &out.CommonResponse)
+
 	if data.Type != model.TypeFile {
 		out.SetErr(helper.E(op, helper.KindBadRequest, ErrWrongType, ErrWrongType.Error()))
 		return out
 	}
 
-	var err error
+	parts := data.Parts
+	if len(parts) == 0 {
+		parts = []model.FilePart{{Filename: data.Filename, File: data.RawFile}}
+	}
+
+	if err := checkParts(parts, data); err != nil {
+		out.SetErr(helper.E(op, helper.KindBadRequest, err, err.Error()))
+		return out
+	}
+
+	if data.BurnAfterRead && data.MaxDownloads > 1 {
+		out.SetErr(helper.E(op, helper.KindBadRequest, ErrBurnWithLimit, ErrBurnWithLimit.Error()))
+		return out
+	}
+
+	attrs := model.ShortenResponse{
+		Type:          data.Type,
+		Alias:         data.Alias,
+		Filename:      data.Filename,
+		Encryption:    data.Encryption,
+		MaxDownloads:  data.MaxDownloads,
+		BurnAfterRead: data.BurnAfterRead,
+	}
+
+	if err := d.checkLimit(attrs.Limit()); err != nil {
+		out.SetErr(helper.E(op, helper.GetKind(err), err, CantProcessRequest))
+		return out
+	}
+
+	blobs := make([]model.Blob, len(parts))
+	entries := make([]model.FileEntry, len(parts))
+	for i, part := range parts {
+		blob, err := hashFile(part.File)
+		if err != nil {
+			out.SetErr(helper.E(op, helper.KindUnexpected, err, CantProcessRequest))
+			return out
+		}
+
+		entries[i] = model.FileEntry{Name: part.Filename, Size: blob.Size, SHA256: blob.SHA256}
+
+		// the ciphertext of an encrypted file tells nothing
+		if data.Encryption == nil {
+			if entries[i].ContentType, entries[i].Image, err = sniffFile(part.File); err != nil {
+				out.SetErr(helper.E(op, helper.KindUnexpected, err, CantProcessRequest))
+				return out
+			}
+		}
+
+		if d.encrypt {
+			if blob.Key, err = d.newDataKey(ctx); err != nil {
+				out.SetErr(helper.E(op, helper.GetKind(err), err, CantProcessRequest))
+				return out
+			}
+		}
+
+		blobs[i] = blob
+	}
+
+	// the client sent the checksum of its file, a mismatch is a corrupted transfer
+	if data.SHA256 != "" && !strings.EqualFold(data.SHA256, blobs[0].SHA256) {
+		out.SetErr(helper.E(op, helper.KindBadRequest, ErrChecksumMismatch, "the uploaded file doesn't match its sha256"))
+		return out
+	}
+
+	if len(parts) == 1 {
+		attrs.SHA256 = blobs[0].SHA256
+		attrs.ContentType = entries[0].ContentType
+		attrs.Image = entries[0].Image
+	} else {
+		// the files are downloaded one by one or together as a zip named after the alias
+		attrs.Filename = data.Alias + ".zip"
+		attrs.Files = entries
+	}
 
-	err = d.uploader.Upload(ctx, data.Alias, data.RawFile)
+	// the row claims the alias before the upload, a taken alias must not overwrite the file of its owner
+	created, err := d.storage.InsertFile(ctx, data.Alias, attrs, blobs)
 	if err != nil {
 		out.SetErr(helper.E(op, helper.GetKind(err), err, err.Error()))
 		return out
 	}
 
-	err = d.storage.Insert(ctx, data.Alias, data)
+	keys := repo.ObjectKeys(attrs)
+	for i, part := range parts {
+		// the content may be stored already, its object is encrypted with the key it was stored with
+		opts := repo.PutOptions{Checksum: blobs[i].SHA256, ContentType: entries[i].ContentType}
+		opts.CustomerKey, err = d.customerKey(ctx, blobs[i].SHA256)
+		if err == nil {
+			err = d.uploadBlob(ctx, keys[i], part.File, opts, created[i])
+		}
+		if err != nil {
+			break
+		}
+	}
 	if err != nil {
+		// a row left behind is dangling, the reconciler removes it if this delete fails too
+		objects, deleteErr := d.storage.Delete(ctx, data.Alias)
+		if deleteErr != nil {
+			zerolog.Ctx(ctx).Warn().Err(deleteErr).Str("alias", data.Alias).Msg("cant release the alias of a failed upload")
+		}
+
+		// the files uploaded before the failure are left without a reference
+		d.deleteObjects(ctx, data.Alias, objects)
+
 		out.SetErr(helper.E(op, helper.GetKind(err), err, err.Error()))
 		return out
 	}
 
 	defer func() {
-		marshalled, err := json.Marshal(data)
+		marshalled, err := json.Marshal(attrs)
 		if err != nil {
-			log.Warn().Err(err).Msg("cant marshal InsertFile")
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("cant marshal InsertFile")
 			return
 		}
 
-		if err := d.cache.Set(data.Alias, marshalled); err != nil {
-			log.Warn().Err(err).Msg("cant store to cache in InsertFile")
+		if err := d.cacheSet(ctx, data.Alias, marshalled); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("cant store to cache in InsertFile")
 		}
 	}()
 
 	out.Alias = data.Alias
 	out.Type = data.Type
-	out.Filename = data.Filename
+	out.Filename = attrs.Filename
+	out.SHA256 = attrs.SHA256
+	out.Files = attrs.Files
+	out.MaxDownloads = attrs.MaxDownloads
+	out.BurnAfterRead = attrs.BurnAfterRead
 
 	out.SetOK()
 	return out
 }
 
+// checkParts refuses the uploads of too many files, of files named alike and the
+// checksum or encryption of a single file sent with several
+func checkParts(parts []model.FilePart, data model.ShortenFileRequest) error {
+	if len(parts) > MaxFiles {
+		return fmt.Errorf("%w, an alias shares at most %d", ErrTooManyFiles, MaxFiles)
+	}
+
+	if len(parts) == 1 {
+		return nil
+	}
+
+	if data.SHA256 != "" || data.Encryption != nil {
+		return ErrSingleFileOnly
+	}
+
+	names := make(map[string]struct{}, len(parts))
+	for _, part := range parts {
+		if _, ok := names[part.Filename]; ok {
+			return ErrDuplicateName
+		}
+
+		names[part.Filename] = struct{}{}
+	}
+
+	return nil
+}
+
+// hashFile reads the whole file for its SHA-256 then rewinds it for the upload
+func hashFile(file multipart.File) (model.Blob, error) {
+	hash := sha256.New()
+
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return model.Blob{}, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return model.Blob{}, err
+	}
+
+	return model.Blob{SHA256: hex.EncodeToString(hash.Sum(nil)), Size: size}, nil
+}
+
+// sniffFile returns the content type of the file and the dimensions of an image then rewinds it
+func sniffFile(file multipart.File) (string, *model.ImageInfo, error) {
+	contentType, width, height, err := preview.Sniff(file)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", nil, err
+	}
+
+	if width == 0 || height == 0 {
+		return contentType, nil, nil
+	}
+
+	return contentType, &model.ImageInfo{Width: width, Height: height}, nil
+}
+
+// uploadBlob always uploads the blob of a new row, an object found under its key belongs to a
+// released row whose delete found the blob stored again. The upload of a shared blob is skipped once its object
+// is there, the bucket checks the checksum of a new one.
+func (d *Deps) uploadBlob(ctx context.Context, key string, file io.ReadCloser, opts repo.PutOptions, created bool) error {
+	if created {
+		return d.uploader.Upload(ctx, key, file, opts)
+	}
+
+	if _, err := d.uploader.Stat(ctx, key); err == nil {
+		zerolog.Ctx(ctx).Debug().Str("object", key).Msg("blob already stored, upload skipped")
+		return file.Close()
+	}
+
+	return d.uploader.Upload(ctx, key, file, opts)
+}
+
+// newDataKey returns a new data key wrapped by the current master key
+func (d *Deps) newDataKey(ctx context.Context) (model.DataKey, error) {
+	dataKey, err := kms.NewDataKey()
+	if err != nil {
+		return model.DataKey{}, err
+	}
+
+	return d.keys.Wrap(ctx, dataKey)
+}
+
+// customerKey returns the data key of the blob, nil when its object is stored in the clear
+// or there is no key ring
+func (d *Deps) customerKey(ctx context.Context, hash string) ([]byte, error) {
+	const op = helper.Op("customerKey")
+
+	if d.keys == nil || hash == "" {
+		return nil, nil
+	}
+
+	storage, ok := d.storage.(KeyStorage)
+	if !ok {
+		return nil, helper.E(op, helper.KindUnexpected, ErrNoKeyStorage, CantProcessRequest)
+	}
+
+	key, err := storage.BlobKey(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if key.KeyID == "" {
+		return nil, nil
+	}
+
+	return d.keys.Unwrap(ctx, key)
+}
+
+// customerKeys returns the data key of every file, in their order
+func (d *Deps) customerKeys(ctx context.Context, files []model.FileEntry) ([][]byte, error) {
+	keys := make([][]byte, len(files))
+	for i, entry := range files {
+		key, err := d.customerKey(ctx, entry.SHA256)
+		if err != nil {
+			return nil, err
+		}
+
+		keys[i] = key
+	}
+
+	return keys, nil
+}
+
 type FindOutput struct {
 	CommonResponse
 	Response model.ShortenResponse `json:"response"`
 }
 
-func (d *Deps) Find(ctx context.Context, key string) FindOutput {
+type FindOptions struct {
+	// Resolve tells the lookup is followed, it counts a click of a link with max_clicks.
+	// An inspection of the alias leaves it unset, the target of such a link is then left out.
+	Resolve bool
+}
+
+// Find looks the alias up, a link with max_clicks only counts the lookups resolving it and only
+// gives its target to them
+func (d *Deps) Find(ctx context.Context, key string, opts FindOptions) FindOutput {
 	const op = helper.Op("Find")
 	var out FindOutput
 
-	resultFromMemory, err := d.cache.Get(key)
-	if (err != nil) && !errors.Is(err, repo.ErrCacheNotFound) {
+	ctx, span := tracing.Start(ctx, "service.Find")
+	defer finish(ctx, span, &out.CommonResponse)
+
+	result, err := d.lookup(ctx, key)
+	if err != nil {
 		out.SetErr(helper.E(op, helper.GetKind(err), err, err.Error()))
 		return out
 	}
 
-	if errors.Is(err, repo.ErrCacheNotFound) {
-		result, err := d.storage.Get(ctx, key)
-		if err != nil {
+	// a resolved link is a click, the files are counted when they are downloaded
+	if result.Type == model.TypeLink && result.Limit() > 0 {
+		if !opts.Resolve {
+			result.RedirectTo = ""
+		} else if _, err := d.consume(ctx, key, result); err != nil {
 			out.SetErr(helper.E(op, helper.GetKind(err), err, err.Error()))
 			return out
 		}
-
-		out.Response = result
-
-		out.SetOK()
-		return out
 	}
 
-	if err := json.Unmarshal(resultFromMemory, &out.Response); err != nil {
-		out.SetErr(helper.E(op, helper.GetKind(err), err, `can't get your data`))
-		return out
-	}
+	out.Response = result
 
 	out.SetOK()
 	return out
@@ -185,13 +526,38 @@ type DownloadFileOutput struct {
 	ContentDisposition string        `json:"-"`
 	ContentType        string        `json:"-"`
 	ContentLength      string        `json:"-"`
+	SHA256             string        `json:"-"`
 	File               io.ReadWriter `json:"-"`
+
+	// WriteTo streams the zip of an alias sharing several files instead of File, its length
+	// isn't known beforehand
+	WriteTo func(w io.Writer) error `json:"-"`
+
+	// Limited is set when the downloads are counted, no cache must serve the file again
+	Limited bool `json:"-"`
+}
+
+type DownloadOptions struct {
+	// File selects one of the files of an alias sharing several by index or name, without it
+	// they are served together as a zip
+	File string
+
+	// Inline lets a browser show the file, only the types preview.Inline allows are
+	Inline bool
 }
 
-func (d *Deps) DownloadFile(ctx context.Context, key string) DownloadFileOutput {
+// DownloadFile serves the file of the alias, or the files of an alias sharing several as a zip.
+// A download of an alias with a limit is counted before its first byte is sent, whether or not
+// the client gets all of it, and a download cut short is not given back: the count is what keeps
+// the limit when downloads run concurrently. The last use allowed releases the objects, they are
+// deleted once served and left to the reconciler otherwise.
+func (d *Deps) DownloadFile(ctx context.Context, key string, opts DownloadOptions) DownloadFileOutput {
 	const op = helper.Op("DownloadFile")
 	var out DownloadFileOutput
 
+	ctx, span := tracing.Start(ctx, "service.DownloadFile")
+	defer finish(ctx, span, &out.CommonResponse)
+
 	record, err := d.storage.Get(ctx, key)
 	if err != nil {
 		out.SetErr(helper.E(op, helper.GetKind(err), err, err.Error()))
@@ -203,18 +569,164 @@ func (d *Deps) DownloadFile(ctx context.Context, key string) DownloadFileOutput
 		return out
 	}
 
-	out.File = bytes.NewBuffer([]byte{})
+	out.Limited = record.Limit() > 0
 
-	fs, err := d.uploader.Get(ctx, record.Alias, out.File)
+	if len(record.Files) > 0 && opts.File == "" {
+		// the keys are read first, the last download releases the blobs along with their keys
+		customerKeys, err := d.customerKeys(ctx, record.Files)
+		if err != nil {
+			out.SetErr(helper.E(op, helper.GetKind(err), err, CantProcessRequest))
+			return out
+		}
+
+		released, err := d.consume(ctx, key, record)
+		if err != nil {
+			out.SetErr(helper.E(op, helper.GetKind(err), err, err.Error()))
+			return out
+		}
+
+		// an archive cut short leaves the objects it released to the reconciler
+		out.WriteTo = func(w io.Writer) error {
+			if err := d.writeZip(ctx, key, record.Files, customerKeys, w); err != nil {
+				return err
+			}
+
+			d.deleteObjects(ctx, key, released)
+			return nil
+		}
+		out.ContentType = "application/zip"
+		out.ContentDisposition = fmt.Sprintf("attachment; filename=\"%s\"", record.Filename)
+
+		out.SetOK()
+		return out
+	}
+
+	// one file of the alias is not a use, a limit counts the whole archive
+	if len(record.Files) > 0 && out.Limited {
+		out.SetErr(helper.E(op, helper.KindBadRequest, ErrLimitedFile, ErrLimitedFile.Error()))
+		return out
+	}
+
+	entry, object, err := selectFile(record, opts.File)
+	if err != nil {
+		out.SetErr(helper.E(op, helper.KindNotFound, err, err.Error()))
+		return out
+	}
+
+	customerKey, err := d.customerKey(ctx, entry.SHA256)
+	if err != nil {
+		out.SetErr(helper.E(op, helper.GetKind(err), err, CantProcessRequest))
+		return out
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+
+	fs, err := d.getVerified(ctx, key, object, entry.SHA256, customerKey, buf)
+	if err != nil {
+		out.SetErr(helper.E(op, helper.GetKind(err), err, CantProcessRequest))
+		return out
+	}
+
+	released, err := d.consume(ctx, key, record)
 	if err != nil {
 		out.SetErr(helper.E(op, helper.GetKind(err), err, err.Error()))
 		return out
 	}
 
+	// the file is in the buffer, nothing is sent yet and its object can go
+	d.deleteObjects(ctx, key, released)
+
+	out.File = buf
+	out.SHA256 = entry.SHA256
+
 	out.ContentType = fs.ContentType
+	if entry.ContentType != "" {
+		out.ContentType = entry.ContentType
+	}
+	if record.Encryption != nil {
+		// the ciphertext is opaque, whatever the storage guessed
+		out.ContentType = "application/octet-stream"
+	}
 	out.ContentLength = strconv.FormatInt(fs.ContentLength, 10)
-	out.ContentDisposition = fmt.Sprintf("attachment; filename=\"%s\"", record.Filename)
+
+	// the type is the one sniffed on upload, the older files are never inline
+	disposition := "attachment"
+	if opts.Inline && record.Encryption == nil && preview.Inline(entry.ContentType) {
+		disposition = "inline"
+	}
+	out.ContentDisposition = fmt.Sprintf("%s; filename=\"%s\"", disposition, entry.Name)
 
 	out.SetOK()
 	return out
 }
+
+// selectFile returns the file of record picked by file and the object holding it,
+// the file of a single file alias is its index 0
+func selectFile(record model.ShortenResponse, file string) (model.FileEntry, string, error) {
+	if len(record.Files) == 0 {
+		if file == "" || file == "0" || file == record.Filename {
+			entry := model.FileEntry{Name: record.Filename, SHA256: record.SHA256, ContentType: record.ContentType, Image: record.Image}
+			return entry, repo.ObjectKey(record), nil
+		}
+
+		return model.FileEntry{}, "", ErrFileNotFound
+	}
+
+	if i, err := strconv.Atoi(file); err == nil && i >= 0 && i < len(record.Files) {
+		return record.Files[i], repo.BlobPrefix + record.Files[i].SHA256, nil
+	}
+
+	for _, entry := range record.Files {
+		if entry.Name == file {
+			return entry, repo.BlobPrefix + entry.SHA256, nil
+		}
+	}
+
+	return model.FileEntry{}, "", ErrFileNotFound
+}
+
+// getVerified writes the object to w and checks it against sha256 as the policy says,
+// the files uploaded before the checksums have none to check
+func (d *Deps) getVerified(ctx context.Context, alias, object, sum string, customerKey []byte, w io.Writer) (repo.FileStat, error) {
+	const op = helper.Op("getVerified")
+
+	hash := sha256.New()
+
+	fs, err := d.uploader.Get(ctx, object, io.MultiWriter(w, hash), customerKey)
+	if err != nil {
+		return fs, err
+	}
+
+	if sum == "" || d.verify == VerifyOff {
+		return fs, nil
+	}
+
+	if got := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(got, sum) {
+		zerolog.Ctx(ctx).Error().Str("alias", alias).Str("object", object).Str("want", sum).Str("got", got).Msg("stored file doesn't match its sha256")
+
+		if d.verify == VerifyEnforce {
+			return fs, helper.E(op, helper.KindUnexpected, ErrChecksumMismatch, CantProcessRequest)
+		}
+	}
+
+	return fs, nil
+}
+
+// writeZip streams the files into a zip archive as they are read from the bucket, nothing is
+// buffered. The headers are sent by then, a failing file cuts the archive short.
+func (d *Deps) writeZip(ctx context.Context, alias string, files []model.FileEntry, customerKeys [][]byte, w io.Writer) error {
+	zw := zip.NewWriter(w)
+
+	for i, entry := range files {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: entry.Name, Method: zip.Deflate})
+		if err != nil {
+			return err
+		}
+
+		if _, err := d.getVerified(ctx, alias, repo.BlobPrefix+entry.SHA256, entry.SHA256, customerKeys[i], fw); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
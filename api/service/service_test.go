@@ -0,0 +1,792 @@
+package service
+
+import (
+	"archive/zip"
+	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/api/kms"
+	"backstreetlinkv2/api/model"
+	"backstreetlinkv2/api/preview"
+	"backstreetlinkv2/api/repo"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeStorage struct {
+	mu        sync.Mutex
+	records   map[string]model.ShortenResponse
+	keys      map[string]model.DataKey
+	uses      map[string]int
+	exhausted map[string]bool
+	blocked   map[string]bool
+	gets      int32
+	delay     time.Duration
+}
+
+func newFakeStorage() *fakeStorage {
+	return &fakeStorage{
+		records:   map[string]model.ShortenResponse{},
+		keys:      map[string]model.DataKey{},
+		uses:      map[string]int{},
+		exhausted: map[string]bool{},
+		blocked:   map[string]bool{},
+	}
+}
+
+func (f *fakeStorage) Insert(_ context.Context, key string, data any) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.records[key]; ok {
+		return helper.E("fakeStorage.Insert", helper.KindConflict, repo.ErrUnique, repo.ErrUnique.Error())
+	}
+
+	switch v := data.(type) {
+	case model.ShortenRequest:
+		f.records[key] = model.ShortenResponse{Alias: v.Alias, Type: v.Type, RedirectTo: v.RedirectTo, MaxClicks: v.MaxClicks}
+	case model.ShortenFileRequest:
+		f.records[key] = model.ShortenResponse{Alias: v.Alias, Type: v.Type, Filename: v.Filename}
+	}
+
+	return nil
+}
+
+func (f *fakeStorage) InsertFile(_ context.Context, key string, attrs model.ShortenResponse, blobs []model.Blob) ([]bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.records[key]; ok {
+		return nil, helper.E("fakeStorage.InsertFile", helper.KindConflict, repo.ErrUnique, repo.ErrUnique.Error())
+	}
+
+	shared := f.shared(key)
+	f.records[key] = attrs
+
+	created := make([]bool, len(blobs))
+	for i, blob := range blobs {
+		created[i] = !shared[repo.BlobPrefix+blob.SHA256]
+		shared[repo.BlobPrefix+blob.SHA256] = true
+
+		if _, ok := f.keys[blob.SHA256]; !ok {
+			f.keys[blob.SHA256] = blob.Key
+		}
+	}
+
+	return created, nil
+}
+
+func (f *fakeStorage) BlobKey(_ context.Context, hash string) (model.DataKey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.keys[hash], nil
+}
+
+func (f *fakeStorage) Get(_ context.Context, key string) (model.ShortenResponse, error) {
+	atomic.AddInt32(&f.gets, 1)
+	time.Sleep(f.delay)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	record, ok := f.records[key]
+	if !ok {
+		return record, helper.E("fakeStorage.Get", helper.KindNotFound, repo.ErrNotFound, repo.ErrNotFound.Error())
+	}
+
+	if f.blocked[key] {
+		return model.ShortenResponse{}, helper.E("fakeStorage.Get", helper.KindGone, repo.ErrBlocked, repo.ErrBlocked.Error())
+	}
+
+	if f.exhausted[key] {
+		return model.ShortenResponse{}, helper.E("fakeStorage.Get", helper.KindGone, repo.ErrExhausted, repo.ErrExhausted.Error())
+	}
+
+	return record, nil
+}
+
+func (f *fakeStorage) Source(_ context.Context, key string) (repo.Source, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	record, ok := f.records[key]
+	if !ok {
+		return repo.Source{}, helper.E("fakeStorage.Source", helper.KindNotFound, repo.ErrNotFound, repo.ErrNotFound.Error())
+	}
+
+	return repo.Source{ShortenResponse: record}, nil
+}
+
+func (f *fakeStorage) Consume(_ context.Context, key string) (int, []string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	record, ok := f.records[key]
+	if !ok {
+		return 0, nil, helper.E("fakeStorage.Consume", helper.KindNotFound, repo.ErrNotFound, repo.ErrNotFound.Error())
+	}
+
+	if f.exhausted[key] {
+		return 0, nil, helper.E("fakeStorage.Consume", helper.KindGone, repo.ErrExhausted, repo.ErrExhausted.Error())
+	}
+
+	f.uses[key]++
+	if left := record.Limit() - f.uses[key]; left > 0 {
+		return left, nil, nil
+	}
+
+	f.exhausted[key] = true
+	return 0, f.released(record), nil
+}
+
+func (f *fakeStorage) Delete(_ context.Context, key string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	record, ok := f.records[key]
+	if !ok {
+		return nil, helper.E("fakeStorage.Delete", helper.KindNotFound, repo.ErrNotFound, repo.ErrNotFound.Error())
+	}
+
+	delete(f.records, key)
+
+	if f.exhausted[key] {
+		return nil, nil
+	}
+
+	return f.released(record), nil
+}
+
+// released returns the objects of record no other alias points at
+func (f *fakeStorage) released(record model.ShortenResponse) []string {
+	if record.Type != model.TypeFile {
+		return nil
+	}
+
+	shared := f.shared(record.Alias)
+
+	var objects []string
+	for _, object := range repo.ObjectKeys(record) {
+		if !shared[object] {
+			objects = append(objects, object)
+		}
+	}
+
+	return objects
+}
+
+// shared returns the objects the aliases other than alias point at
+func (f *fakeStorage) shared(alias string) map[string]bool {
+	shared := map[string]bool{}
+	for key, other := range f.records {
+		if other.Type == model.TypeFile && key != alias && !f.exhausted[key] {
+			for _, object := range repo.ObjectKeys(other) {
+				shared[object] = true
+			}
+		}
+	}
+
+	return shared
+}
+
+type fakeUploader struct {
+	uploaded  []string
+	deleted   []string
+	uploadErr error
+
+	// content is what Get reads, whatever the key
+	content string
+
+	// objects keeps the uploads when set, Get reads them instead of content
+	objects map[string][]byte
+
+	// customerKeys are the SSE-C keys of the uploads, Get wants the same
+	customerKeys map[string][]byte
+}
+
+func (f *fakeUploader) Upload(_ context.Context, filename string, file io.ReadCloser, opts repo.PutOptions) error {
+	if f.uploadErr != nil {
+		return f.uploadErr
+	}
+
+	if f.objects != nil {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return err
+		}
+
+		f.objects[filename] = data
+	}
+
+	if f.customerKeys == nil {
+		f.customerKeys = map[string][]byte{}
+	}
+
+	f.uploaded = append(f.uploaded, filename)
+	f.customerKeys[filename] = opts.CustomerKey
+
+	return nil
+}
+
+func (f *fakeUploader) Get(_ context.Context, filename string, w io.Writer, customerKey []byte) (repo.FileStat, error) {
+	if !bytes.Equal(f.customerKeys[filename], customerKey) {
+		return repo.FileStat{}, helper.E("fakeUploader.Get", helper.KindBadRequest, errors.New("wrong customer key"), "wrong customer key")
+	}
+
+	if f.objects != nil {
+		data, ok := f.objects[filename]
+		if !ok {
+			return repo.FileStat{}, helper.E("fakeUploader.Get", helper.KindNotFound, repo.ErrObjectNotFound, "not found")
+		}
+
+		n, err := w.Write(data)
+		return repo.FileStat{ContentLength: int64(n)}, err
+	}
+
+	n, err := io.WriteString(w, f.content)
+	return repo.FileStat{ContentLength: int64(n)}, err
+}
+
+func (f *fakeUploader) Stat(_ context.Context, filename string) (repo.ObjectInfo, error) {
+	for _, uploaded := range f.uploaded {
+		if uploaded == filename {
+			return repo.ObjectInfo{Key: filename}, nil
+		}
+	}
+
+	return repo.ObjectInfo{}, helper.E("fakeUploader.Stat", helper.KindNotFound, repo.ErrObjectNotFound, "not found")
+}
+
+func (f *fakeUploader) Delete(_ context.Context, filename string) error {
+	f.deleted = append(f.deleted, filename)
+	return nil
+}
+
+type fakeCache struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+}
+
+func newFakeCache() *fakeCache {
+	return &fakeCache{entries: map[string][]byte{}}
+}
+
+func (f *fakeCache) Get(key string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	val, ok := f.entries[key]
+	if !ok {
+		return nil, repo.ErrCacheNotFound
+	}
+
+	return val, nil
+}
+
+func (f *fakeCache) Set(key string, val []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.entries[key] = val
+	return nil
+}
+
+func (f *fakeCache) Delete(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.entries, key)
+	return nil
+}
+
+func (f *fakeCache) Reset() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.entries = map[string][]byte{}
+	return nil
+}
+
+func TestDeps_FindReadThrough(t *testing.T) {
+	t.Parallel()
+
+	storage := newFakeStorage()
+	storage.records["somekey"] = model.ShortenResponse{Alias: "somekey", Type: model.TypeLink, RedirectTo: "https://google.com"}
+
+	cache := newFakeCache()
+	deps := NewLinkDeps(storage, &fakeUploader{}, cache)
+
+	for i := 0; i < 3; i++ {
+		out := deps.Find(context.Background(), "somekey", FindOptions{})
+		if out.Code != http.StatusOK {
+			t.Fatalf("Find() code = %d, want %d", out.Code, http.StatusOK)
+		}
+
+		if out.Response.RedirectTo != "https://google.com" {
+			t.Errorf("Find() redirect = %s", out.Response.RedirectTo)
+		}
+	}
+
+	if got := atomic.LoadInt32(&storage.gets); got != 1 {
+		t.Errorf("storage.Get called %d times, want 1", got)
+	}
+}
+
+func TestDeps_FindNegativeCache(t *testing.T) {
+	t.Parallel()
+
+	storage := newFakeStorage()
+	cache := newFakeCache()
+	deps := NewLinkDeps(storage, &fakeUploader{}, cache)
+
+	for i := 0; i < 3; i++ {
+		if out := deps.Find(context.Background(), "missing", FindOptions{}); out.Code != http.StatusNotFound {
+			t.Fatalf("Find() code = %d, want %d", out.Code, http.StatusNotFound)
+		}
+	}
+
+	if got := atomic.LoadInt32(&storage.gets); got != 1 {
+		t.Errorf("storage.Get called %d times, want 1", got)
+	}
+
+	out := deps.InsertLink(context.Background(), model.ShortenRequest{
+		Alias:      "missing",
+		Type:       model.TypeLink,
+		RedirectTo: "https://google.com",
+	})
+	if out.Code != http.StatusOK {
+		t.Fatalf("InsertLink() code = %d, want %d", out.Code, http.StatusOK)
+	}
+
+	if out := deps.Find(context.Background(), "missing", FindOptions{}); out.Code != http.StatusOK {
+		t.Errorf("Find() after insert code = %d, want %d", out.Code, http.StatusOK)
+	}
+}
+
+func TestDeps_FindNegativeCacheExpired(t *testing.T) {
+	t.Parallel()
+
+	storage := newFakeStorage()
+	cache := newFakeCache()
+	deps := NewLinkDeps(storage, &fakeUploader{}, cache)
+
+	cache.Set("expired", encodeNotFound(time.Now().Add(-2*NegativeCacheTTL)))
+	storage.records["expired"] = model.ShortenResponse{Alias: "expired", Type: model.TypeLink}
+
+	if out := deps.Find(context.Background(), "expired", FindOptions{}); out.Code != http.StatusOK {
+		t.Errorf("Find() code = %d, want %d", out.Code, http.StatusOK)
+	}
+}
+
+func TestDeps_FindSingleflight(t *testing.T) {
+	t.Parallel()
+
+	storage := newFakeStorage()
+	storage.delay = 50 * time.Millisecond
+	storage.records["hot"] = model.ShortenResponse{Alias: "hot", Type: model.TypeLink}
+
+	deps := NewLinkDeps(storage, &fakeUploader{}, newFakeCache())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if out := deps.Find(context.Background(), "hot", FindOptions{}); out.Code != http.StatusOK {
+				t.Errorf("Find() code = %d, want %d", out.Code, http.StatusOK)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&storage.gets); got != 1 {
+		t.Errorf("storage.Get called %d times, want 1", got)
+	}
+}
+
+// memFile is an uploaded multipart file kept in memory
+type memFile struct {
+	*bytes.Reader
+}
+
+func (memFile) Close() error { return nil }
+
+func fileRequest(alias, content string) model.ShortenFileRequest {
+	return model.ShortenFileRequest{
+		Alias:    alias,
+		Type:     model.TypeFile,
+		Filename: "report.pdf",
+		RawFile:  memFile{bytes.NewReader([]byte(content))},
+	}
+}
+
+func TestDeps_InsertFile(t *testing.T) {
+	t.Parallel()
+
+	t.Run("taken alias keeps the file of its owner", func(t *testing.T) {
+		storage := newFakeStorage()
+		storage.records["somefile"] = model.ShortenResponse{Alias: "somefile", Type: model.TypeFile, Filename: "owner.pdf"}
+
+		uploader := &fakeUploader{}
+		deps := NewLinkDeps(storage, uploader, newFakeCache())
+
+		if out := deps.InsertFile(context.Background(), fileRequest("somefile", "content")); out.Code != http.StatusConflict {
+			t.Fatalf("InsertFile() code = %d, want %d", out.Code, http.StatusConflict)
+		}
+
+		if len(uploader.uploaded) != 0 {
+			t.Errorf("uploaded %v over the file of the owner", uploader.uploaded)
+		}
+	})
+
+	t.Run("failed upload releases the alias", func(t *testing.T) {
+		storage := newFakeStorage()
+		uploader := &fakeUploader{
+			uploadErr: helper.E("fakeUploader.Upload", helper.KindUnavailable, errors.New("s3 is down"), "can't upload"),
+		}
+		deps := NewLinkDeps(storage, uploader, newFakeCache())
+
+		if out := deps.InsertFile(context.Background(), fileRequest("somefile", "content")); out.Code != http.StatusServiceUnavailable {
+			t.Fatalf("InsertFile() code = %d, want %d", out.Code, http.StatusServiceUnavailable)
+		}
+
+		if _, ok := storage.records["somefile"]; ok {
+			t.Errorf("the alias of the failed upload is still taken")
+		}
+	})
+
+	t.Run("checksum mismatch rejects the upload", func(t *testing.T) {
+		storage := newFakeStorage()
+		uploader := &fakeUploader{}
+		deps := NewLinkDeps(storage, uploader, newFakeCache())
+
+		req := fileRequest("somefile", "content")
+		req.SHA256 = "0000000000000000000000000000000000000000000000000000000000000000"
+
+		if out := deps.InsertFile(context.Background(), req); out.Code != http.StatusBadRequest {
+			t.Fatalf("InsertFile() code = %d, want %d", out.Code, http.StatusBadRequest)
+		}
+
+		if _, ok := storage.records["somefile"]; ok || len(uploader.uploaded) != 0 {
+			t.Errorf("the corrupted upload was stored")
+		}
+	})
+
+	t.Run("same content is stored once", func(t *testing.T) {
+		storage := newFakeStorage()
+		uploader := &fakeUploader{}
+		deps := NewLinkDeps(storage, uploader, newFakeCache())
+
+		for _, alias := range []string{"firstfile", "secondfile"} {
+			if out := deps.InsertFile(context.Background(), fileRequest(alias, "content")); out.Code != http.StatusOK {
+				t.Fatalf("InsertFile(%s) code = %d", alias, out.Code)
+			}
+		}
+
+		// sha256("content")
+		const blob = "blobs/ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"
+		if len(uploader.uploaded) != 1 || uploader.uploaded[0] != blob {
+			t.Fatalf("uploaded = %v, want only %s", uploader.uploaded, blob)
+		}
+
+		deps.DeleteAlias(context.Background(), "firstfile")
+		if len(uploader.deleted) != 0 {
+			t.Fatalf("deleted %v while secondfile still points at it", uploader.deleted)
+		}
+
+		deps.DeleteAlias(context.Background(), "secondfile")
+
+		// the thumbnails go with their blob
+		want := []string{blob}
+		for _, size := range preview.Sizes {
+			want = append(want, repo.ThumbKey(strings.TrimPrefix(blob, repo.BlobPrefix), size))
+		}
+
+		if !reflect.DeepEqual(uploader.deleted, want) {
+			t.Errorf("deleted = %v, want %v once the last alias is gone", uploader.deleted, want)
+		}
+
+		// the deleted object is still listed by Stat, the new row uploads it anyway
+		if out := deps.InsertFile(context.Background(), fileRequest("thirdfile", "content")); out.Code != http.StatusOK {
+			t.Fatalf("InsertFile(thirdfile) code = %d", out.Code)
+		}
+
+		if len(uploader.uploaded) != 2 {
+			t.Errorf("uploaded = %v, want %s uploaded again", uploader.uploaded, blob)
+		}
+	})
+}
+
+func TestDeps_InsertFiles(t *testing.T) {
+	t.Parallel()
+
+	parts := func(names ...string) []model.FilePart {
+		var parts []model.FilePart
+		for _, name := range names {
+			parts = append(parts, model.FilePart{Filename: name, File: memFile{bytes.NewReader([]byte("content"))}})
+		}
+
+		return parts
+	}
+
+	tests := []struct {
+		name   string
+		parts  []model.FilePart
+		sha256 string
+		want   int
+	}{
+		{name: "files", parts: parts("a.txt", "b.txt"), want: http.StatusOK},
+		{name: "same names", parts: parts("a.txt", "a.txt"), want: http.StatusBadRequest},
+		{name: "checksum of several", parts: parts("a.txt", "b.txt"), sha256: strings.Repeat("0", 64), want: http.StatusBadRequest},
+		{name: "too many", parts: parts(make([]string, MaxFiles+1)...), want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			storage := newFakeStorage()
+			deps := NewLinkDeps(storage, &fakeUploader{content: "content"}, newFakeCache())
+
+			req := fileRequest("bundle", "")
+			req.Parts, req.SHA256 = tt.parts, tt.sha256
+
+			out := deps.InsertFile(context.Background(), req)
+			if out.Code != tt.want {
+				t.Fatalf("InsertFile() code = %d, want %d", out.Code, tt.want)
+			}
+
+			if tt.want != http.StatusOK {
+				return
+			}
+
+			if out.Filename != "bundle.zip" || len(out.Files) != 2 || out.Files[1].Name != "b.txt" || out.Files[1].Size != 7 {
+				t.Errorf("InsertFile() = %+v, want the manifest of bundle.zip", out)
+			}
+		})
+	}
+}
+
+func TestDeps_DownloadFileOfSeveral(t *testing.T) {
+	t.Parallel()
+
+	// sha256("content")
+	const sum = "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"
+
+	storage := newFakeStorage()
+	storage.records["bundle"] = model.ShortenResponse{Alias: "bundle", Type: model.TypeFile, Filename: "bundle.zip", Files: []model.FileEntry{
+		{Name: "a.txt", Size: 7, SHA256: sum},
+		{Name: "b.txt", Size: 7, SHA256: sum},
+	}}
+
+	deps := NewLinkDeps(storage, &fakeUploader{content: "content"}, newFakeCache())
+
+	for _, file := range []string{"1", "b.txt"} {
+		out := deps.DownloadFile(context.Background(), "bundle", DownloadOptions{File: file})
+		if out.Code != http.StatusOK || out.ContentDisposition != `attachment; filename="b.txt"` || out.SHA256 != sum {
+			t.Errorf("DownloadFile(%s) = %d %s, want b.txt", file, out.Code, out.ContentDisposition)
+		}
+	}
+
+	if out := deps.DownloadFile(context.Background(), "bundle", DownloadOptions{File: "c.txt"}); out.Code != http.StatusNotFound {
+		t.Errorf("DownloadFile() of a missing file code = %d, want %d", out.Code, http.StatusNotFound)
+	}
+
+	out := deps.DownloadFile(context.Background(), "bundle", DownloadOptions{})
+	if out.Code != http.StatusOK || out.WriteTo == nil || out.ContentType != "application/zip" {
+		t.Fatalf("DownloadFile() = %+v, want a zip", out)
+	}
+
+	var buf bytes.Buffer
+	if err := out.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader() error = %v", err)
+	}
+
+	for i, name := range []string{"a.txt", "b.txt"} {
+		f, err := archive.File[i].Open()
+		if err != nil {
+			t.Fatalf("Open(%s) error = %v", name, err)
+		}
+
+		content, _ := io.ReadAll(f)
+		if archive.File[i].Name != name || string(content) != "content" {
+			t.Errorf("entry %d = %s %q, want %s", i, archive.File[i].Name, content, name)
+		}
+	}
+}
+
+func TestDeps_DownloadFileVerify(t *testing.T) {
+	t.Parallel()
+
+	// sha256("content")
+	const sum = "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"
+
+	tests := []struct {
+		name    string
+		policy  VerifyPolicy
+		sha256  string
+		content string
+		want    int
+	}{
+		{name: "intact", policy: VerifyEnforce, sha256: sum, content: "content", want: http.StatusOK},
+		{name: "corrupted enforced", policy: VerifyEnforce, sha256: sum, content: "c0ntent", want: http.StatusInternalServerError},
+		{name: "corrupted warned", policy: VerifyWarn, sha256: sum, content: "c0ntent", want: http.StatusOK},
+		{name: "corrupted unchecked", policy: VerifyOff, sha256: sum, content: "c0ntent", want: http.StatusOK},
+		{name: "legacy file", policy: VerifyEnforce, content: "c0ntent", want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			storage := newFakeStorage()
+			storage.records["somefile"] = model.ShortenResponse{Alias: "somefile", Type: model.TypeFile, Filename: "report.pdf", SHA256: tt.sha256}
+
+			deps := NewLinkDeps(storage, &fakeUploader{content: tt.content}, newFakeCache(), WithVerifyPolicy(tt.policy))
+
+			out := deps.DownloadFile(context.Background(), "somefile", DownloadOptions{})
+			if out.Code != tt.want {
+				t.Fatalf("DownloadFile() code = %d, want %d", out.Code, tt.want)
+			}
+
+			if tt.want == http.StatusOK && out.SHA256 != tt.sha256 {
+				t.Errorf("DownloadFile() sha256 = %q, want %q", out.SHA256, tt.sha256)
+			}
+		})
+	}
+}
+
+func TestDeps_EnvelopeEncryption(t *testing.T) {
+	t.Parallel()
+
+	ring, err := kms.NewLocal([]kms.MasterKey{{ID: "master", Key: bytes.Repeat([]byte{1}, kms.DataKeySize)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sha256("content")
+	const blob = "blobs/ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"
+
+	storage := newFakeStorage()
+	uploader := &fakeUploader{content: "content"}
+	deps := NewLinkDeps(storage, uploader, newFakeCache(), WithKeyRing(ring, true))
+
+	if out := deps.InsertFile(context.Background(), fileRequest("somefile", "content")); out.Code != http.StatusOK {
+		t.Fatalf("InsertFile() code = %d", out.Code)
+	}
+
+	dataKey := uploader.customerKeys[blob]
+	if len(dataKey) != kms.DataKeySize {
+		t.Fatalf("uploaded with customer key %x, want a data key", dataKey)
+	}
+
+	wrapped := storage.keys[strings.TrimPrefix(blob, repo.BlobPrefix)]
+	if wrapped.KeyID != "master" || bytes.Contains(wrapped.Wrapped, dataKey) {
+		t.Errorf("stored key = %+v, want the data key wrapped by master", wrapped)
+	}
+
+	if out := deps.DownloadFile(context.Background(), "somefile", DownloadOptions{}); out.Code != http.StatusOK {
+		t.Errorf("DownloadFile() code = %d, want %d", out.Code, http.StatusOK)
+	}
+
+	// without encryption the new files are stored in the clear, the encrypted ones still read
+	plain := NewLinkDeps(storage, uploader, newFakeCache(), WithKeyRing(ring, false))
+
+	if out := plain.InsertFile(context.Background(), fileRequest("otherfile", "other")); out.Code != http.StatusOK {
+		t.Fatalf("InsertFile() code = %d", out.Code)
+	}
+
+	for key, customerKey := range uploader.customerKeys {
+		if key != blob && customerKey != nil {
+			t.Errorf("%s uploaded with a customer key", key)
+		}
+	}
+
+	if out := plain.DownloadFile(context.Background(), "somefile", DownloadOptions{}); out.Code != http.StatusOK {
+		t.Errorf("DownloadFile() of the encrypted file code = %d, want %d", out.Code, http.StatusOK)
+	}
+}
+
+func TestDeps_DeleteAlias(t *testing.T) {
+	t.Parallel()
+
+	storage := newFakeStorage()
+	storage.records["somefile"] = model.ShortenResponse{Alias: "somefile", Type: model.TypeFile, Filename: "report.pdf"}
+
+	cache := newFakeCache()
+	uploader := &fakeUploader{}
+	deps := NewLinkDeps(storage, uploader, cache)
+
+	if out := deps.Find(context.Background(), "somefile", FindOptions{}); out.Code != http.StatusOK {
+		t.Fatalf("Find() code = %d", out.Code)
+	}
+
+	out := deps.DeleteAlias(context.Background(), "somefile")
+	if out.Code != http.StatusOK || out.Type != model.TypeFile {
+		t.Fatalf("DeleteAlias() = %+v", out)
+	}
+
+	if len(uploader.deleted) != 1 || uploader.deleted[0] != "somefile" {
+		t.Errorf("deleted objects = %v, want [somefile]", uploader.deleted)
+	}
+
+	if _, err := cache.Get("somefile"); err == nil {
+		t.Errorf("the alias is still cached")
+	}
+
+	if out := deps.DeleteAlias(context.Background(), "somefile"); out.Code != http.StatusNotFound {
+		t.Errorf("second DeleteAlias() code = %d, want %d", out.Code, http.StatusNotFound)
+	}
+}
+
+func TestDeps_DeleteAliasGone(t *testing.T) {
+	t.Parallel()
+
+	storage := newFakeStorage()
+	deps := NewLinkDeps(storage, &fakeUploader{}, newFakeCache())
+
+	req := model.ShortenRequest{Alias: "blocked", Type: model.TypeLink, RedirectTo: "https://example.com"}
+	if out := deps.InsertLink(context.Background(), req); out.Code != http.StatusOK {
+		t.Fatalf("InsertLink() code = %d", out.Code)
+	}
+
+	req = model.ShortenRequest{Alias: "exhausted", Type: model.TypeLink, RedirectTo: "https://example.com", MaxClicks: 1}
+	if out := deps.InsertLink(context.Background(), req); out.Code != http.StatusOK {
+		t.Fatalf("InsertLink() code = %d", out.Code)
+	}
+
+	storage.blocked["blocked"] = true
+	if out := deps.Find(context.Background(), "exhausted", FindOptions{Resolve: true}); out.Code != http.StatusOK {
+		t.Fatalf("Find() code = %d", out.Code)
+	}
+
+	// the aliases answering gone are the ones a moderator deletes
+	for _, alias := range []string{"blocked", "exhausted"} {
+		if _, err := storage.Get(context.Background(), alias); helper.GetKind(err) != helper.KindGone {
+			t.Fatalf("Get(%s) error = %v, want gone", alias, err)
+		}
+
+		if out := deps.DeleteAlias(context.Background(), alias); out.Code != http.StatusOK || out.Type != model.TypeLink {
+			t.Errorf("DeleteAlias(%s) = %+v", alias, out)
+		}
+
+		if out := deps.InsertLink(context.Background(), model.ShortenRequest{Alias: alias, Type: model.TypeLink, RedirectTo: "https://example.com"}); out.Code != http.StatusOK {
+			t.Errorf("InsertLink(%s) after the delete code = %d, want the alias free", alias, out.Code)
+		}
+	}
+}
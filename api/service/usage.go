@@ -0,0 +1,64 @@
+package service
+
+import (
+	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/api/model"
+	"context"
+	"errors"
+	"github.com/rs/zerolog"
+)
+
+var (
+	ErrNoUsageStorage = errors.New("the storage doesn't count the uses of the aliases")
+	ErrBurnWithLimit  = errors.New("a file burnt after reading is downloaded once, max_downloads can't be more")
+	ErrLimitedFile    = errors.New("the files of an alias with a download limit are only downloaded together")
+)
+
+// UsageStorage is implemented by the storages counting the uses of the aliases with a limit
+type UsageStorage interface {
+	// Consume counts a use of key and returns the uses left, the last one returns the objects to delete
+	Consume(ctx context.Context, key string) (int, []string, error)
+}
+
+// checkLimit refuses a limit when nothing counts the uses against it
+func (d *Deps) checkLimit(limit int) error {
+	const op = helper.Op("checkLimit")
+
+	if limit == 0 {
+		return nil
+	}
+
+	if _, ok := d.storage.(UsageStorage); !ok {
+		return helper.E(op, helper.KindUnexpected, ErrNoUsageStorage, CantProcessRequest)
+	}
+
+	return nil
+}
+
+// consume counts a use of the alias when it has a limit and returns the objects released by the
+// last one, its cache entry is evicted so the next lookups answer gone
+func (d *Deps) consume(ctx context.Context, key string, record model.ShortenResponse) ([]string, error) {
+	const op = helper.Op("consume")
+
+	if record.Limit() == 0 {
+		return nil, nil
+	}
+
+	storage, ok := d.storage.(UsageStorage)
+	if !ok {
+		return nil, helper.E(op, helper.KindUnexpected, ErrNoUsageStorage, CantProcessRequest)
+	}
+
+	left, objects, err := storage.Consume(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if left == 0 {
+		if err := d.cacheDelete(ctx, key); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("alias", key).Msg("cant evict the exhausted alias from cache")
+		}
+	}
+
+	return objects, nil
+}
@@ -0,0 +1,283 @@
+package service
+
+import (
+	"backstreetlinkv2/api/model"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestDeps_DownloadLimits(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		maxDownloads  int
+		burnAfterRead bool
+		wantInsert    int
+		wantCodes     []int
+	}{
+		{name: "unlimited", wantInsert: http.StatusOK, wantCodes: []int{http.StatusOK, http.StatusOK, http.StatusOK}},
+		{name: "burn after read", burnAfterRead: true, wantInsert: http.StatusOK, wantCodes: []int{http.StatusOK, http.StatusGone}},
+		{name: "max downloads", maxDownloads: 2, wantInsert: http.StatusOK, wantCodes: []int{http.StatusOK, http.StatusOK, http.StatusGone}},
+		{name: "burn with max downloads", maxDownloads: 2, burnAfterRead: true, wantInsert: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			cache := newFakeCache()
+			uploader := &fakeUploader{objects: map[string][]byte{}}
+			deps := NewLinkDeps(newFakeStorage(), uploader, cache)
+
+			req := fileRequest("secret", "content")
+			req.MaxDownloads, req.BurnAfterRead = tt.maxDownloads, tt.burnAfterRead
+
+			out := deps.InsertFile(context.Background(), req)
+			if out.Code != tt.wantInsert {
+				t.Fatalf("InsertFile() code = %d, want %d", out.Code, tt.wantInsert)
+			}
+
+			if tt.wantInsert != http.StatusOK {
+				return
+			}
+
+			for i, want := range tt.wantCodes {
+				out := deps.DownloadFile(context.Background(), "secret", DownloadOptions{})
+				if out.Code != want {
+					t.Fatalf("download %d code = %d, want %d", i+1, out.Code, want)
+				}
+
+				if want == http.StatusOK && out.File.(*bytes.Buffer).String() != "content" {
+					t.Errorf("download %d = %q, want content", i+1, out.File)
+				}
+			}
+
+			exhausted := tt.wantCodes[len(tt.wantCodes)-1] == http.StatusGone
+			if deleted := len(uploader.deleted) > 0; deleted != exhausted {
+				t.Errorf("deleted objects = %v, want them deleted %v", uploader.deleted, exhausted)
+			}
+
+			if _, err := cache.Get("secret"); exhausted && err == nil {
+				t.Errorf("the exhausted alias is still cached")
+			}
+
+			if out := deps.Find(context.Background(), "secret", FindOptions{}); exhausted && out.Code != http.StatusGone {
+				t.Errorf("Find() of the exhausted alias code = %d, want %d", out.Code, http.StatusGone)
+			}
+		})
+	}
+}
+
+func TestDeps_MaxClicks(t *testing.T) {
+	t.Parallel()
+
+	deps := NewLinkDeps(newFakeStorage(), &fakeUploader{}, newFakeCache())
+
+	req := model.ShortenRequest{Alias: "oneclick", Type: model.TypeLink, RedirectTo: "https://example.com", MaxClicks: 2}
+	if out := deps.InsertLink(context.Background(), req); out.Code != http.StatusOK || out.MaxClicks != 2 {
+		t.Fatalf("InsertLink() = %+v", out)
+	}
+
+	// looking the link up is not a click, it doesn't give the target away either
+	for i := 0; i < 3; i++ {
+		out := deps.Find(context.Background(), "oneclick", FindOptions{})
+		if out.Code != http.StatusOK || out.Response.RedirectTo != "" || out.Response.MaxClicks != 2 {
+			t.Fatalf("lookup %d = %+v, want the link without its target", i+1, out)
+		}
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusGone, http.StatusGone} {
+		out := deps.Find(context.Background(), "oneclick", FindOptions{Resolve: true})
+		if out.Code != want {
+			t.Errorf("click %d code = %d, want %d", i+1, out.Code, want)
+		}
+
+		if want == http.StatusOK && out.Response.RedirectTo != "https://example.com" {
+			t.Errorf("click %d redirect_to = %q, want the target", i+1, out.Response.RedirectTo)
+		}
+	}
+
+	if out := deps.Find(context.Background(), "oneclick", FindOptions{}); out.Code != http.StatusGone {
+		t.Errorf("lookup of the exhausted link code = %d, want %d", out.Code, http.StatusGone)
+	}
+}
+
+func TestDeps_DownloadLimitOfSeveral(t *testing.T) {
+	t.Parallel()
+
+	uploader := &fakeUploader{objects: map[string][]byte{}}
+	deps := NewLinkDeps(newFakeStorage(), uploader, newFakeCache())
+	insertBundle(t, deps, "bundle")
+
+	if out := deps.Preview(context.Background(), "bundle", PreviewOptions{}); out.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Preview() code = %d, want %d", out.Code, http.StatusUnsupportedMediaType)
+	}
+
+	// a single file would be a use of the limit without the archive
+	if out := deps.DownloadFile(context.Background(), "bundle", DownloadOptions{File: "0"}); out.Code != http.StatusBadRequest {
+		t.Errorf("DownloadFile() of a file code = %d, want %d", out.Code, http.StatusBadRequest)
+	}
+
+	out := deps.DownloadFile(context.Background(), "bundle", DownloadOptions{})
+	if out.Code != http.StatusOK {
+		t.Fatalf("DownloadFile() code = %d", out.Code)
+	}
+
+	// the use is counted before the archive is written, the blobs are deleted after
+	if second := deps.DownloadFile(context.Background(), "bundle", DownloadOptions{}); second.Code != http.StatusGone {
+		t.Errorf("second DownloadFile() code = %d, want %d", second.Code, http.StatusGone)
+	}
+
+	if len(uploader.deleted) != 0 {
+		t.Errorf("deleted objects = %v before the archive is written", uploader.deleted)
+	}
+
+	var buf bytes.Buffer
+	if err := out.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+
+	for _, blob := range uploader.uploaded {
+		if _, ok := uploader.objects[blob]; ok && !contains(uploader.deleted, blob) {
+			t.Errorf("deleted objects = %v, want %s among them", uploader.deleted, blob)
+		}
+	}
+}
+
+func TestDeps_DownloadCutShort(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		alias string
+		// cut serves the first download partly or not at all
+		cut func(t *testing.T, out DownloadFileOutput)
+	}{
+		{
+			name:  "single file never read",
+			alias: "single",
+			cut:   func(t *testing.T, out DownloadFileOutput) {},
+		},
+		{
+			name:  "archive cut short",
+			alias: "bundle",
+			cut: func(t *testing.T, out DownloadFileOutput) {
+				if err := out.WriteTo(failingWriter{}); err == nil {
+					t.Fatal("WriteTo() to a failing writer error = nil")
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			uploader := &fakeUploader{objects: map[string][]byte{}}
+			deps := NewLinkDeps(newFakeStorage(), uploader, newFakeCache())
+
+			if tt.alias == "bundle" {
+				insertBundle(t, deps, tt.alias)
+			} else {
+				req := fileRequest(tt.alias, "content")
+				req.BurnAfterRead = true
+				if out := deps.InsertFile(context.Background(), req); out.Code != http.StatusOK {
+					t.Fatalf("InsertFile() code = %d", out.Code)
+				}
+			}
+
+			out := deps.DownloadFile(context.Background(), tt.alias, DownloadOptions{})
+			if out.Code != http.StatusOK {
+				t.Fatalf("DownloadFile() code = %d", out.Code)
+			}
+
+			tt.cut(t, out)
+
+			// the use was spent when the download started
+			if out := deps.DownloadFile(context.Background(), tt.alias, DownloadOptions{}); out.Code != http.StatusGone {
+				t.Errorf("DownloadFile() after a cut one code = %d, want %d", out.Code, http.StatusGone)
+			}
+
+			// the blobs of an archive cut short are left to the reconciler
+			if tt.alias == "bundle" && len(uploader.deleted) != 0 {
+				t.Errorf("deleted objects = %v after a failed write", uploader.deleted)
+			}
+		})
+	}
+}
+
+func TestDeps_ConcurrentZipDownloads(t *testing.T) {
+	t.Parallel()
+
+	deps := NewLinkDeps(newFakeStorage(), &fakeUploader{objects: map[string][]byte{}}, newFakeCache())
+	insertBundle(t, deps, "bundle")
+
+	outs := make([]DownloadFileOutput, 2)
+
+	// both downloads start before either archive is written
+	var wg sync.WaitGroup
+	for i := range outs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			outs[i] = deps.DownloadFile(context.Background(), "bundle", DownloadOptions{})
+		}(i)
+	}
+	wg.Wait()
+
+	codes := make([]int, len(outs))
+	for i, out := range outs {
+		codes[i] = out.Code
+		if out.Code == http.StatusOK {
+			if err := out.WriteTo(io.Discard); err != nil {
+				t.Errorf("WriteTo() error = %v", err)
+			}
+		}
+	}
+
+	sort.Ints(codes)
+	if codes[0] != http.StatusOK || codes[1] != http.StatusGone {
+		t.Errorf("codes = %v, want one download and one gone", codes)
+	}
+}
+
+// insertBundle inserts a burn after read alias sharing two files
+func insertBundle(t *testing.T, deps *Deps, alias string) {
+	t.Helper()
+
+	req := fileRequest(alias, "")
+	req.BurnAfterRead = true
+	req.Parts = []model.FilePart{
+		{Filename: "a.txt", File: memFile{bytes.NewReader([]byte("a"))}},
+		{Filename: "b.txt", File: memFile{bytes.NewReader([]byte("b"))}},
+	}
+
+	if out := deps.InsertFile(context.Background(), req); out.Code != http.StatusOK || !out.BurnAfterRead {
+		t.Fatalf("InsertFile() = %+v", out)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func contains(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
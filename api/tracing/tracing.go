@@ -0,0 +1,154 @@
+package tracing
+
+import (
+	"backstreetlinkv2/api/helper"
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"os"
+	"strings"
+)
+
+const tracerName = "backstreetlinkv2"
+
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+type Config struct {
+	// Exporter is one of ExporterNone, ExporterStdout or ExporterOTLP
+	Exporter    string
+	ServiceName string
+
+	// Endpoint is the host:port of the OTLP/HTTP collector,
+	// empty means the OTEL_EXPORTER_OTLP_* variables are used
+	Endpoint string
+	Insecure bool
+
+	// SampleRatio is the fraction of new traces that are recorded, zero records all of them
+	SampleRatio float64
+}
+
+// Setup installs the global tracer provider and the W3C propagators.
+// The returned func flushes the pending spans and must be called on shutdown.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch cfg.Exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+
+	case ExporterOTLP:
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+
+		exporter, err = otlptracehttp.New(ctx, opts...)
+
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = tracerName
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceNameKey.String(serviceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	sampler := sdktrace.AlwaysSample()
+	if cfg.SampleRatio > 0 && cfg.SampleRatio < 1 {
+		sampler = sdktrace.TraceIDRatioBased(cfg.SampleRatio)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+	)
+
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// RecordError attaches the error to the span, the op chain of a helper.Error
+// is added as an event so the path through the layers shows up in the trace
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+
+	kind := helper.GetKind(err)
+
+	if ops := helper.Ops(err); len(ops) > 0 {
+		var causes []string
+		for _, cause := range helper.TraceErr(err) {
+			if cause != nil {
+				causes = append(causes, cause.Error())
+			}
+		}
+
+		span.AddEvent("helper.error", trace.WithAttributes(
+			attribute.String("error.ops", strings.Join(ops, " - ")),
+			attribute.Int("error.kind", kind),
+			attribute.String("error.message", err.Error()),
+			attribute.StringSlice("error.causes", causes),
+		))
+	}
+
+	span.RecordError(err)
+
+	if kind >= 500 {
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// End records err, if any, and ends the span
+func End(span trace.Span, err error) {
+	RecordError(span, err)
+	span.End()
+}
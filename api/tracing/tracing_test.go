@@ -0,0 +1,50 @@
+package tracing
+
+import (
+	"backstreetlinkv2/api/helper"
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestEnd(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	root := errors.New("connection refused")
+	err := helper.E("Find", helper.KindUnexpected, helper.E("repo.MYSQLRepo.Get", helper.KindUnexpected, root, "can't process your request"), "can't process your request")
+
+	_, span := provider.Tracer("test").Start(context.Background(), "service.Find")
+	End(span, err)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+
+	if spans[0].Status().Code != codes.Error {
+		t.Errorf("status = %v, want %v", spans[0].Status().Code, codes.Error)
+	}
+
+	var found bool
+	for _, event := range spans[0].Events() {
+		if event.Name != "helper.error" {
+			continue
+		}
+
+		found = true
+		for _, attr := range event.Attributes {
+			if attr.Key == "error.ops" && attr.Value.AsString() != "Find - repo.MYSQLRepo.Get" {
+				t.Errorf("error.ops = %s", attr.Value.AsString())
+			}
+		}
+	}
+
+	if !found {
+		t.Errorf("helper.error event not recorded")
+	}
+}
@@ -0,0 +1,555 @@
+// Package client calls the backstreet.link api.
+//
+// The calls are retried with an exponential backoff when the api answers 429 or 5xx,
+// or can't be reached, honouring the Retry-After header. A POST may have been stored before
+// its response was lost, it is only retried on 429 and 503 or when it wasn't sent at all. The errors answered by the
+// api are returned as *Error, which matches the Err* kinds with errors.Is.
+package client
+
+import (
+	"backstreetlinkv2/api/model"
+	"backstreetlinkv2/api/service"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultRetries    = 3
+	defaultMinBackoff = 200 * time.Millisecond
+	defaultMaxBackoff = 10 * time.Second
+)
+
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	adminKey   string
+
+	retries    int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+type Option func(c *Client)
+
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithRetries sets how many times a failed call is tried again, 0 disables the retries
+func WithRetries(retries int) Option {
+	return func(c *Client) {
+		c.retries = retries
+	}
+}
+
+// WithBackoff bounds the wait between two tries, a Retry-After answered by the api is not capped
+func WithBackoff(min, max time.Duration) Option {
+	return func(c *Client) {
+		c.minBackoff = min
+		c.maxBackoff = max
+	}
+}
+
+// WithAdminKey authenticates the calls to the admin routes
+func WithAdminKey(key string) Option {
+	return func(c *Client) {
+		c.adminKey = key
+	}
+}
+
+// New returns a client of the api served at baseURL, e.g. https://backstreet.link
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("client: invalid base url: %w", err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("client: base url %q must be http or https", baseURL)
+	}
+
+	c := &Client{
+		baseURL:    u,
+		httpClient: &http.Client{Timeout: 5 * time.Minute},
+		retries:    defaultRetries,
+		minBackoff: defaultMinBackoff,
+		maxBackoff: defaultMaxBackoff,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c, nil
+}
+
+// CreateLink shortens req.RedirectTo under req.Alias
+func (c *Client) CreateLink(ctx context.Context, req model.ShortenRequest) (service.InsertLinkOutput, error) {
+	var out service.InsertLinkOutput
+
+	if req.Type == "" {
+		req.Type = model.TypeLink
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return out, err
+	}
+
+	err = c.doJSON(ctx, http.MethodPost, "/api/v2/link", func() (io.Reader, string, error) {
+		return bytes.NewReader(body), "application/json", nil
+	}, &out)
+
+	return out, err
+}
+
+// CreateFile uploads file under req.Alias. The file is streamed, it is only sent again
+// on a retry when it is an io.Seeker. The sha256 of an io.ReadSeeker is computed when
+// req.SHA256 is empty, the api rejects a file corrupted on the way. The encrypted files
+// are left alone, their chunks are authenticated.
+func (c *Client) CreateFile(ctx context.Context, req model.ShortenFileRequest, file io.Reader) (service.InsertFileOutput, error) {
+	var out service.InsertFileOutput
+
+	if req.Type == "" {
+		req.Type = model.TypeFile
+	}
+
+	if rs, ok := file.(io.ReadSeeker); ok && req.SHA256 == "" && req.Encryption == nil {
+		sum, err := hashSeeker(rs)
+		if err != nil {
+			return out, fmt.Errorf("client: can't hash the file: %w", err)
+		}
+
+		req.SHA256 = sum
+	}
+
+	fields, err := json.Marshal(req)
+	if err != nil {
+		return out, err
+	}
+
+	seeker, replayable := file.(io.Seeker)
+	sent := false
+
+	body := func() (io.Reader, string, error) {
+		if sent {
+			if !replayable {
+				return nil, "", errNotReplayable
+			}
+
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return nil, "", err
+			}
+		}
+		sent = true
+
+		return multipartBody(fields, []File{{Name: req.Filename, Content: file}})
+	}
+
+	err = c.doJSON(ctx, http.MethodPost, "/api/v2/file", body, &out)
+	return out, err
+}
+
+// File is one of the files shared by CreateFiles
+type File struct {
+	Name    string
+	Content io.Reader
+}
+
+// CreateFiles shares the files under one alias, they are downloaded one by one or as a zip.
+// The request is retried only when every file is an io.Seeker.
+func (c *Client) CreateFiles(ctx context.Context, req model.ShortenFileRequest, files []File) (service.InsertFileOutput, error) {
+	var out service.InsertFileOutput
+
+	if req.Type == "" {
+		req.Type = model.TypeFile
+	}
+
+	if len(files) == 0 {
+		return out, errors.New("client: no file to upload")
+	}
+
+	req.Filename = files[0].Name
+
+	fields, err := json.Marshal(req)
+	if err != nil {
+		return out, err
+	}
+
+	sent := false
+
+	body := func() (io.Reader, string, error) {
+		if sent {
+			for _, file := range files {
+				seeker, ok := file.Content.(io.Seeker)
+				if !ok {
+					return nil, "", errNotReplayable
+				}
+
+				if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+					return nil, "", err
+				}
+			}
+		}
+		sent = true
+
+		return multipartBody(fields, files)
+	}
+
+	err = c.doJSON(ctx, http.MethodPost, "/api/v2/file", body, &out)
+	return out, err
+}
+
+func hashSeeker(rs io.ReadSeeker) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, rs); err != nil {
+		return "", err
+	}
+
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// multipartBody streams the form expected by the api through a pipe
+func multipartBody(fields []byte, files []File) (io.Reader, string, error) {
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+
+	go func() {
+		err := form.WriteField("json_field", string(fields))
+
+		for _, file := range files {
+			if err != nil {
+				break
+			}
+
+			var part io.Writer
+			part, err = form.CreateFormFile("file_field", file.Name)
+			if err == nil {
+				_, err = io.Copy(part, file.Content)
+			}
+		}
+
+		if err == nil {
+			err = form.Close()
+		}
+
+		pw.CloseWithError(err)
+	}()
+
+	return pr, form.FormDataContentType(), nil
+}
+
+// Find looks alias up without resolving it, a click of a link with max_clicks is not counted
+// and its redirect_to is left empty
+func (c *Client) Find(ctx context.Context, alias string) (service.FindOutput, error) {
+	var out service.FindOutput
+
+	err := c.doJSON(ctx, http.MethodGet, "/api/v2/find/"+url.PathEscape(alias), nil, &out)
+	return out, err
+}
+
+// Resolve looks alias up to follow it, it counts a click of a link with max_clicks
+func (c *Client) Resolve(ctx context.Context, alias string) (service.FindOutput, error) {
+	var out service.FindOutput
+
+	err := c.doJSON(ctx, http.MethodGet, "/api/v2/find/"+url.PathEscape(alias)+"?resolve=true", nil, &out)
+	return out, err
+}
+
+// FileInfo describes a downloaded file
+type FileInfo struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256,omitempty"`
+}
+
+// DownloadFile streams the file of alias to w, a failure once the copy started is not retried.
+// The file is checked against the Digest header when the api sends one. An alias sharing
+// several files is downloaded as a zip.
+func (c *Client) DownloadFile(ctx context.Context, alias string, w io.Writer) (FileInfo, error) {
+	return c.DownloadEntry(ctx, alias, "", w)
+}
+
+// DownloadEntry streams one of the files of alias to w, file is its index or its name
+func (c *Client) DownloadEntry(ctx context.Context, alias, file string, w io.Writer) (FileInfo, error) {
+	var info FileInfo
+
+	path := "/api/v2/download-file/" + url.PathEscape(alias)
+	if file != "" {
+		path += "?file=" + url.QueryEscape(file)
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+
+	info.ContentType = resp.Header.Get("Content-Type")
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		info.Filename = params["filename"]
+	}
+
+	hash := sha256.New()
+
+	info.Size, err = io.Copy(io.MultiWriter(w, hash), resp.Body)
+	if err != nil {
+		return info, fmt.Errorf("client: download of %s interrupted: %w", alias, err)
+	}
+
+	want, ok := digest(resp.Header.Get("Digest"))
+	if !ok {
+		return info, nil
+	}
+
+	info.SHA256 = hex.EncodeToString(want)
+	if !bytes.Equal(hash.Sum(nil), want) {
+		return info, fmt.Errorf("%w: %s", ErrChecksumMismatch, alias)
+	}
+
+	return info, nil
+}
+
+// Preview streams a thumbnail of the image of alias to w, fitting in size x size,
+// file picks one of the files of an alias sharing several. Zero values use the defaults.
+func (c *Client) Preview(ctx context.Context, alias, file string, size int, w io.Writer) (FileInfo, error) {
+	var info FileInfo
+
+	query := url.Values{}
+	if file != "" {
+		query.Set("file", file)
+	}
+	if size != 0 {
+		query.Set("size", strconv.Itoa(size))
+	}
+
+	path := "/api/v2/preview/" + url.PathEscape(alias)
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+
+	info.ContentType = resp.Header.Get("Content-Type")
+
+	info.Size, err = io.Copy(w, resp.Body)
+	if err != nil {
+		return info, fmt.Errorf("client: preview of %s interrupted: %w", alias, err)
+	}
+
+	return info, nil
+}
+
+// digest returns the sha-256 of a Digest header, the other algorithms are ignored
+func digest(header string) ([]byte, bool) {
+	for _, value := range strings.Split(header, ",") {
+		algorithm, encoded, ok := strings.Cut(strings.TrimSpace(value), "=")
+		if !ok || !strings.EqualFold(algorithm, "sha-256") {
+			continue
+		}
+
+		sum, err := base64.StdEncoding.DecodeString(encoded)
+		if err == nil && len(sum) == sha256.Size {
+			return sum, true
+		}
+	}
+
+	return nil, false
+}
+
+// DeleteAlias removes the alias and its file, it needs the admin key
+func (c *Client) DeleteAlias(ctx context.Context, alias string) (service.DeleteAliasOutput, error) {
+	var out service.DeleteAliasOutput
+
+	err := c.doJSON(ctx, http.MethodDelete, "/api/v2/admin/alias/"+url.PathEscape(alias), nil, &out)
+	return out, err
+}
+
+// CacheStats returns the counters of the cache, it needs the admin key
+func (c *Client) CacheStats(ctx context.Context) (service.CacheStatsOutput, error) {
+	var out service.CacheStatsOutput
+
+	err := c.doJSON(ctx, http.MethodGet, "/api/v2/admin/cache/stats", nil, &out)
+	return out, err
+}
+
+// bodyFunc returns the body of a try and its content type, it is called again on every retry
+type bodyFunc func() (io.Reader, string, error)
+
+func (c *Client) doJSON(ctx context.Context, method, path string, body bodyFunc, out any) error {
+	resp, err := c.do(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("client: can't decode the response of %s %s: %w", method, path, err)
+	}
+
+	return nil
+}
+
+// do sends the request until it succeeds, fails for good or runs out of retries.
+// The returned response is always a 2xx, its body must be closed.
+func (c *Client) do(ctx context.Context, method, path string, body bodyFunc) (*http.Response, error) {
+	var lastErr error
+
+	for attempt := 0; ; attempt++ {
+		var sent int32
+		resp, err := c.try(ctx, method, path, body, &sent)
+
+		var wait time.Duration
+		switch {
+		case err == errNotReplayable:
+			return nil, lastErr
+
+		case err != nil:
+			if ctx.Err() != nil {
+				return nil, err
+			}
+
+			// the api may have stored what it received
+			if method == http.MethodPost && atomic.LoadInt32(&sent) == 1 {
+				return nil, err
+			}
+
+		case resp.StatusCode < 400:
+			return resp, nil
+
+		default:
+			apiErr := decodeError(resp)
+			resp.Body.Close()
+
+			if !retryable(method, resp.StatusCode) {
+				return nil, apiErr
+			}
+
+			wait = retryAfter(resp.Header.Get("Retry-After"), time.Now())
+			err = apiErr
+		}
+
+		if attempt >= c.retries {
+			return nil, err
+		}
+		lastErr = err
+
+		if wait <= 0 {
+			wait = c.backoff(attempt)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+	}
+}
+
+// try sends the request once, sent is set once the request is written
+func (c *Client) try(ctx context.Context, method, path string, body bodyFunc, sent *int32) (*http.Response, error) {
+	var reader io.Reader
+	var contentType string
+
+	if body != nil {
+		var err error
+		if reader, contentType, err = body(); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) { atomic.StoreInt32(sent, 1) },
+	})
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL.String()+path, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	req.Header.Set("Accept", "application/json, application/problem+json")
+
+	if c.adminKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.adminKey)
+	}
+
+	return c.httpClient.Do(req)
+}
+
+// retryable tells whether a status is worth another try, the api refused a POST answered 429 or
+// 503 while a proxy may answer a 502 or a 504 for one it stored
+func retryable(method string, status int) bool {
+	switch {
+	case status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable:
+		return true
+	case method == http.MethodPost:
+		return false
+	}
+
+	return status >= 500
+}
+
+// backoff is an exponential backoff with full jitter
+func (c *Client) backoff(attempt int) time.Duration {
+	max := c.minBackoff << attempt
+	if max <= 0 || max > c.maxBackoff {
+		max = c.maxBackoff
+	}
+
+	if max <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(max)) + 1)
+}
+
+// retryAfter reads the header as seconds or as an http date, 0 when it is missing or invalid
+func retryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(header); err == nil {
+		return date.Sub(now)
+	}
+
+	return 0
+}
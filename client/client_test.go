@@ -0,0 +1,533 @@
+package client
+
+import (
+	"archive/zip"
+	"backstreetlinkv2/api"
+	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/api/model"
+	"backstreetlinkv2/api/repo"
+	"backstreetlinkv2/api/service"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testAdminKey = "admin-key"
+
+type memStorage struct {
+	mu      sync.Mutex
+	records map[string][]byte
+	blobs   map[string][]string
+}
+
+func (m *memStorage) Insert(ctx context.Context, key string, data any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.records[key]; ok {
+		return helper.E("memStorage.Insert", helper.KindConflict, repo.ErrUnique, repo.ErrUnique.Error())
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	m.records[key] = raw
+	return nil
+}
+
+func (m *memStorage) InsertFile(ctx context.Context, key string, attrs model.ShortenResponse, blobs []model.Blob) ([]bool, error) {
+	if err := m.Insert(ctx, key, attrs); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	created := make([]bool, len(blobs))
+	for i, blob := range blobs {
+		created[i] = true
+		for _, hashes := range m.blobs {
+			for _, hash := range hashes {
+				created[i] = created[i] && hash != blob.SHA256
+			}
+		}
+
+		m.blobs[key] = append(m.blobs[key], blob.SHA256)
+	}
+
+	return created, nil
+}
+
+func (m *memStorage) Get(ctx context.Context, key string) (model.ShortenResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var resp model.ShortenResponse
+
+	raw, ok := m.records[key]
+	if !ok {
+		return resp, helper.E("memStorage.Get", helper.KindNotFound, repo.ErrNotFound, repo.ErrNotFound.Error())
+	}
+
+	err := resp.Scan(raw)
+	if hashes := m.blobs[key]; len(hashes) == 1 {
+		resp.SHA256 = hashes[0]
+	}
+
+	return resp, err
+}
+
+func (m *memStorage) Delete(ctx context.Context, key string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.records[key]; !ok {
+		return nil, helper.E("memStorage.Delete", helper.KindNotFound, repo.ErrNotFound, repo.ErrNotFound.Error())
+	}
+
+	hashes := m.blobs[key]
+	delete(m.records, key)
+	delete(m.blobs, key)
+
+	shared := map[string]bool{}
+	for _, others := range m.blobs {
+		for _, other := range others {
+			shared[other] = true
+		}
+	}
+
+	var objects []string
+	for _, hash := range hashes {
+		if !shared[hash] {
+			objects = append(objects, repo.BlobPrefix+hash)
+		}
+	}
+
+	return objects, nil
+}
+
+type memUploader struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func (m *memUploader) Upload(ctx context.Context, filename string, file io.ReadCloser, _ repo.PutOptions) error {
+	raw, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.files[filename] = raw
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *memUploader) Get(ctx context.Context, filename string, w io.Writer, _ []byte) (repo.FileStat, error) {
+	m.mu.Lock()
+	raw, ok := m.files[filename]
+	m.mu.Unlock()
+
+	if !ok {
+		return repo.FileStat{}, helper.E("memUploader.Get", helper.KindNotFound, repo.ErrObjectNotFound, "not found")
+	}
+
+	n, err := w.Write(raw)
+	return repo.FileStat{ContentType: "text/plain", ContentLength: int64(n)}, err
+}
+
+func (m *memUploader) Stat(ctx context.Context, filename string) (repo.ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	raw, ok := m.files[filename]
+	if !ok {
+		return repo.ObjectInfo{}, helper.E("memUploader.Stat", helper.KindNotFound, repo.ErrObjectNotFound, "not found")
+	}
+
+	return repo.ObjectInfo{Key: filename, Size: int64(len(raw))}, nil
+}
+
+func (m *memUploader) Delete(ctx context.Context, filename string) error {
+	m.mu.Lock()
+	delete(m.files, filename)
+	m.mu.Unlock()
+
+	return nil
+}
+
+// newTestServer serves the real router, wrap lets a test put a handler in front of it
+func newTestServer(t *testing.T, wrap func(http.Handler) http.Handler, opts ...Option) *Client {
+	t.Helper()
+
+	cache, err := repo.NewCache(context.Background(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc := service.NewLinkDeps(
+		&memStorage{records: map[string][]byte{}, blobs: map[string][]string{}},
+		&memUploader{files: map[string][]byte{}},
+		cache,
+	)
+
+	var handler http.Handler = api.NewRouter(svc, api.RouterConfig{Limits: api.NewLimits(1 << 20), AdminAPIKey: testAdminKey})
+	if wrap != nil {
+		handler = wrap(handler)
+	}
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	c, err := New(server.URL, append([]Option{WithBackoff(time.Millisecond, 10*time.Millisecond)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestClient_Link(t *testing.T) {
+	c := newTestServer(t, nil)
+	ctx := context.Background()
+
+	out, err := c.CreateLink(ctx, model.ShortenRequest{Alias: "testing", RedirectTo: "https://google.com"})
+	if err != nil {
+		t.Fatalf("CreateLink() error = %v", err)
+	}
+
+	if out.Alias != "testing" || out.Type != model.TypeLink {
+		t.Errorf("CreateLink() = %+v", out)
+	}
+
+	found, err := c.Find(ctx, "testing")
+	if err != nil {
+		t.Fatalf("Find() error = %v", err)
+	}
+
+	if found.Response.RedirectTo != "https://google.com" {
+		t.Errorf("Find() = %+v", found)
+	}
+
+	_, err = c.CreateLink(ctx, model.ShortenRequest{Alias: "testing", RedirectTo: "https://example.com"})
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("CreateLink() of a taken alias error = %v, want ErrConflict", err)
+	}
+
+	_, err = c.Find(ctx, "missing1")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Find() of a missing alias error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestClient_Admin(t *testing.T) {
+	ctx := context.Background()
+
+	anonymous := newTestServer(t, nil)
+	if _, err := anonymous.CacheStats(ctx); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("CacheStats() without key error = %v, want ErrUnauthorized", err)
+	}
+
+	c := newTestServer(t, nil, WithAdminKey(testAdminKey))
+
+	if _, err := c.CreateLink(ctx, model.ShortenRequest{Alias: "deleteme", RedirectTo: "https://google.com"}); err != nil {
+		t.Fatalf("CreateLink() error = %v", err)
+	}
+
+	if _, err := c.DeleteAlias(ctx, "deleteme"); err != nil {
+		t.Fatalf("DeleteAlias() error = %v", err)
+	}
+
+	if _, err := c.Find(ctx, "deleteme"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Find() after DeleteAlias() error = %v, want ErrNotFound", err)
+	}
+
+	if _, err := c.CacheStats(ctx); err != nil {
+		t.Errorf("CacheStats() error = %v", err)
+	}
+}
+
+func TestClient_ValidationError(t *testing.T) {
+	c := newTestServer(t, nil)
+
+	_, err := c.CreateLink(context.Background(), model.ShortenRequest{Alias: "abc", RedirectTo: "https://google.com"})
+
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("CreateLink() error = %v, want a bad request *Error", err)
+	}
+
+	if apiErr.Code != helper.CodeValidation || len(apiErr.Fields) != 1 || apiErr.Fields[0].Field != "alias" {
+		t.Errorf("error = %+v, want a validation error on alias", apiErr)
+	}
+}
+
+func TestClient_File(t *testing.T) {
+	c := newTestServer(t, nil)
+	ctx := context.Background()
+
+	content := strings.Repeat("backstreet ", 10_000)
+
+	// a plain reader is streamed and can't be replayed
+	file := io.MultiReader(strings.NewReader(content))
+
+	_, err := c.CreateFile(ctx, model.ShortenFileRequest{Alias: "myreport", Filename: "report.txt"}, file)
+	if err != nil {
+		t.Fatalf("CreateFile() error = %v", err)
+	}
+
+	var buf bytes.Buffer
+	info, err := c.DownloadFile(ctx, "myreport", &buf)
+	if err != nil {
+		t.Fatalf("DownloadFile() error = %v", err)
+	}
+
+	if buf.String() != content || info.Filename != "report.txt" || info.Size != int64(len(content)) {
+		t.Errorf("DownloadFile() = %+v, %d bytes", info, buf.Len())
+	}
+}
+
+func TestClient_Files(t *testing.T) {
+	c := newTestServer(t, nil)
+	ctx := context.Background()
+
+	files := []File{
+		{Name: "a.txt", Content: strings.NewReader("first file")},
+		{Name: "b.txt", Content: strings.NewReader(strings.Repeat("second ", 1000))},
+	}
+
+	out, err := c.CreateFiles(ctx, model.ShortenFileRequest{Alias: "mybundle"}, files)
+	if err != nil || out.Filename != "mybundle.zip" || len(out.Files) != 2 {
+		t.Fatalf("CreateFiles() = %+v, %v", out, err)
+	}
+
+	var buf bytes.Buffer
+	info, err := c.DownloadEntry(ctx, "mybundle", "b.txt", &buf)
+	if err != nil || info.Filename != "b.txt" || buf.String() != strings.Repeat("second ", 1000) {
+		t.Fatalf("DownloadEntry() = %+v, %v, %d bytes", info, err, buf.Len())
+	}
+
+	buf.Reset()
+	if info, err = c.DownloadFile(ctx, "mybundle", &buf); err != nil || info.ContentType != "application/zip" {
+		t.Fatalf("DownloadFile() = %+v, %v, want a zip", info, err)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil || len(archive.File) != 2 || archive.File[0].Name != "a.txt" {
+		t.Fatalf("zip.NewReader() = %v, want a.txt and b.txt", err)
+	}
+
+	if _, err := c.DownloadEntry(ctx, "mybundle", "c.txt", io.Discard); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DownloadEntry() of a missing file error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestClient_Preview(t *testing.T) {
+	c := newTestServer(t, nil)
+	ctx := context.Background()
+
+	var picture bytes.Buffer
+	if err := png.Encode(&picture, image.NewGray(image.Rect(0, 0, 600, 300))); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.CreateFile(ctx, model.ShortenFileRequest{Alias: "picture", Filename: "picture.png"}, bytes.NewReader(picture.Bytes())); err != nil {
+		t.Fatalf("CreateFile() error = %v", err)
+	}
+
+	found, err := c.Find(ctx, "picture")
+	if err != nil || found.Response.Image == nil || found.Response.Image.Width != 600 {
+		t.Fatalf("Find() = %+v, %v, want the dimensions", found.Response, err)
+	}
+
+	var thumb bytes.Buffer
+	info, err := c.Preview(ctx, "picture", "", 128, &thumb)
+	if err != nil || info.ContentType != "image/png" {
+		t.Fatalf("Preview() = %+v, %v", info, err)
+	}
+
+	if config, err := png.DecodeConfig(&thumb); err != nil || config.Width != 128 || config.Height != 64 {
+		t.Errorf("thumbnail is %dx%d, %v, want 128x64", config.Width, config.Height, err)
+	}
+
+	if _, err := c.Preview(ctx, "picture", "", 100, io.Discard); !errors.Is(err, ErrBadRequest) {
+		t.Errorf("Preview() of a size not offered error = %v, want ErrBadRequest", err)
+	}
+}
+
+// corruptWriter flips the first byte of the body
+type corruptWriter struct {
+	http.ResponseWriter
+	done bool
+}
+
+func (w *corruptWriter) Write(p []byte) (int, error) {
+	if !w.done && len(p) > 0 {
+		w.done = true
+		p = append([]byte{p[0] ^ 0xff}, p[1:]...)
+	}
+
+	return w.ResponseWriter.Write(p)
+}
+
+func TestClient_FileChecksum(t *testing.T) {
+	corrupt := false
+	c := newTestServer(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if corrupt {
+				w = &corruptWriter{ResponseWriter: w}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	})
+	ctx := context.Background()
+
+	// sha256("content")
+	const sum = "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"
+
+	_, err := c.CreateFile(ctx, model.ShortenFileRequest{Alias: "badsum", Filename: "a.txt", SHA256: strings.Repeat("0", 64)}, strings.NewReader("content"))
+	if !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("CreateFile() with a wrong sha256 error = %v, want ErrBadRequest", err)
+	}
+
+	out, err := c.CreateFile(ctx, model.ShortenFileRequest{Alias: "goodsum", Filename: "a.txt"}, strings.NewReader("content"))
+	if err != nil || out.SHA256 != sum {
+		t.Fatalf("CreateFile() = %+v, %v, want sha256 %s", out, err, sum)
+	}
+
+	info, err := c.DownloadFile(ctx, "goodsum", io.Discard)
+	if err != nil || info.SHA256 != sum {
+		t.Fatalf("DownloadFile() = %+v, %v, want sha256 %s", info, err, sum)
+	}
+
+	corrupt = true
+	if _, err := c.DownloadFile(ctx, "goodsum", io.Discard); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("DownloadFile() of a corrupted body error = %v, want ErrChecksumMismatch", err)
+	}
+}
+
+func TestClient_Retry(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		failures   int32
+		wantErr    error
+		wantTries  int32
+	}{
+		{name: "rate limited then ok", status: http.StatusTooManyRequests, retryAfter: "0", failures: 2, wantTries: 3},
+		{name: "unavailable then ok", status: http.StatusServiceUnavailable, failures: 1, wantTries: 2},
+		{name: "gives up", status: http.StatusServiceUnavailable, failures: 10, wantErr: ErrUnavailable, wantTries: defaultRetries + 1},
+		{name: "not retried", status: http.StatusNotFound, failures: 10, wantErr: ErrNotFound, wantTries: 1},
+		{name: "post not retried on a bad gateway", status: http.StatusBadGateway, failures: 10, wantErr: ErrUnexpected, wantTries: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tries int32
+
+			c := newTestServer(t, func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if atomic.AddInt32(&tries, 1) <= tt.failures {
+						if tt.retryAfter != "" {
+							w.Header().Set("Retry-After", tt.retryAfter)
+						}
+						helper.WriteProblem(w, r, helper.NewProblem(tt.status, "", "try again"))
+						return
+					}
+
+					next.ServeHTTP(w, r)
+				})
+			})
+
+			_, err := c.CreateLink(context.Background(), model.ShortenRequest{Alias: "retried", RedirectTo: "https://google.com"})
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("CreateLink() error = %v", err)
+			}
+
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CreateLink() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if got := atomic.LoadInt32(&tries); got != tt.wantTries {
+				t.Errorf("tries = %d, want %d", got, tt.wantTries)
+			}
+		})
+	}
+}
+
+func TestClient_LostResponse(t *testing.T) {
+	var tries int32
+
+	// the link is stored but a proxy answers 502 in place of the api
+	c := newTestServer(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost {
+				stored := httptest.NewRecorder()
+				next.ServeHTTP(stored, r)
+				if stored.Code != http.StatusOK {
+					t.Errorf("POST %s = %d, %s", r.URL.Path, stored.Code, stored.Body)
+				}
+			}
+
+			if r.Method == http.MethodPost || atomic.AddInt32(&tries, 1) == 1 {
+				helper.WriteProblem(w, r, helper.NewProblem(http.StatusBadGateway, "", "bad gateway"))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	ctx := context.Background()
+
+	_, err := c.CreateLink(ctx, model.ShortenRequest{Alias: "lostresponse", RedirectTo: "https://google.com"})
+	if !errors.Is(err, ErrUnexpected) {
+		t.Fatalf("CreateLink() error = %v, want the bad gateway rather than a conflict of its retry", err)
+	}
+
+	// a GET is retried, the link is there
+	found, err := c.Find(ctx, "lostresponse")
+	if err != nil || found.Response.RedirectTo != "https://google.com" {
+		t.Fatalf("Find() = %+v, %v", found, err)
+	}
+
+	if got := atomic.LoadInt32(&tries); got != 2 {
+		t.Errorf("tries of the GET = %d, want 2", got)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"3", 3 * time.Second},
+		{"soon", 0},
+		{now.Add(5 * time.Second).Format(http.TimeFormat), 5 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := retryAfter(tt.header, now); got != tt.want {
+			t.Errorf("retryAfter(%q) = %s, want %s", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package client
+
+import (
+	"backstreetlinkv2/api/model"
+	"backstreetlinkv2/api/service"
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+const (
+	// KeySize is the size of the AES-256 keys of the encrypted files
+	KeySize = 32
+
+	DefaultChunkSize = 64 << 10
+)
+
+// ErrDecrypt is returned when a file doesn't decrypt, the key is wrong or the ciphertext was altered
+var ErrDecrypt = errors.New("client: the file can't be decrypted, wrong key or altered file")
+
+// NewKey returns a random key for CreateEncryptedFile
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// ShareLink returns the link of alias with key in its fragment, the browsers don't send the fragment to the server
+func (c *Client) ShareLink(alias string, key []byte) string {
+	link := c.baseURL.String() + "/" + url.PathEscape(alias)
+	if len(key) > 0 {
+		link += "#" + base64.RawURLEncoding.EncodeToString(key)
+	}
+
+	return link
+}
+
+// ParseShareLink reads the alias and the key of a link made by ShareLink, the link may be
+// alias#key without the url, a plain alias has no key
+func ParseShareLink(link string) (string, []byte, error) {
+	link, fragment, _ := strings.Cut(link, "#")
+
+	alias := link
+	if i := strings.LastIndex(link, "/"); i >= 0 {
+		alias = link[i+1:]
+	}
+
+	alias, err := url.PathUnescape(alias)
+	if err != nil || alias == "" {
+		return "", nil, fmt.Errorf("client: no alias in %q", link)
+	}
+
+	if fragment == "" {
+		return alias, nil, nil
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(fragment)
+	if err != nil || len(key) != KeySize {
+		return "", nil, fmt.Errorf("client: the link of %s has an invalid key", alias)
+	}
+
+	return alias, key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("client: invalid key: %w", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce is the nonce of the chunk index, the base nonce xor the index
+func chunkNonce(nonce []byte, index uint64) []byte {
+	out := make([]byte, len(nonce))
+	copy(out, nonce)
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], index)
+
+	for i, b := range counter {
+		out[len(out)-8+i] ^= b
+	}
+
+	return out
+}
+
+// chunkAD marks the last chunk, a file cut at a chunk boundary doesn't decrypt
+func chunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+
+	return []byte{0}
+}
+
+// encryptReader seals the chunks of src as they are read, an empty src gives one empty last chunk
+type encryptReader struct {
+	aead      cipher.AEAD
+	src       *bufio.Reader
+	nonce     []byte
+	chunkSize int
+
+	index uint64
+	plain []byte
+	out   []byte
+	done  bool
+}
+
+// newEncryptReader encrypts src, the reader seeks back to the start when src does
+func newEncryptReader(src io.Reader, key []byte, enc model.Encryption) (io.Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(enc.Nonce)
+	if err != nil || len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("client: invalid nonce %q", enc.Nonce)
+	}
+
+	r := &encryptReader{
+		aead:      aead,
+		src:       bufio.NewReader(src),
+		nonce:     nonce,
+		chunkSize: enc.ChunkSize,
+		plain:     make([]byte, enc.ChunkSize),
+	}
+
+	if seeker, ok := src.(io.Seeker); ok {
+		return &seekingEncryptReader{encryptReader: r, seeker: seeker, raw: src}, nil
+	}
+
+	return r, nil
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		if err := r.seal(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+
+	return n, nil
+}
+
+func (r *encryptReader) seal() error {
+	n, err := io.ReadFull(r.src, r.plain)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		r.done = true
+	case err != nil:
+		return err
+	default:
+		// a full chunk is the last one when nothing follows
+		if _, err := r.src.Peek(1); err == io.EOF {
+			r.done = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	r.out = r.aead.Seal(nil, chunkNonce(r.nonce, r.index), r.plain[:n], chunkAD(r.done))
+	r.index++
+
+	return nil
+}
+
+// seekingEncryptReader lets a failed upload be sent again from the start
+type seekingEncryptReader struct {
+	*encryptReader
+	seeker io.Seeker
+	raw    io.Reader
+}
+
+func (r *seekingEncryptReader) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, errors.New("client: an encrypted upload only seeks back to the start")
+	}
+
+	if _, err := r.seeker.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	r.src.Reset(r.raw)
+	r.index, r.out, r.done = 0, nil, false
+
+	return 0, nil
+}
+
+// decryptWriter opens the chunks written to it and writes the plaintext to w, Close opens the last one
+type decryptWriter struct {
+	aead      cipher.AEAD
+	w         io.Writer
+	nonce     []byte
+	chunkSize int
+
+	index   uint64
+	buf     []byte
+	written int64
+}
+
+func newDecryptWriter(w io.Writer, key []byte, enc model.Encryption) (*decryptWriter, error) {
+	if enc.Algorithm != model.AlgorithmAESGCMChunked {
+		return nil, fmt.Errorf("client: unknown encryption %q", enc.Algorithm)
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(enc.Nonce)
+	if err != nil || len(nonce) != aead.NonceSize() || enc.ChunkSize <= 0 {
+		return nil, fmt.Errorf("client: invalid encryption %+v", enc)
+	}
+
+	return &decryptWriter{aead: aead, w: w, nonce: nonce, chunkSize: enc.ChunkSize}, nil
+}
+
+func (d *decryptWriter) Write(p []byte) (int, error) {
+	d.buf = append(d.buf, p...)
+	sealed := d.chunkSize + d.aead.Overhead()
+
+	// a full chunk is only known not to be the last one once more bytes follow it
+	offset := 0
+	for len(d.buf)-offset > sealed {
+		if err := d.open(d.buf[offset:offset+sealed], false); err != nil {
+			return 0, err
+		}
+
+		offset += sealed
+	}
+
+	d.buf = append(d.buf[:0], d.buf[offset:]...)
+
+	return len(p), nil
+}
+
+// Close opens the last chunk, a missing or truncated one fails with ErrDecrypt
+func (d *decryptWriter) Close() error {
+	return d.open(d.buf, true)
+}
+
+func (d *decryptWriter) open(chunk []byte, last bool) error {
+	plain, err := d.aead.Open(nil, chunkNonce(d.nonce, d.index), chunk, chunkAD(last))
+	if err != nil {
+		return ErrDecrypt
+	}
+
+	d.index++
+
+	n, err := d.w.Write(plain)
+	d.written += int64(n)
+
+	return err
+}
+
+// CreateEncryptedFile encrypts file with key while uploading it, the api only stores the
+// ciphertext and how it was encrypted. Share the alias with ShareLink.
+func (c *Client) CreateEncryptedFile(ctx context.Context, req model.ShortenFileRequest, file io.Reader, key []byte) (service.InsertFileOutput, error) {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return service.InsertFileOutput{}, err
+	}
+
+	enc := model.Encryption{
+		Algorithm: model.AlgorithmAESGCMChunked,
+		Nonce:     base64.StdEncoding.EncodeToString(nonce),
+		ChunkSize: DefaultChunkSize,
+	}
+
+	body, err := newEncryptReader(file, key, enc)
+	if err != nil {
+		return service.InsertFileOutput{}, err
+	}
+
+	req.Encryption = &enc
+	req.SHA256 = ""
+
+	return c.CreateFile(ctx, req, body)
+}
+
+// DownloadEncryptedFile decrypts the file of alias with key while streaming it to w. The plaintext
+// written before an altered chunk is found can't be taken back, w is best a temporary file.
+func (c *Client) DownloadEncryptedFile(ctx context.Context, alias string, key []byte, w io.Writer) (FileInfo, error) {
+	found, err := c.Find(ctx, alias)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	if found.Response.Encryption == nil {
+		return FileInfo{}, fmt.Errorf("client: %s is not encrypted", alias)
+	}
+
+	dw, err := newDecryptWriter(w, key, *found.Response.Encryption)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	info, err := c.DownloadFile(ctx, alias, dw)
+	if err != nil {
+		return info, err
+	}
+
+	if err := dw.Close(); err != nil {
+		return info, err
+	}
+
+	info.Size = dw.written
+	return info, nil
+}
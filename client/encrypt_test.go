@@ -0,0 +1,117 @@
+package client
+
+import (
+	"backstreetlinkv2/api/model"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestClient_EncryptedFile(t *testing.T) {
+	c := newTestServer(t, nil)
+	ctx := context.Background()
+
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := map[string]int{"empty": 0, "short": 10, "onechunk": DefaultChunkSize, "chunksplus": 2*DefaultChunkSize + 1}
+
+	for alias, size := range sizes {
+		content := strings.Repeat("x", size)
+
+		out, err := c.CreateEncryptedFile(ctx, model.ShortenFileRequest{Alias: alias, Filename: "secret.txt"}, strings.NewReader(content), key)
+		if err != nil {
+			t.Fatalf("CreateEncryptedFile(%s) error = %v", alias, err)
+		}
+
+		var stored bytes.Buffer
+		if _, err := c.DownloadFile(ctx, out.Alias, &stored); err != nil {
+			t.Fatalf("DownloadFile(%s) error = %v", alias, err)
+		}
+
+		if size > 0 && bytes.Contains(stored.Bytes(), []byte(content)) {
+			t.Errorf("%s is stored in the clear", alias)
+		}
+
+		var buf bytes.Buffer
+		info, err := c.DownloadEncryptedFile(ctx, alias, key, &buf)
+		if err != nil {
+			t.Fatalf("DownloadEncryptedFile(%s) error = %v", alias, err)
+		}
+
+		if buf.String() != content || info.Size != int64(size) {
+			t.Errorf("DownloadEncryptedFile(%s) = %+v, %d bytes, want %d", alias, info, buf.Len(), size)
+		}
+	}
+
+	other, _ := NewKey()
+	if _, err := c.DownloadEncryptedFile(ctx, "short", other, io.Discard); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("DownloadEncryptedFile() with another key error = %v, want ErrDecrypt", err)
+	}
+}
+
+func TestDecryptWriter_Truncated(t *testing.T) {
+	key, _ := NewKey()
+	enc := model.Encryption{Algorithm: model.AlgorithmAESGCMChunked, Nonce: base64.StdEncoding.EncodeToString(make([]byte, 12)), ChunkSize: 1024}
+
+	r, err := newEncryptReader(strings.NewReader(strings.Repeat("x", 3000)), key, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the file cut after its first two chunks
+	dw, err := newDecryptWriter(io.Discard, key, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dw.Write(sealed[:2*(1024+16)]); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	if err := dw.Close(); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("Close() of a truncated file error = %v, want ErrDecrypt", err)
+	}
+}
+
+func TestParseShareLink(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, KeySize)
+	encoded := base64.RawURLEncoding.EncodeToString(key)
+
+	tests := []struct {
+		link      string
+		wantAlias string
+		wantKey   []byte
+		wantErr   bool
+	}{
+		{link: "https://backstreet.link/myreport#" + encoded, wantAlias: "myreport", wantKey: key},
+		{link: "myreport#" + encoded, wantAlias: "myreport", wantKey: key},
+		{link: "myreport", wantAlias: "myreport"},
+		{link: "myreport#tooshort", wantErr: true},
+		{link: "https://backstreet.link/", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.link, func(t *testing.T) {
+			alias, key, err := ParseShareLink(tt.link)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseShareLink() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if alias != tt.wantAlias || !bytes.Equal(key, tt.wantKey) {
+				t.Errorf("ParseShareLink() = %q, %x, want %q, %x", alias, key, tt.wantAlias, tt.wantKey)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"backstreetlinkv2/api/helper"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// the kinds of error answered by the api, match them with errors.Is
+var (
+	ErrBadRequest   = &kindError{helper.KindBadRequest}
+	ErrUnauthorized = &kindError{helper.KindUnauthorized}
+	ErrForbidden    = &kindError{helper.KindForbidden}
+	ErrNotFound     = &kindError{helper.KindNotFound}
+	ErrConflict     = &kindError{helper.KindConflict}
+	ErrGone         = &kindError{helper.KindGone}
+	ErrTooLarge     = &kindError{helper.KindTooLarge}
+	ErrUnsupported  = &kindError{helper.KindUnsupported}
+	ErrRateLimited  = &kindError{helper.KindRateLimited}
+	ErrUnexpected   = &kindError{helper.KindUnexpected}
+	ErrUnavailable  = &kindError{helper.KindUnavailable}
+	ErrTimeout      = &kindError{helper.KindTimeout}
+)
+
+var errNotReplayable = errors.New("client: the body can't be sent again")
+
+// ErrChecksumMismatch is returned when a download doesn't match the sha256 sent by the api,
+// the file was written to w all the same
+var ErrChecksumMismatch = errors.New("client: the downloaded file doesn't match its sha256")
+
+type kindError struct {
+	kind helper.Kind
+}
+
+func (k *kindError) Error() string {
+	return fmt.Sprintf("client: %s", http.StatusText(k.kind))
+}
+
+// Error is the problem answered by the api
+type Error struct {
+	Status    int                 `json:"status"`
+	Code      string              `json:"code"`
+	Detail    string              `json:"detail"`
+	RequestID string              `json:"request_id,omitempty"`
+	Fields    []helper.FieldError `json:"fields,omitempty"`
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("api: %d %s", e.Status, e.Code)
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+
+	if e.RequestID != "" {
+		msg += " (request id " + e.RequestID + ")"
+	}
+
+	return msg
+}
+
+// Is matches the Err* kind of the status
+func (e *Error) Is(target error) bool {
+	k, ok := target.(*kindError)
+	if !ok {
+		return false
+	}
+
+	if k.kind == helper.KindUnexpected {
+		return e.Status >= 500 && !errors.Is(e, ErrUnavailable) && !errors.Is(e, ErrTimeout)
+	}
+
+	return e.Status == k.kind
+}
+
+// decodeError reads the problem of a failed response, a body that isn't a problem,
+// e.g. from a proxy, still gives an *Error of the status
+func decodeError(resp *http.Response) *Error {
+	apiErr := &Error{
+		Status:    resp.StatusCode,
+		Code:      helper.ErrorCode(resp.StatusCode),
+		RequestID: resp.Header.Get("X-Request-ID"),
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return apiErr
+	}
+
+	var problem helper.Problem
+	if err := json.Unmarshal(raw, &problem); err != nil || problem.Code == "" {
+		apiErr.Detail = http.StatusText(resp.StatusCode)
+		return apiErr
+	}
+
+	apiErr.Code = problem.Code
+	apiErr.Detail = problem.Detail
+	apiErr.Fields = problem.Fields
+
+	if problem.RequestID != "" {
+		apiErr.RequestID = problem.RequestID
+	}
+
+	return apiErr
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"backstreetlinkv2/api/model"
+	"backstreetlinkv2/api/service"
+	"backstreetlinkv2/client"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+type cli struct {
+	client *client.Client
+	stdout io.Writer
+	stderr io.Writer
+	json   bool
+}
+
+type command func(ctx context.Context, app *cli, args []string) error
+
+var commands = map[string]command{
+	"link":     linkCmd,
+	"upload":   uploadCmd,
+	"find":     findCmd,
+	"download": downloadCmd,
+	"delete":   deleteCmd,
+	"stats":    statsCmd,
+}
+
+func linkCmd(ctx context.Context, app *cli, args []string) error {
+	fs := flag.NewFlagSet("link", flag.ContinueOnError)
+	fs.SetOutput(app.stderr)
+	maxClicks := fs.Int("max-clicks", 0, "clicks before the link is gone, unlimited by default")
+
+	if err := fs.Parse(args); err != nil || fs.NArg() != 2 {
+		return usageError{"usage: backstreet link [-max-clicks n] <alias> <url>"}
+	}
+
+	out, err := app.client.CreateLink(ctx, model.ShortenRequest{Alias: fs.Arg(0), RedirectTo: fs.Arg(1), MaxClicks: *maxClicks})
+	if err != nil {
+		return err
+	}
+
+	return app.print(out, "%s -> %s\n", out.Alias, out.RedirectTo)
+}
+
+func uploadCmd(ctx context.Context, app *cli, args []string) error {
+	fs := flag.NewFlagSet("upload", flag.ContinueOnError)
+	fs.SetOutput(app.stderr)
+	name := fs.String("name", "", "filename shown on download, the base name of the file by default")
+	encrypt := fs.Bool("encrypt", false, "encrypt the file, the key is only in the printed link")
+	maxDownloads := fs.Int("max-downloads", 0, "downloads before the file is deleted, unlimited by default")
+	burn := fs.Bool("burn", false, "delete the file after its first download")
+
+	if err := fs.Parse(args); err != nil || fs.NArg() < 2 {
+		return usageError{"usage: backstreet upload [-name name] [-encrypt] [-max-downloads n] [-burn] <alias> <file>..."}
+	}
+
+	req := model.ShortenFileRequest{Alias: fs.Arg(0), MaxDownloads: *maxDownloads, BurnAfterRead: *burn}
+
+	if fs.NArg() > 2 {
+		if *name != "" || *encrypt {
+			return usageError{"-name and -encrypt take a single file"}
+		}
+
+		return uploadFiles(ctx, app, req, fs.Args()[1:])
+	}
+
+	path := fs.Arg(1)
+	if *name == "" {
+		*name = filepath.Base(path)
+	}
+	req.Filename = *name
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader = file
+	if !app.json {
+		progress := newProgressReader(file, stat.Size(), *name, app.stderr)
+		defer progress.Done()
+
+		body = progress
+	}
+
+	if *encrypt {
+		return uploadEncrypted(ctx, app, req, body)
+	}
+
+	// hashed before the progress starts, the client would otherwise read the file through it twice
+	sum, err := sha256File(file)
+	if err != nil {
+		return err
+	}
+
+	req.SHA256 = sum
+
+	out, err := app.client.CreateFile(ctx, req, body)
+	if err != nil {
+		return err
+	}
+
+	return app.print(out, "%s -> %s\n", out.Alias, out.Filename)
+}
+
+// uploadFiles shares the files under the alias of req, named by their base name
+func uploadFiles(ctx context.Context, app *cli, req model.ShortenFileRequest, paths []string) error {
+	files := make([]client.File, len(paths))
+
+	for i, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		stat, err := file.Stat()
+		if err != nil {
+			return err
+		}
+
+		files[i] = client.File{Name: filepath.Base(path), Content: file}
+
+		if !app.json {
+			progress := newProgressReader(file, stat.Size(), files[i].Name, app.stderr)
+			defer progress.Done()
+
+			files[i].Content = progress
+		}
+	}
+
+	out, err := app.client.CreateFiles(ctx, req, files)
+	if err != nil {
+		return err
+	}
+
+	return app.print(out, "%s -> %s (%d files)\n", out.Alias, out.Filename, len(out.Files))
+}
+
+// uploadEncrypted prints the link holding the key, it can't be found again afterwards
+func uploadEncrypted(ctx context.Context, app *cli, req model.ShortenFileRequest, body io.Reader) error {
+	key, err := client.NewKey()
+	if err != nil {
+		return err
+	}
+
+	out, err := app.client.CreateEncryptedFile(ctx, req, body, key)
+	if err != nil {
+		return err
+	}
+
+	link := app.client.ShareLink(out.Alias, key)
+
+	return app.print(struct {
+		service.InsertFileOutput
+		Link string `json:"link"`
+	}{out, link}, "%s -> %s\n%s\n", out.Alias, out.Filename, link)
+}
+
+func sha256File(file *os.File) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func findCmd(ctx context.Context, app *cli, args []string) error {
+	if len(args) != 1 {
+		return usageError{"usage: backstreet find <alias>"}
+	}
+
+	out, err := app.client.Find(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	target := out.Response.RedirectTo
+	if out.Response.Type == model.TypeFile {
+		target = out.Response.Filename + describe(out.Response.ContentType, out.Response.Image)
+	}
+
+	if out.Response.Type == model.TypeLink && target == "" {
+		target = "hidden, resolving it counts a click"
+	}
+
+	if limit := out.Response.Limit(); limit > 0 {
+		target += fmt.Sprintf(" (gone after %d uses)", limit)
+	}
+
+	// the json holds the files already
+	if err := app.print(out, "%s %s -> %s\n", out.Response.Alias, out.Response.Type, target); err != nil || app.json {
+		return err
+	}
+
+	for i, file := range out.Response.Files {
+		if err := app.print(out, "  %d %s (%s)%s\n", i, file.Name, humanBytes(file.Size), describe(file.ContentType, file.Image)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// describe returns " image/png 640x480", what is known of a file
+func describe(contentType string, img *model.ImageInfo) string {
+	var s string
+	if contentType != "" {
+		s += " " + contentType
+	}
+
+	if img != nil {
+		s += fmt.Sprintf(" %dx%d", img.Width, img.Height)
+	}
+
+	return s
+}
+
+func downloadCmd(ctx context.Context, app *cli, args []string) error {
+	fs := flag.NewFlagSet("download", flag.ContinueOnError)
+	fs.SetOutput(app.stderr)
+	output := fs.String("o", "", "destination, the name of the file in the current directory by default")
+	entry := fs.String("file", "", "index or name of one of the files of the alias, all of them as a zip by default")
+
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return usageError{"usage: backstreet download [-o path] [-file index|name] <alias or link>"}
+	}
+
+	// the link of an encrypted file holds its key
+	alias, key, err := client.ParseShareLink(fs.Arg(0))
+	if err != nil {
+		return usageError{err.Error()}
+	}
+
+	download := func(ctx context.Context, alias string, w io.Writer) (client.FileInfo, error) {
+		return app.client.DownloadEntry(ctx, alias, *entry, w)
+	}
+	if key != nil {
+		if *entry != "" {
+			return usageError{"an encrypted link shares a single file, -file doesn't apply"}
+		}
+
+		download = func(ctx context.Context, alias string, w io.Writer) (client.FileInfo, error) {
+			return app.client.DownloadEncryptedFile(ctx, alias, key, w)
+		}
+	}
+
+	if *output == "-" {
+		_, err := download(ctx, alias, app.stdout)
+		return err
+	}
+
+	// the name is only known once the response arrives, the file is renamed after the download
+	tmp, err := os.CreateTemp(filepath.Dir(*output), ".backstreet-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	info, err := download(ctx, alias, tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	dest := *output
+	if dest == "" {
+		dest = filepath.Base(info.Filename)
+		if dest == "." || dest == "/" || dest == "" {
+			dest = alias
+		}
+
+		if _, err := os.Stat(dest); err == nil {
+			return fmt.Errorf("%s already exists, choose another name with -o", dest)
+		}
+	}
+
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return err
+	}
+
+	info.Filename = dest
+	return app.print(info, "%s (%d bytes)\n", dest, info.Size)
+}
+
+func deleteCmd(ctx context.Context, app *cli, args []string) error {
+	if len(args) != 1 {
+		return usageError{"usage: backstreet delete <alias>"}
+	}
+
+	out, err := app.client.DeleteAlias(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	return app.print(out, "%s deleted\n", out.Alias)
+}
+
+func statsCmd(ctx context.Context, app *cli, args []string) error {
+	if len(args) != 0 {
+		return usageError{"usage: backstreet stats"}
+	}
+
+	out, err := app.client.CacheStats(ctx)
+	if err != nil {
+		return err
+	}
+
+	s := out.Stats
+	return app.print(out, "hits %d\nmisses %d\nhit ratio %.2f\nentries %d\nevictions %d\nexpirations %d\ncollisions %d\n",
+		s.Hits, s.Misses, out.HitRatio, s.Entries, s.Evictions, s.Expirations, s.Collisions)
+}
+
+// print writes v as json with -json, the formatted text otherwise
+func (app *cli) print(v any, format string, args ...any) error {
+	if app.json {
+		encoder := json.NewEncoder(app.stdout)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(v)
+	}
+
+	_, err := fmt.Fprintf(app.stdout, format, args...)
+	return err
+}
+
+// printErr writes the error to stderr, the problem answered by the api is kept whole with -json
+func (app *cli) printErr(err error) {
+	var apiErr *client.Error
+	errors.As(err, &apiErr)
+
+	if app.json && apiErr != nil {
+		encoder := json.NewEncoder(app.stderr)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(apiErr)
+
+		return
+	}
+
+	fmt.Fprintln(app.stderr, "backstreet:", err)
+
+	if apiErr != nil {
+		for _, field := range apiErr.Fields {
+			fmt.Fprintf(app.stderr, "  %s: %s\n", field.Field, field.Message)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const defaultURL = "https://backstreet.link"
+
+type config struct {
+	URL    string `yaml:"url"`
+	APIKey string `yaml:"api_key"`
+}
+
+// loadConfig reads path, or the default config file when path is empty,
+// a missing default file is not an error
+func loadConfig(path string, lookupEnv func(string) (string, bool)) (config, error) {
+	cfg := config{URL: defaultURL}
+
+	explicit := path != ""
+	if !explicit {
+		dir, err := os.UserConfigDir()
+		if err == nil {
+			path = filepath.Join(dir, "backstreet", "config.yaml")
+		}
+	}
+
+	if path != "" {
+		raw, err := os.ReadFile(path)
+
+		switch {
+		case errors.Is(err, fs.ErrNotExist) && !explicit:
+		case err != nil:
+			return cfg, fmt.Errorf("config: %w", err)
+		default:
+			decoder := yaml.NewDecoder(bytes.NewReader(raw))
+			decoder.KnownFields(true)
+
+			if err := decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+				return cfg, fmt.Errorf("config %s: %w", path, err)
+			}
+		}
+	}
+
+	if url, ok := lookupEnv("BACKSTREET_URL"); ok && url != "" {
+		cfg.URL = url
+	}
+
+	if key, ok := lookupEnv("BACKSTREET_API_KEY"); ok && key != "" {
+		cfg.APIKey = key
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,146 @@
+// Command backstreet shortens links and shares files through the backstreet.link api.
+package main
+
+import (
+	"backstreetlinkv2/client"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+)
+
+const usage = `usage: backstreet [-config file] [-url url] [-json] <command> [arguments]
+
+commands:
+  link [-max-clicks n] <alias> <url>
+                                     shorten url under alias, gone after n clicks
+  upload [-name name] [-encrypt] [-max-downloads n] [-burn] <alias> <file>...
+                                     share files under alias, -encrypt prints a link holding the key,
+                                     deleted after n downloads or the first one with -burn
+  find <alias>                       show what alias points to and its files
+  download [-o path] [-file index|name] <alias|link>
+                                     save the file of alias, several as a zip, -o - writes it to stdout
+  delete <alias>                     delete alias and its file, needs the api key
+  stats                              show the cache counters, needs the api key
+
+The url and the api key are read from the config file, by default
+$XDG_CONFIG_HOME/backstreet/config.yaml, then from BACKSTREET_URL and
+BACKSTREET_API_KEY, then from the flags.
+
+exit codes:
+  0 ok                      5 invalid request
+  1 unexpected error        6 unauthorized or forbidden
+  2 usage                   7 too large or unsupported
+  3 not found               8 gone
+  4 alias already taken     9 rate limited or unavailable, retry later
+`
+
+const (
+	exitOK = iota
+	exitUnexpected
+	exitUsage
+	exitNotFound
+	exitConflict
+	exitInvalid
+	exitUnauthorized
+	exitTooLarge
+	exitGone
+	exitRetryLater
+)
+
+// usageError is a mistake in the command line
+type usageError struct {
+	msg string
+}
+
+func (e usageError) Error() string {
+	return e.msg
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	os.Exit(run(ctx, os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("backstreet", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, usage) }
+
+	configPath := fs.String("config", "", "config file")
+	baseURL := fs.String("url", "", "base url of the api")
+	jsonOutput := fs.Bool("json", false, "print the responses as json")
+
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	cfg, err := loadConfig(*configPath, os.LookupEnv)
+	if err != nil {
+		fmt.Fprintln(stderr, "backstreet:", err)
+		return exitUsage
+	}
+
+	if *baseURL != "" {
+		cfg.URL = *baseURL
+	}
+
+	c, err := client.New(cfg.URL, client.WithAdminKey(cfg.APIKey))
+	if err != nil {
+		fmt.Fprintln(stderr, "backstreet:", err)
+		return exitUsage
+	}
+
+	app := &cli{client: c, stdout: stdout, stderr: stderr, json: *jsonOutput}
+
+	command, ok := commands[fs.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "backstreet: unknown command %q\n\n%s", fs.Arg(0), usage)
+		return exitUsage
+	}
+
+	if err := command(ctx, app, fs.Args()[1:]); err != nil {
+		app.printErr(err)
+		return exitCode(err)
+	}
+
+	return exitOK
+}
+
+// exitCode maps the error kinds of the api to the exit status
+func exitCode(err error) int {
+	var usageErr usageError
+
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &usageErr):
+		return exitUsage
+	case errors.Is(err, client.ErrNotFound):
+		return exitNotFound
+	case errors.Is(err, client.ErrConflict):
+		return exitConflict
+	case errors.Is(err, client.ErrBadRequest):
+		return exitInvalid
+	case errors.Is(err, client.ErrUnauthorized), errors.Is(err, client.ErrForbidden):
+		return exitUnauthorized
+	case errors.Is(err, client.ErrTooLarge), errors.Is(err, client.ErrUnsupported):
+		return exitTooLarge
+	case errors.Is(err, client.ErrGone):
+		return exitGone
+	case errors.Is(err, client.ErrRateLimited), errors.Is(err, client.ErrUnavailable), errors.Is(err, client.ErrTimeout):
+		return exitRetryLater
+	default:
+		return exitUnexpected
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"backstreetlinkv2/api/helper"
+	"backstreetlinkv2/client"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		status int
+		want   int
+	}{
+		{http.StatusNotFound, exitNotFound},
+		{http.StatusConflict, exitConflict},
+		{http.StatusBadRequest, exitInvalid},
+		{http.StatusUnauthorized, exitUnauthorized},
+		{http.StatusRequestEntityTooLarge, exitTooLarge},
+		{http.StatusGone, exitGone},
+		{http.StatusServiceUnavailable, exitRetryLater},
+		{http.StatusInternalServerError, exitUnexpected},
+	}
+
+	for _, tt := range tests {
+		err := fmt.Errorf("wrapped: %w", &client.Error{Status: tt.status})
+		if got := exitCode(err); got != tt.want {
+			t.Errorf("exitCode(%d) = %d, want %d", tt.status, got, tt.want)
+		}
+	}
+
+	if got := exitCode(usageError{"bad"}); got != exitUsage {
+		t.Errorf("exitCode(usageError) = %d, want %d", got, exitUsage)
+	}
+
+	if got := exitCode(errors.New("disk full")); got != exitUnexpected {
+		t.Errorf("exitCode(plain error) = %d, want %d", got, exitUnexpected)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("url: http://file.example\napi_key: from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{"BACKSTREET_API_KEY": "from-env"}
+	lookup := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+
+	cfg, err := loadConfig(path, lookup)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+
+	if cfg.URL != "http://file.example" || cfg.APIKey != "from-env" {
+		t.Errorf("loadConfig() = %+v", cfg)
+	}
+
+	if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml"), lookup); err == nil {
+		t.Errorf("loadConfig() of a missing explicit file should fail")
+	}
+}
+
+func TestRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v2/find/missing" {
+			helper.WriteProblem(w, r, helper.NewProblem(http.StatusNotFound, "", "not found"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"code": 200, "message": "OK", "alias": "testing", "type": "LINK", "redirect_to": "https://google.com"})
+	}))
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+		wantOut  string
+	}{
+		{name: "link", args: []string{"link", "testing", "https://google.com"}, wantOut: "testing -> https://google.com\n"},
+		{name: "not found", args: []string{"find", "missing"}, wantCode: exitNotFound},
+		{name: "unknown command", args: []string{"shorten"}, wantCode: exitUsage},
+		{name: "missing argument", args: []string{"link", "testing"}, wantCode: exitUsage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+
+			// keeps the config of the machine out of the test
+			t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+			t.Setenv("HOME", t.TempDir())
+
+			args := append([]string{"-url", server.URL}, tt.args...)
+
+			code := run(context.Background(), args, &stdout, &stderr)
+			if code != tt.wantCode {
+				t.Fatalf("run() = %d, want %d, stderr: %s", code, tt.wantCode, stderr.String())
+			}
+
+			if tt.wantOut != "" && stdout.String() != tt.wantOut {
+				t.Errorf("stdout = %q, want %q", stdout.String(), tt.wantOut)
+			}
+		})
+	}
+}
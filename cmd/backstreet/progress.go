@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+const progressInterval = 200 * time.Millisecond
+
+// progressReader reports on w how much of the file has been read by the upload,
+// a retried upload seeks back to the start and the progress follows
+type progressReader struct {
+	file  io.ReadSeeker
+	name  string
+	total int64
+	read  int64
+	w     io.Writer
+	last  time.Time
+}
+
+func newProgressReader(file io.ReadSeeker, total int64, name string, w io.Writer) *progressReader {
+	return &progressReader{file: file, name: name, total: total, w: w}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.file.Read(b)
+	p.read += int64(n)
+
+	if now := time.Now(); now.Sub(p.last) >= progressInterval || err == io.EOF {
+		p.last = now
+		p.report()
+	}
+
+	return n, err
+}
+
+func (p *progressReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := p.file.Seek(offset, whence)
+	if err == nil {
+		p.read = pos
+	}
+
+	return pos, err
+}
+
+// Done ends the progress line
+func (p *progressReader) Done() {
+	p.report()
+	fmt.Fprintln(p.w)
+}
+
+func (p *progressReader) report() {
+	percent := 100.0
+	if p.total > 0 {
+		percent = float64(p.read) * 100 / float64(p.total)
+	}
+
+	fmt.Fprintf(p.w, "\ruploading %s %5.1f%% (%s / %s)", p.name, percent, humanBytes(p.read), humanBytes(p.total))
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
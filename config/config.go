@@ -0,0 +1,308 @@
+// Package config loads the server configuration.
+//
+// Every field has a default, and can be overridden, from the lowest to the highest
+// precedence, by its environment variable, by the optional YAML or TOML file given
+// with -config (or CONFIG_FILE) and by its command line flag. The flag of a field is
+// its path in the file, e.g. -http.write_timeout=30s.
+//
+// The fields tagged reload:"true" can be changed while the server runs,
+// see Loader.Load and Diff.
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EnvProduction = "PRODUCTION"
+	EnvLocal      = "LOCAL"
+
+	CacheMemory = "memory"
+	CacheRedis  = "redis"
+	CacheTiered = "tiered"
+)
+
+var productionOrigins = []string{"https://backstreet.link", "https://www.backstreet.link"}
+
+type Config struct {
+	Env         string `env:"ENV" yaml:"env" toml:"env" default:"LOCAL"`
+	Port        string `env:"PORT" yaml:"port" toml:"port" default:"8080"`
+	AdminAPIKey string `env:"ADMIN_API_KEY" yaml:"admin_api_key" toml:"admin_api_key" secret:"true"`
+
+	// MetricsToken is the bearer token /metrics asks for, it is open when empty
+	MetricsToken string `env:"METRICS_TOKEN" yaml:"metrics_token" toml:"metrics_token" secret:"true"`
+
+	Log       LogConfig       `yaml:"log" toml:"log"`
+	HTTP      HTTPConfig      `yaml:"http" toml:"http"`
+	RateLimit RateLimitConfig `yaml:"rate_limit" toml:"rate_limit"`
+	CORS      CORSConfig      `yaml:"cors" toml:"cors"`
+	MySQL     MySQLConfig     `yaml:"mysql" toml:"mysql"`
+	S3        S3Config        `yaml:"s3" toml:"s3"`
+	Cache     CacheConfig     `yaml:"cache" toml:"cache"`
+	Redis     RedisConfig     `yaml:"redis" toml:"redis"`
+	Tracing   TracingConfig   `yaml:"tracing" toml:"tracing"`
+	Reconcile ReconcileConfig `yaml:"reconcile" toml:"reconcile"`
+	Checksum  ChecksumConfig  `yaml:"checksum" toml:"checksum"`
+	SSE       SSEConfig       `yaml:"sse" toml:"sse"`
+}
+
+type LogConfig struct {
+	Level  string `env:"LOG_LEVEL" yaml:"level" toml:"level" default:"info" reload:"true"`
+	Format string `env:"LOG_FORMAT" yaml:"format" toml:"format" default:"json"`
+}
+
+type HTTPConfig struct {
+	ReadTimeout        time.Duration `env:"HTTP_READ_TIMEOUT" yaml:"read_timeout" toml:"read_timeout" default:"10s"`
+	WriteTimeout       time.Duration `env:"HTTP_WRITE_TIMEOUT" yaml:"write_timeout" toml:"write_timeout" default:"10s"`
+	IdleTimeout        time.Duration `env:"HTTP_IDLE_TIMEOUT" yaml:"idle_timeout" toml:"idle_timeout" default:"30s"`
+	ReadHeaderTimeout  time.Duration `env:"HTTP_READ_HEADER_TIMEOUT" yaml:"read_header_timeout" toml:"read_header_timeout" default:"5s"`
+	MaxHeaderBytes     int           `env:"HTTP_MAX_HEADER_BYTES" yaml:"max_header_bytes" toml:"max_header_bytes" default:"10485760"`
+	FileMaxSize        int64         `env:"HTTP_FILE_MAX_SIZE" yaml:"file_max_size" toml:"file_max_size" default:"10485760" reload:"true"`
+	ShutdownTimeout    time.Duration `env:"SHUTDOWN_TIMEOUT" yaml:"shutdown_timeout" toml:"shutdown_timeout" default:"30s"`
+	DrainDelay         time.Duration `env:"DRAIN_DELAY" yaml:"drain_delay" toml:"drain_delay" default:"5s"`
+	HealthCheckTimeout time.Duration `env:"HEALTH_CHECK_TIMEOUT" yaml:"health_check_timeout" toml:"health_check_timeout" default:"2s"`
+	// TrustedProxies are the CIDRs or addresses of the proxies whose X-Forwarded-For is believed
+	TrustedProxies []string `env:"HTTP_TRUSTED_PROXIES" yaml:"trusted_proxies" toml:"trusted_proxies"`
+}
+
+type RateLimitConfig struct {
+	RPS   float64 `env:"RATE_LIMIT_RPS" yaml:"rps" toml:"rps" default:"1" reload:"true"`
+	Burst int     `env:"RATE_LIMIT_BURST" yaml:"burst" toml:"burst" default:"3" reload:"true"`
+}
+
+type CORSConfig struct {
+	// AllowedOrigins defaults to the backstreet.link origins in production and to "*" elsewhere
+	AllowedOrigins []string `env:"CORS_ALLOWED_ORIGINS" yaml:"allowed_origins" toml:"allowed_origins" reload:"true"`
+}
+
+type MySQLConfig struct {
+	DSN string `env:"MYSQL_DSN" yaml:"dsn" toml:"dsn" secret:"true"`
+}
+
+type S3Config struct {
+	AccessKey string `env:"NEW_AWS_ACCESS_KEY" yaml:"access_key" toml:"access_key" secret:"true"`
+	SecretKey string `env:"NEW_AWS_SECRET_KEY" yaml:"secret_key" toml:"secret_key" secret:"true"`
+	Endpoint  string `env:"NEW_AWS_ENDPOINT" yaml:"endpoint" toml:"endpoint"`
+	Bucket    string `env:"NEW_AWS_BUCKETNAME" yaml:"bucket" toml:"bucket"`
+	Region    string `env:"NEW_AWS_REGION" yaml:"region" toml:"region" default:"de"`
+}
+
+type CacheConfig struct {
+	Driver       string        `env:"CACHE_DRIVER" yaml:"driver" toml:"driver" default:"memory"`
+	TTL          time.Duration `env:"CACHE_TTL" yaml:"ttl" toml:"ttl" default:"12h"`
+	L1TTL        time.Duration `env:"CACHE_L1_TTL" yaml:"l1_ttl" toml:"l1_ttl" default:"1m"`
+	MaxSizeMB    int           `env:"CACHE_MAX_SIZE_MB" yaml:"max_size_mb" toml:"max_size_mb" default:"30"`
+	MaxEntrySize int           `env:"CACHE_MAX_ENTRY_SIZE" yaml:"max_entry_size" toml:"max_entry_size" default:"500"`
+	Shards       int           `env:"CACHE_SHARDS" yaml:"shards" toml:"shards" default:"1024"`
+}
+
+type RedisConfig struct {
+	Addr     string `env:"REDIS_ADDR" yaml:"addr" toml:"addr"`
+	Username string `env:"REDIS_USERNAME" yaml:"username" toml:"username"`
+	Password string `env:"REDIS_PASSWORD" yaml:"password" toml:"password" secret:"true"`
+	DB       int    `env:"REDIS_DB" yaml:"db" toml:"db"`
+	PoolSize int    `env:"REDIS_POOL_SIZE" yaml:"pool_size" toml:"pool_size"`
+	Prefix   string `env:"REDIS_PREFIX" yaml:"prefix" toml:"prefix" default:"backstreet:"`
+}
+
+type TracingConfig struct {
+	Exporter    string  `env:"TRACE_EXPORTER" yaml:"exporter" toml:"exporter" default:"none"`
+	ServiceName string  `env:"TRACE_SERVICE_NAME" yaml:"service_name" toml:"service_name" default:"backstreetlinkv2"`
+	SampleRatio float64 `env:"TRACE_SAMPLE_RATIO" yaml:"sample_ratio" toml:"sample_ratio" default:"1"`
+}
+
+// ReconcileConfig schedules the reconciliation of the bucket and the sources table,
+// every replica runs its own schedule so it is best enabled on a single one
+type ReconcileConfig struct {
+	// Interval 0 disables the scheduled runs, the gc-orphans command still runs on demand
+	Interval time.Duration `env:"RECONCILE_INTERVAL" yaml:"interval" toml:"interval" default:"0s"`
+	MinAge   time.Duration `env:"RECONCILE_MIN_AGE" yaml:"min_age" toml:"min_age" default:"1h"`
+
+	// Delete makes the scheduled runs delete what they find instead of only reporting it
+	Delete bool `env:"RECONCILE_DELETE" yaml:"delete" toml:"delete"`
+}
+
+type ChecksumConfig struct {
+	// Verify is off, warn or enforce, enforce fails the downloads that don't match their sha256
+	Verify string `env:"CHECKSUM_VERIFY" yaml:"verify" toml:"verify" default:"enforce"`
+}
+
+// SSEConfig encrypts the objects with SSE-C, every blob has its own data key wrapped by a master key.
+// The master keys are read from keys_file, a stand-in for a kms, then master_key is added as the
+// current one when set.
+type SSEConfig struct {
+	// Enabled encrypts the new uploads, the encrypted objects are read as long as their master key is known
+	Enabled     bool   `env:"SSE_ENABLED" yaml:"enabled" toml:"enabled"`
+	MasterKey   string `env:"SSE_MASTER_KEY" yaml:"master_key" toml:"master_key" secret:"true"`
+	MasterKeyID string `env:"SSE_MASTER_KEY_ID" yaml:"master_key_id" toml:"master_key_id" default:"config"`
+
+	// KeysFile holds one "<id> <base64 key>" per line, the last one is the current one
+	KeysFile string `env:"SSE_KEYS_FILE" yaml:"keys_file" toml:"keys_file"`
+}
+
+// Origins returns the CORS origins, falling back to the defaults of the environment
+func (c Config) Origins() []string {
+	if len(c.CORS.AllowedOrigins) > 0 {
+		return c.CORS.AllowedOrigins
+	}
+
+	if c.Env == EnvProduction {
+		return productionOrigins
+	}
+
+	return []string{"*"}
+}
+
+// Validate reports every invalid field at once
+func (c Config) Validate() error {
+	var problems []string
+	add := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		add("port: %q is not a valid port", c.Port)
+	}
+
+	if _, err := zerolog.ParseLevel(c.Log.Level); err != nil {
+		add("log.level: %q is not a log level", c.Log.Level)
+	}
+
+	if c.Log.Format != "json" && c.Log.Format != "console" {
+		add("log.format: must be json or console, got %q", c.Log.Format)
+	}
+
+	timeouts := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"http.read_timeout", c.HTTP.ReadTimeout},
+		{"http.write_timeout", c.HTTP.WriteTimeout},
+		{"http.idle_timeout", c.HTTP.IdleTimeout},
+		{"http.read_header_timeout", c.HTTP.ReadHeaderTimeout},
+		{"http.shutdown_timeout", c.HTTP.ShutdownTimeout},
+		{"http.health_check_timeout", c.HTTP.HealthCheckTimeout},
+	}
+
+	for _, timeout := range timeouts {
+		if timeout.value <= 0 {
+			add("%s: must be positive, got %s", timeout.name, timeout.value)
+		}
+	}
+
+	if c.HTTP.DrainDelay < 0 {
+		add("http.drain_delay: must not be negative, got %s", c.HTTP.DrainDelay)
+	}
+
+	if c.HTTP.FileMaxSize <= 0 {
+		add("http.file_max_size: must be positive, got %d", c.HTTP.FileMaxSize)
+	}
+
+	if c.HTTP.MaxHeaderBytes <= 0 {
+		add("http.max_header_bytes: must be positive, got %d", c.HTTP.MaxHeaderBytes)
+	}
+
+	for _, proxy := range c.HTTP.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			add("http.trusted_proxies: %q is not a CIDR or an address", proxy)
+		}
+	}
+
+	if c.RateLimit.RPS <= 0 {
+		add("rate_limit.rps: must be positive, got %v", c.RateLimit.RPS)
+	}
+
+	if c.RateLimit.Burst < 1 {
+		add("rate_limit.burst: must be at least 1, got %d", c.RateLimit.Burst)
+	}
+
+	for _, origin := range c.CORS.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" {
+			add("cors.allowed_origins: %q is not an origin", origin)
+		}
+	}
+
+	if c.MySQL.DSN == "" {
+		add("mysql.dsn: is required (MYSQL_DSN)")
+	}
+
+	if c.S3.Endpoint != "" {
+		if u, err := url.Parse(c.S3.Endpoint); err != nil || u.Scheme == "" {
+			add("s3.endpoint: %q is not an url", c.S3.Endpoint)
+		}
+	}
+
+	switch c.Cache.Driver {
+	case CacheMemory:
+	case CacheRedis, CacheTiered:
+		if c.Redis.Addr == "" {
+			add("redis.addr: is required by the %s cache driver", c.Cache.Driver)
+		}
+	default:
+		add("cache.driver: must be memory, redis or tiered, got %q", c.Cache.Driver)
+	}
+
+	if c.Cache.TTL <= 0 {
+		add("cache.ttl: must be positive, got %s", c.Cache.TTL)
+	}
+
+	if c.Cache.Driver == CacheTiered && (c.Cache.L1TTL <= 0 || c.Cache.L1TTL >= c.Cache.TTL) {
+		add("cache.l1_ttl: must be positive and shorter than cache.ttl (%s), got %s", c.Cache.TTL, c.Cache.L1TTL)
+	}
+
+	if c.Cache.MaxSizeMB < 0 || c.Cache.MaxEntrySize <= 0 {
+		add("cache: max_size_mb must not be negative and max_entry_size must be positive")
+	}
+
+	if c.Cache.Shards <= 0 || c.Cache.Shards&(c.Cache.Shards-1) != 0 {
+		add("cache.shards: must be a power of two, got %d", c.Cache.Shards)
+	}
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout", "otlp":
+	default:
+		add("tracing.exporter: must be none, stdout or otlp, got %q", c.Tracing.Exporter)
+	}
+
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		add("tracing.sample_ratio: must be between 0 and 1, got %v", c.Tracing.SampleRatio)
+	}
+
+	if c.Reconcile.Interval < 0 || c.Reconcile.MinAge < 0 {
+		add("reconcile: interval and min_age must not be negative")
+	}
+
+	switch c.Checksum.Verify {
+	case "off", "warn", "enforce":
+	default:
+		add("checksum.verify: must be off, warn or enforce, got %q", c.Checksum.Verify)
+	}
+
+	if c.SSE.MasterKey != "" {
+		if key, err := base64.StdEncoding.DecodeString(c.SSE.MasterKey); err != nil || len(key) != 32 {
+			add("sse.master_key: must be 32 bytes in base64")
+		}
+	}
+
+	if c.SSE.Enabled && c.SSE.MasterKey == "" && c.SSE.KeysFile == "" {
+		add("sse: enabled needs master_key or keys_file")
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+}
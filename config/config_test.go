@@ -0,0 +1,215 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLoader(t *testing.T, env map[string]string, args ...string) *Loader {
+	t.Helper()
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	l := NewLoader(fs)
+	l.lookupFn = func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	return l
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoader_Defaults(t *testing.T) {
+	cfg, err := newTestLoader(t, map[string]string{"MYSQL_DSN": "user:pass@tcp(db:3306)/backstreet"}).Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if cfg.Port != "8080" || cfg.HTTP.WriteTimeout != 10*time.Second || cfg.Cache.TTL != 12*time.Hour {
+		t.Errorf("defaults not applied: %+v", cfg)
+	}
+
+	if got := cfg.Origins(); len(got) != 1 || got[0] != "*" {
+		t.Errorf("Origins() = %v, want [*]", got)
+	}
+}
+
+func TestLoader_Precedence(t *testing.T) {
+	yamlFile := writeFile(t, "config.yaml", `
+port: "9000"
+http:
+  write_timeout: 20s
+rate_limit:
+  burst: 10
+`)
+
+	env := map[string]string{
+		"MYSQL_DSN":          "dsn",
+		"PORT":               "7000",
+		"HTTP_WRITE_TIMEOUT": "15s",
+		"HTTP_READ_TIMEOUT":  "3s",
+		"ENV":                "PRODUCTION",
+	}
+
+	cfg, err := newTestLoader(t, env, "-config", yamlFile, "-rate_limit.burst=20").Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if cfg.HTTP.ReadTimeout != 3*time.Second {
+		t.Errorf("env should override the default, got %s", cfg.HTTP.ReadTimeout)
+	}
+
+	if cfg.Port != "9000" || cfg.HTTP.WriteTimeout != 20*time.Second {
+		t.Errorf("file should override the env, got port %s and write timeout %s", cfg.Port, cfg.HTTP.WriteTimeout)
+	}
+
+	if cfg.RateLimit.Burst != 20 {
+		t.Errorf("flag should override the file, got burst %d", cfg.RateLimit.Burst)
+	}
+
+	if got := cfg.Origins(); len(got) != 2 {
+		t.Errorf("Origins() = %v, want the production origins", got)
+	}
+}
+
+func TestLoader_TOML(t *testing.T) {
+	tomlFile := writeFile(t, "config.toml", `
+[mysql]
+dsn = "from-toml"
+
+[cors]
+allowed_origins = ["https://a.example", "https://b.example"]
+
+[cache]
+l1_ttl = "30s"
+`)
+
+	cfg, err := newTestLoader(t, map[string]string{"CONFIG_FILE": tomlFile}).Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if cfg.MySQL.DSN != "from-toml" || len(cfg.CORS.AllowedOrigins) != 2 || cfg.Cache.L1TTL != 30*time.Second {
+		t.Errorf("toml not applied: %+v", cfg)
+	}
+}
+
+func TestLoader_UnknownKey(t *testing.T) {
+	yamlFile := writeFile(t, "config.yaml", "http:\n  write_timout: 1s\n")
+
+	if _, err := newTestLoader(t, map[string]string{"MYSQL_DSN": "dsn"}, "-config", yamlFile).Load(); err == nil {
+		t.Errorf("Load() expected an error for a misspelled key")
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	env := map[string]string{
+		"PORT":            "not-a-port",
+		"CACHE_DRIVER":    "redis",
+		"LOG_LEVEL":       "loud",
+		"CHECKSUM_VERIFY": "sometimes",
+	}
+
+	_, err := newTestLoader(t, env).Load()
+	if err == nil {
+		t.Fatal("Load() expected a validation error")
+	}
+
+	for _, want := range []string{"port:", "mysql.dsn:", "redis.addr:", "log.level:", "checksum.verify:"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error should mention %s, got:\n%v", want, err)
+		}
+	}
+}
+
+func TestConfig_String(t *testing.T) {
+	env := map[string]string{
+		"MYSQL_DSN":          "user:hunter2@tcp(db:3306)/backstreet",
+		"NEW_AWS_SECRET_KEY": "very-secret",
+	}
+
+	cfg, err := newTestLoader(t, env).Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	out := cfg.String()
+	if strings.Contains(out, "hunter2") || strings.Contains(out, "very-secret") {
+		t.Errorf("String() leaks a secret:\n%s", out)
+	}
+
+	if !strings.Contains(out, "mysql.dsn="+redacted) || !strings.Contains(out, "s3.access_key=\n") {
+		t.Errorf("String() should redact set secrets only:\n%s", out)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	env := map[string]string{"MYSQL_DSN": "user:hunter2@tcp(db:3306)/backstreet"}
+
+	old, err := newTestLoader(t, env).Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	env["MYSQL_DSN"] = "user:hunter3@tcp(db:3306)/backstreet"
+	env["RATE_LIMIT_RPS"] = "5"
+
+	new, err := newTestLoader(t, env).Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	changes := Diff(old, new)
+	want := []Change{
+		{Key: "rate_limit.rps", Old: "1", New: "5", Reloadable: true},
+		{Key: "mysql.dsn", Old: redacted, New: redacted, Reloadable: false},
+	}
+
+	if len(changes) != len(want) {
+		t.Fatalf("Diff() = %+v, want %+v", changes, want)
+	}
+
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("Diff()[%d] = %+v, want %+v", i, changes[i], want[i])
+		}
+	}
+
+	if len(Diff(old, old)) != 0 {
+		t.Errorf("Diff() of the same config should be empty")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	current := Config{Port: "8080", RateLimit: RateLimitConfig{RPS: 1, Burst: 3}}
+	next := Config{Port: "9090", RateLimit: RateLimitConfig{RPS: 5, Burst: 10}}
+
+	got := Merge(current, next)
+
+	if got.Port != "8080" {
+		t.Errorf("Port = %q, want the running 8080", got.Port)
+	}
+
+	if got.RateLimit != next.RateLimit {
+		t.Errorf("RateLimit = %+v, want %+v", got.RateLimit, next.RateLimit)
+	}
+}
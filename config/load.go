@@ -0,0 +1,341 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const redacted = "[REDACTED]"
+
+// Loader keeps the flags so the configuration can be loaded again later
+type Loader struct {
+	flags    *flag.FlagSet
+	file     *string
+	values   map[string]*string
+	lookupFn func(string) (string, bool)
+}
+
+// NewLoader registers -config and one flag per field on fs, fs must be parsed before Load
+func NewLoader(fs *flag.FlagSet) *Loader {
+	l := &Loader{
+		flags:    fs,
+		values:   map[string]*string{},
+		lookupFn: os.LookupEnv,
+	}
+
+	l.file = fs.String("config", "", "path of a YAML or TOML config file (env CONFIG_FILE)")
+
+	walk(reflect.ValueOf(&Config{}).Elem(), "", func(f field) {
+		usage := f.env
+		if f.def != "" {
+			usage = fmt.Sprintf("%s (default %s)", usage, f.def)
+		}
+
+		l.values[f.path] = fs.String(f.path, "", usage)
+	})
+
+	return l
+}
+
+// Load builds the configuration from the defaults, the env, the file and the flags, then validates it
+func (l *Loader) Load() (Config, error) {
+	var cfg Config
+	v := reflect.ValueOf(&cfg).Elem()
+
+	var err error
+	walk(v, "", func(f field) {
+		if err == nil && f.def != "" {
+			err = f.set(f.def)
+		}
+	})
+	if err != nil {
+		return cfg, err
+	}
+
+	walk(v, "", func(f field) {
+		if err != nil || f.env == "" {
+			return
+		}
+
+		if raw, ok := l.lookupFn(f.env); ok && raw != "" {
+			if setErr := f.set(raw); setErr != nil {
+				err = fmt.Errorf("env %s: %w", f.env, setErr)
+			}
+		}
+	})
+	if err != nil {
+		return cfg, err
+	}
+
+	if path := l.filePath(); path != "" {
+		if err := decodeFile(path, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	set := map[string]bool{}
+	l.flags.Visit(func(fl *flag.Flag) {
+		set[fl.Name] = true
+	})
+
+	walk(v, "", func(f field) {
+		if err != nil || !set[f.path] {
+			return
+		}
+
+		if setErr := f.set(*l.values[f.path]); setErr != nil {
+			err = fmt.Errorf("flag -%s: %w", f.path, setErr)
+		}
+	})
+	if err != nil {
+		return cfg, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
+func (l *Loader) filePath() string {
+	if *l.file != "" {
+		return *l.file
+	}
+
+	path, _ := l.lookupFn("CONFIG_FILE")
+	return path
+}
+
+func decodeFile(path string, cfg *Config) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(raw))
+		decoder.KnownFields(true)
+
+		if err := decoder.Decode(cfg); err != nil {
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+
+	case ".toml":
+		meta, err := toml.Decode(string(raw), cfg)
+		if err != nil {
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("config file %s: unknown keys %v", path, undecoded)
+		}
+
+	default:
+		return fmt.Errorf("config file %s: must be .yaml, .yml or .toml", path)
+	}
+
+	return nil
+}
+
+// Flatten returns every field by its path, the secrets are redacted
+func (c Config) Flatten() map[string]string {
+	out := map[string]string{}
+
+	walk(reflect.ValueOf(&c).Elem(), "", func(f field) {
+		value := f.String()
+		if f.secret {
+			value = redact(value)
+		}
+
+		out[f.path] = value
+	})
+
+	return out
+}
+
+// String prints the configuration with the secrets redacted, one field per line
+func (c Config) String() string {
+	var b strings.Builder
+
+	walk(reflect.ValueOf(&c).Elem(), "", func(f field) {
+		value := f.String()
+		if f.secret {
+			value = redact(value)
+		}
+
+		fmt.Fprintf(&b, "%s=%s\n", f.path, value)
+	})
+
+	return b.String()
+}
+
+// Change is a field that differs between two configurations, the secrets are redacted
+type Change struct {
+	Key        string
+	Old        string
+	New        string
+	Reloadable bool
+}
+
+// Diff lists the fields that differ between old and new in declaration order
+func Diff(old, new Config) []Change {
+	newValues := map[string]string{}
+	walk(reflect.ValueOf(&new).Elem(), "", func(f field) {
+		newValues[f.path] = f.String()
+	})
+
+	var changes []Change
+	walk(reflect.ValueOf(&old).Elem(), "", func(f field) {
+		change := Change{Key: f.path, Old: f.String(), New: newValues[f.path], Reloadable: f.reloadable}
+		if change.Old == change.New {
+			return
+		}
+
+		if f.secret {
+			change.Old, change.New = redact(change.Old), redact(change.New)
+		}
+
+		changes = append(changes, change)
+	})
+
+	return changes
+}
+
+// Merge returns current with the reloadable fields taken from next,
+// the other fields only change on restart
+func Merge(current, next Config) Config {
+	nextValues := map[string]reflect.Value{}
+	walk(reflect.ValueOf(&next).Elem(), "", func(f field) {
+		nextValues[f.path] = f.value
+	})
+
+	walk(reflect.ValueOf(&current).Elem(), "", func(f field) {
+		if f.reloadable {
+			f.value.Set(nextValues[f.path])
+		}
+	})
+
+	return current
+}
+
+func redact(value string) string {
+	if value == "" {
+		return value
+	}
+
+	return redacted
+}
+
+type field struct {
+	path       string
+	env        string
+	def        string
+	secret     bool
+	reloadable bool
+	value      reflect.Value
+}
+
+// walk calls fn for every leaf field, the path is made of the yaml names
+func walk(v reflect.Value, prefix string, fn func(f field)) {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+
+		name, _, _ := strings.Cut(sf.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		path := prefix + name
+
+		if sf.Type.Kind() == reflect.Struct && sf.Type != reflect.TypeOf(time.Duration(0)) {
+			walk(v.Field(i), path+".", fn)
+			continue
+		}
+
+		fn(field{
+			path:       path,
+			env:        sf.Tag.Get("env"),
+			def:        sf.Tag.Get("default"),
+			secret:     sf.Tag.Get("secret") == "true",
+			reloadable: sf.Tag.Get("reload") == "true",
+			value:      v.Field(i),
+		})
+	}
+}
+
+func (f field) set(raw string) error {
+	v := f.value
+
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+
+	case v.Kind() == reflect.String:
+		v.SetString(raw)
+
+	case v.Kind() == reflect.Int, v.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+
+	case v.Kind() == reflect.Float64:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+func (f field) String() string {
+	v := f.value
+
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		return time.Duration(v.Int()).String()
+	case v.Kind() == reflect.Slice:
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = v.Index(i).String()
+		}
+		return strings.Join(items, ",")
+	default:
+		return fmt.Sprint(v.Interface())
+	}
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"backstreetlinkv2/db/migrations"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	tests := []struct {
+		name     string
+		fsys     fstest.MapFS
+		versions []int
+		wantErr  bool
+	}{
+		{
+			name: "sorted by version",
+			fsys: fstest.MapFS{
+				"000010_b.up.sql":   {Data: []byte("CREATE TABLE b(id INT);")},
+				"000010_b.down.sql": {Data: []byte("DROP TABLE b;")},
+				"000002_a.up.sql":   {Data: []byte("CREATE TABLE a(id INT);")},
+				"000002_a.down.sql": {Data: []byte("DROP TABLE a;")},
+				"README.md":         {Data: []byte("ignored")},
+			},
+			versions: []int{2, 10},
+		},
+		{
+			name: "missing down",
+			fsys: fstest.MapFS{
+				"000001_a.up.sql": {Data: []byte("CREATE TABLE a(id INT);")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "two names for a version",
+			fsys: fstest.MapFS{
+				"000001_a.up.sql":   {Data: []byte("CREATE TABLE a(id INT);")},
+				"000001_b.down.sql": {Data: []byte("DROP TABLE a;")},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LoadMigrations(tt.fsys)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadMigrations() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var versions []int
+			for _, m := range got {
+				versions = append(versions, m.Version)
+			}
+
+			if !reflect.DeepEqual(versions, tt.versions) {
+				t.Errorf("LoadMigrations() versions = %v, want %v", versions, tt.versions)
+			}
+		})
+	}
+}
+
+func TestLoadMigrations_Embedded(t *testing.T) {
+	got, err := LoadMigrations(migrations.Files)
+	if err != nil {
+		t.Fatalf("LoadMigrations() error = %v", err)
+	}
+
+	for i, m := range got {
+		if m.Version != i+1 {
+			t.Errorf("migration %s has version %d, want %d", m.Name, m.Version, i+1)
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	got := splitStatements("ALTER TABLE a ADD COLUMN b INT;\n\nALTER TABLE a ADD COLUMN c INT;\n")
+	want := []string{"ALTER TABLE a ADD COLUMN b INT", "ALTER TABLE a ADD COLUMN c INT"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("splitStatements() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,4 @@
+ALTER TABLE sources
+    DROP COLUMN created_at,
+    DROP COLUMN blocked_at,
+    DROP COLUMN blocked_reason;
@@ -0,0 +1,4 @@
+ALTER TABLE sources
+    ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ADD COLUMN blocked_at TIMESTAMP NULL DEFAULT NULL,
+    ADD COLUMN blocked_reason VARCHAR(255) NOT NULL DEFAULT '';
@@ -0,0 +1,5 @@
+ALTER TABLE sources
+    DROP INDEX sources_blob_hash,
+    DROP COLUMN blob_hash;
+
+DROP TABLE IF EXISTS blobs;
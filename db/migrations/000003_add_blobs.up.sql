@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS blobs(
+    hash CHAR(64) NOT NULL PRIMARY KEY,
+    size BIGINT NOT NULL,
+    refs INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE sources
+    ADD COLUMN blob_hash CHAR(64) NULL DEFAULT NULL,
+    ADD INDEX sources_blob_hash (blob_hash);
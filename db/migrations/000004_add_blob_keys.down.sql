@@ -0,0 +1,4 @@
+ALTER TABLE blobs
+    DROP INDEX blobs_key_id,
+    DROP COLUMN wrapped_key,
+    DROP COLUMN key_id;
@@ -0,0 +1,4 @@
+ALTER TABLE blobs
+    ADD COLUMN key_id VARCHAR(64) NULL DEFAULT NULL,
+    ADD COLUMN wrapped_key VARBINARY(255) NULL DEFAULT NULL,
+    ADD INDEX blobs_key_id (key_id);
@@ -0,0 +1,3 @@
+ALTER TABLE sources
+    DROP COLUMN exhausted_at,
+    DROP COLUMN uses;
@@ -0,0 +1,3 @@
+ALTER TABLE sources
+    ADD COLUMN uses INT NOT NULL DEFAULT 0,
+    ADD COLUMN exhausted_at TIMESTAMP NULL DEFAULT NULL;
@@ -1,13 +1,10 @@
 package migrations
 
 import (
-	_ "embed"
+	"embed"
 )
 
-var (
-	//go:embed 000001_create_sources_table.up.sql
-	UpCmd string
-
-	//go:embed 000001_create_sources_table.down.sql
-	DownCmd string
-)
+// Files holds the migrations, <version>_<name>.up.sql and <version>_<name>.down.sql
+//
+//go:embed *.sql
+var Files embed.FS
@@ -0,0 +1,113 @@
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StopFunc releases a resource, it should give up once ctx is done
+type StopFunc func(ctx context.Context) error
+
+type hook struct {
+	name string
+	stop StopFunc
+}
+
+// Manager stops the registered resources in the reverse order of their registration,
+// so registering them in dependency order (db, storage, cache, ..., http server)
+// drains the traffic first and closes the db last.
+type Manager struct {
+	mu       sync.Mutex
+	hooks    []hook
+	stopping bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func New() *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Manager{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Register adds a hook, it is ignored once the shutdown has started
+func (m *Manager) Register(name string, stop StopFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopping {
+		log.Warn().Msgf("LIFECYCLE: %s registered during shutdown, ignored", name)
+		return
+	}
+
+	m.hooks = append(m.hooks, hook{name: name, stop: stop})
+}
+
+// RegisterCloser is Register for the resources that only know Close
+func (m *Manager) RegisterCloser(name string, close func() error) {
+	m.Register(name, func(context.Context) error {
+		return close()
+	})
+}
+
+// Go runs a background worker until shutdown, the worker must return once ctx is done.
+// It is stopped at its place in the registration order, before what it depends on.
+func (m *Manager) Go(name string, worker func(ctx context.Context)) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		worker(ctx)
+	}()
+
+	m.Register(name, func(stopCtx context.Context) error {
+		cancel()
+
+		select {
+		case <-done:
+			return nil
+		case <-stopCtx.Done():
+			return fmt.Errorf("worker didn't stop: %w", stopCtx.Err())
+		}
+	})
+}
+
+// Shutdown runs every hook in reverse order, a failing hook doesn't stop the next ones
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.stopping = true
+	hooks := m.hooks
+	m.mu.Unlock()
+
+	defer m.cancel()
+
+	var failures []string
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		h := hooks[i]
+		start := time.Now()
+
+		if err := h.stop(ctx); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", h.name, err))
+			log.Error().Err(err).Msgf("LIFECYCLE: stopping %s failed", h.name)
+			continue
+		}
+
+		log.Info().Dur("took", time.Since(start)).Msgf("LIFECYCLE: %s stopped", h.name)
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("shutdown: %s", strings.Join(failures, "; "))
+	}
+
+	return nil
+}
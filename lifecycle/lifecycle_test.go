@@ -0,0 +1,83 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestManager_ShutdownOrder(t *testing.T) {
+	t.Parallel()
+
+	m := New()
+
+	var order []string
+	record := func(name string) StopFunc {
+		return func(context.Context) error {
+			order = append(order, name)
+			return nil
+		}
+	}
+
+	m.Register("db", record("db"))
+	m.Register("s3", record("s3"))
+	m.RegisterCloser("cache", func() error {
+		order = append(order, "cache")
+		return errors.New("already closed")
+	})
+	m.Register("server", record("server"))
+
+	err := m.Shutdown(context.Background())
+	if err == nil {
+		t.Errorf("Shutdown() expected the cache error")
+	}
+
+	want := []string{"server", "cache", "s3", "db"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("order = %v, want %v", order, want)
+	}
+}
+
+func TestManager_Go(t *testing.T) {
+	t.Parallel()
+
+	t.Run("stops worker", func(t *testing.T) {
+		m := New()
+
+		stopped := make(chan struct{})
+		m.Go("worker", func(ctx context.Context) {
+			<-ctx.Done()
+			close(stopped)
+		})
+
+		if err := m.Shutdown(context.Background()); err != nil {
+			t.Fatalf("Shutdown() error = %v", err)
+		}
+
+		select {
+		case <-stopped:
+		default:
+			t.Errorf("worker was not stopped")
+		}
+	})
+
+	t.Run("stuck worker", func(t *testing.T) {
+		m := New()
+
+		block := make(chan struct{})
+		t.Cleanup(func() { close(block) })
+
+		m.Go("stuck", func(ctx context.Context) {
+			<-block
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		if err := m.Shutdown(ctx); err == nil {
+			t.Errorf("Shutdown() expected a timeout error")
+		}
+	})
+}
@@ -1,143 +1,224 @@
 package main
 
 import (
-	"backstreetlinkv2/api"
-	"backstreetlinkv2/api/middleware"
+	"backstreetlinkv2/api/kms"
 	"backstreetlinkv2/api/repo"
 	"backstreetlinkv2/api/service"
-	"backstreetlinkv2/db"
-	"backstreetlinkv2/db/migrations"
+	"backstreetlinkv2/config"
 	"context"
+	"encoding/base64"
 	"errors"
 	"flag"
-	"github.com/gorilla/mux"
+	"fmt"
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/rs/zerolog"
+	zlog "github.com/rs/zerolog/log"
+	"io"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
-	"syscall"
+	"strings"
 	"time"
 )
 
-const shutdownTimeout = 30 * time.Second
-const maxCacheCountdown = 12 * time.Hour
+const usage = `usage: backstreetlinkv2 [command] [flags]
+
+commands:
+  serve                          run the api, the default command, it refuses to start with
+                                 pending migrations unless -migrate applies them
+  migrate [up|down [n]|status]   apply, revert or list the migrations
+  alias list                     list the aliases, -type, -blocked, -after and -limit filter them
+  alias show <alias>             show an alias with its moderation state
+  alias delete <alias>           delete an alias, its file and its cache entry
+  alias block <alias> [reason]   make an alias answer 410 Gone, its file is kept
+  alias unblock <alias>          let a blocked alias resolve again
+  cache flush                    empty the cache
+  gc-orphans [-dry-run] [-json]  delete the objects no alias points at and the FILE aliases
+                                 whose object is missing
+  rotate-keys [-json]            re-wrap the data keys of the encrypted objects with the current
+                                 master key, the objects are not uploaded again
+
+Every command takes the flags of the configuration, e.g. -config file or -mysql.dsn,
+run a command with -h to list them.
+`
+
+// usageError is a mistake in the command line, the usage has already been printed
+type usageError struct {
+	err error
+}
 
-func main() {
-	wantFreshDB := flag.Bool("fresh", false, "drop the DB and remigrate it")
-	flag.Parse()
+func (e usageError) Error() string {
+	return e.err.Error()
+}
 
-	log.SetOutput(zerolog.New(os.Stdout))
+type command func(ctx context.Context, args []string) error
 
-	environment := os.Getenv("ENV")
-	if environment == "" {
-		environment = "LOCAL"
+var commands = map[string]command{
+	"serve":       serve,
+	"migrate":     migrateCmd,
+	"alias":       aliasCmd,
+	"cache":       cacheCmd,
+	"gc-orphans":  gcOrphansCmd,
+	"rotate-keys": rotateKeysCmd,
+}
+
+func main() {
+	// the flags of serve used to be given without a command, they still are
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
 
-	dsn := os.Getenv("MYSQL_DSN")
-	if dsn == "" {
-		dsn = "mysql:password@tcp(localhost:3306)/backstreet?tls=skip-verify"	
+	if name == "help" {
+		fmt.Fprint(os.Stdout, usage)
+		return
 	}
 
-	dbClient, err := db.ConnectMySQL(dsn)
-	if err != nil {
-		log.Fatalf("can't connect to db: %v", err)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", name, usage)
+		os.Exit(2)
 	}
 
-	if *wantFreshDB {
-		ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-		_, err := dbClient.ExecContext(ctx, migrations.DownCmd)
-		if err != nil {
-			log.Fatalf("cant drop table: %v", err)
-		}
+	if err := cmd(ctx, args); err != nil {
+		var usageErr usageError
+		if errors.As(err, &usageErr) {
+			if errors.Is(usageErr.err, flag.ErrHelp) {
+				return
+			}
 
-		_, err = dbClient.ExecContext(ctx, migrations.UpCmd)
-		if err != nil {
-			log.Fatalf("cant create table: %v", err)
+			os.Exit(2)
 		}
+
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		os.Exit(1)
 	}
+}
+
+// parseConfig parses the flags of a command, the configuration flags included, and loads the configuration
+func parseConfig(fs *flag.FlagSet, args []string) (config.Config, error) {
+	loader := config.NewLoader(fs)
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	if err := fs.Parse(args); err != nil {
+		return config.Config{}, usageError{err}
 	}
 
-	accessKey := os.Getenv("NEW_AWS_ACCESS_KEY")
-	secretKey := os.Getenv("NEW_AWS_SECRET_KEY")
-	endpoint := os.Getenv("NEW_AWS_ENDPOINT")
-	bucket := os.Getenv("NEW_AWS_BUCKETNAME")
+	return loader.Load()
+}
 
-	router := mux.NewRouter()
-	router.Use(
-		middleware.CORS(environment),
-		middleware.Recoverer,
-		middleware.Limit,
-	)
+// setupLogger configures the global zerolog logger, format is "json" (default) or "console"
+func setupLogger(w io.Writer, level, format string) error {
+	if level == "" {
+		level = "info"
+	}
 
-	pgRepo := repo.NewMYSQLRepo(dbClient)
-	cache, err := repo.NewCache(context.Background(), maxCacheCountdown)
+	lvl, err := zerolog.ParseLevel(level)
 	if err != nil {
-		log.Fatalf("error cache: %v", err)
+		return fmt.Errorf("invalid LOG_LEVEL: %w", err)
 	}
 
-	s3Service, err := repo.NewObjectScanner(context.Background(), repo.ObjectConfig{
-		AccessKey: accessKey,
-		SecretKey: secretKey,
-		Endpoint:  endpoint,
-		Bucket:    bucket,
-	})
+	var out io.Writer
+	switch format {
+	case "", "json":
+		out = w
+	case "console":
+		out = zerolog.ConsoleWriter{Out: w, TimeFormat: time.RFC3339}
+	default:
+		return fmt.Errorf("invalid LOG_FORMAT %q", format)
+	}
 
-	if err != nil {
-		log.Fatalf("error s3: %v", err)
+	zerolog.SetGlobalLevel(lvl)
+	zlog.Logger = zerolog.New(out).With().Timestamp().Logger()
+	zerolog.DefaultContextLogger = &zlog.Logger
+
+	log.SetFlags(0)
+	log.SetOutput(zlog.Logger)
+
+	return nil
+}
+
+// newKeyRing builds the ring of the master keys from sse.keys_file and sse.master_key, nil when none is set
+func newKeyRing(cfg config.Config) (kms.KeyRing, error) {
+	var keys []kms.MasterKey
+
+	if cfg.SSE.KeysFile != "" {
+		file, err := os.Open(cfg.SSE.KeysFile)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		if keys, err = kms.ReadKeys(file); err != nil {
+			return nil, fmt.Errorf("%s: %w", cfg.SSE.KeysFile, err)
+		}
 	}
 
-	programService := service.NewLinkDeps(pgRepo, s3Service, cache)
-
-	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(200)
-		w.Write([]byte("OK"))
-	}).Methods(http.MethodGet)
-
-	r := router.PathPrefix("/api/v2").Subrouter()
-	r.HandleFunc("/link", api.CreateLink(programService)).Methods(http.MethodPost)
-	r.HandleFunc("/file", api.CreateFile(programService)).Methods(http.MethodPost)
-	r.HandleFunc("/download-file/{alias}", api.DownloadFile(programService)).Methods(http.MethodGet)
-	r.HandleFunc("/find/{alias}", api.Find(programService)).Methods(http.MethodGet)
-
-	server := &http.Server{
-		Addr:              ":" + port,
-		ReadTimeout:       10 * time.Second,
-		WriteTimeout:      10 * time.Second,
-		IdleTimeout:       30 * time.Second,
-		ReadHeaderTimeout: 5 * time.Second,
-		MaxHeaderBytes:    10 * 1024 * 1024,
-		Handler:           router,
+	if cfg.SSE.MasterKey != "" {
+		// validated by config.Validate
+		key, _ := base64.StdEncoding.DecodeString(cfg.SSE.MasterKey)
+		keys = append(keys, kms.MasterKey{ID: cfg.SSE.MasterKeyID, Key: key})
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	return kms.NewLocal(keys)
+}
+
+// newCache picks the cache implementation, "redis" shares the cache between replicas
+// and "tiered" puts a short lived in process cache in front of redis
+func newCache(ctx context.Context, cfg config.Config) (service.Cache, error) {
+	memory := repo.CacheConfig{
+		LifeWindow:   cfg.Cache.TTL,
+		Shards:       cfg.Cache.Shards,
+		MaxEntrySize: cfg.Cache.MaxEntrySize,
+		MaxSizeMB:    cfg.Cache.MaxSizeMB,
 	}
 
-	go func() {
-		log.Println("currently listen and serve on port", port)
+	switch cfg.Cache.Driver {
+	case config.CacheMemory:
+		return repo.NewCacheWithConfig(ctx, memory)
 
-		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Fatalf("cant start server: %v", err)
+	case config.CacheRedis:
+		return newRedisCache(ctx, cfg)
+
+	case config.CacheTiered:
+		memory.LifeWindow = cfg.Cache.L1TTL
+
+		l1, err := repo.NewCacheWithConfig(ctx, memory)
+		if err != nil {
+			return nil, err
 		}
-	}()
 
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT, os.Interrupt)
+		l2, err := newRedisCache(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
 
-	<-quit
+		invalidator, err := repo.NewRedisInvalidator(l2, "invalidate")
+		if err != nil {
+			return nil, err
+		}
 
-	// for this case, imho errgroup / goroutine is overkill
-	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
-	defer cancel()
+		return repo.NewTieredCache(ctx, l1, l2, invalidator)
 
-	if err := dbClient.Close(); err != nil {
-		log.Printf("shutting down db error: %v", err)
+	default:
+		return nil, fmt.Errorf("unknown cache driver %q", cfg.Cache.Driver)
 	}
+}
 
-	if err := server.Shutdown(ctx); err != nil {
-		log.Printf("shutting down server error: %v", err)
-	}
+func newRedisCache(ctx context.Context, cfg config.Config) (*repo.RedisCache, error) {
+	return repo.NewRedisCache(ctx, repo.RedisConfig{
+		Addr:     cfg.Redis.Addr,
+		Username: cfg.Redis.Username,
+		Password: cfg.Redis.Password,
+		DB:       cfg.Redis.DB,
+		PoolSize: cfg.Redis.PoolSize,
+		Prefix:   cfg.Redis.Prefix,
+		TTL:      cfg.Cache.TTL,
+	})
 }
@@ -54,13 +54,13 @@ func ValidateCaptcha(ctx context.Context, token string, input string) (int, erro
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Debug().Err(err)
+		log.Debug().Err(err).Msg("can't read turnstile response")
 		return http.StatusInternalServerError, ErrInternal
 	}
 
 	err = json.Unmarshal(body, &result)
 	if err != nil {
-		log.Debug().Err(err)
+		log.Debug().Err(err).Msg("can't decode turnstile response")
 		return http.StatusInternalServerError, ErrInternal
 	}
 
@@ -80,7 +80,7 @@ func fetchRequest(ctx context.Context, args io.Reader) (*http.Response, error) {
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Debug().Err(err)
+		log.Debug().Err(err).Msg("can't reach turnstile")
 		return nil, ErrInternal
 	}
 
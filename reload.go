@@ -0,0 +1,78 @@
+package main
+
+import (
+	"backstreetlinkv2/api"
+	"backstreetlinkv2/api/middleware"
+	"backstreetlinkv2/config"
+	"context"
+	"github.com/rs/zerolog"
+	zlog "github.com/rs/zerolog/log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reloader applies the reloadable part of the configuration on SIGHUP without restarting the server
+type reloader struct {
+	loader  *config.Loader
+	current config.Config
+
+	limiter *middleware.Limiter
+	cors    *middleware.CORS
+	limits  *api.Limits
+}
+
+func (r *reloader) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.reload()
+		}
+	}
+}
+
+// reload keeps the running configuration when the new one can't be loaded or is invalid
+func (r *reloader) reload() {
+	next, err := r.loader.Load()
+	if err != nil {
+		zlog.Error().Err(err).Msg("config reload rejected, keeping the running configuration")
+		return
+	}
+
+	changes := config.Diff(r.current, next)
+	if len(changes) == 0 {
+		zlog.Info().Msg("config reloaded, nothing changed")
+		return
+	}
+
+	for _, change := range changes {
+		event := zlog.Info()
+		msg := "config changed"
+
+		if !change.Reloadable {
+			event = zlog.Warn()
+			msg = "config changed, restart to apply"
+		}
+
+		event.Str("key", change.Key).Str("old", change.Old).Str("new", change.New).Msg(msg)
+	}
+
+	r.current = config.Merge(r.current, next)
+	r.apply(r.current)
+}
+
+func (r *reloader) apply(cfg config.Config) {
+	// validated by Load
+	level, _ := zerolog.ParseLevel(cfg.Log.Level)
+	zerolog.SetGlobalLevel(level)
+
+	r.limiter.SetPolicy(cfg.RateLimit.RPS, cfg.RateLimit.Burst)
+	r.cors.SetOrigins(cfg.Origins())
+	r.limits.SetFileMaxSize(cfg.HTTP.FileMaxSize)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"backstreetlinkv2/api"
+	"backstreetlinkv2/api/health"
+	"backstreetlinkv2/api/metrics"
+	"backstreetlinkv2/api/middleware"
+	"backstreetlinkv2/api/reconcile"
+	"backstreetlinkv2/api/repo"
+	"backstreetlinkv2/api/service"
+	"backstreetlinkv2/api/tracing"
+	"backstreetlinkv2/config"
+	"backstreetlinkv2/db"
+	"backstreetlinkv2/lifecycle"
+	"context"
+	"errors"
+	"expvar"
+	"flag"
+	"github.com/gorilla/mux"
+	zlog "github.com/rs/zerolog/log"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// serve runs the api until SIGTERM or SIGINT, it is the command run when none is given
+func serve(_ context.Context, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	loader := config.NewLoader(fs)
+	wantFreshDB := fs.Bool("fresh", false, "drop the tables of the DB and remigrate it, the data is lost")
+	wantMigrate := fs.Bool("migrate", false, "apply the pending migrations before serving")
+
+	if err := fs.Parse(args); err != nil {
+		return usageError{err}
+	}
+
+	cfg, err := loader.Load()
+	if err != nil {
+		log.Fatalf("can't load config: %v", err)
+	}
+
+	if err := setupLogger(os.Stdout, cfg.Log.Level, cfg.Log.Format); err != nil {
+		log.Fatalf("can't setup logger: %v", err)
+	}
+
+	zlog.Info().Msgf("configuration:\n%s", cfg)
+
+	app := lifecycle.New()
+
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		Exporter:    cfg.Tracing.Exporter,
+		ServiceName: cfg.Tracing.ServiceName,
+		SampleRatio: cfg.Tracing.SampleRatio,
+	})
+	if err != nil {
+		log.Fatalf("can't setup tracing: %v", err)
+	}
+
+	// stopped last so the spans of the shutdown are flushed
+	app.Register("tracing", shutdownTracing)
+
+	dbClient, err := db.ConnectMySQL(cfg.MySQL.DSN)
+	if err != nil {
+		log.Fatalf("can't connect to db: %v", err)
+	}
+
+	app.RegisterCloser("mysql", dbClient.Close)
+
+	if *wantFreshDB {
+		if err := freshDB(context.Background(), dbClient); err != nil {
+			log.Fatalf("cant remigrate the db: %v", err)
+		}
+	}
+
+	if err := migrateOnStart(context.Background(), dbClient, *wantMigrate); err != nil {
+		log.Fatalf("cant serve the db: %v", err)
+	}
+
+	limiter := middleware.NewLimiter(cfg.RateLimit.RPS, cfg.RateLimit.Burst)
+	corsPolicy := middleware.NewCORS(cfg.Origins())
+
+	proxies, err := middleware.ParseTrustedProxies(cfg.HTTP.TrustedProxies)
+	if err != nil {
+		log.Fatalf("error trusted proxies: %v", err)
+	}
+	limits := api.NewLimits(cfg.HTTP.FileMaxSize)
+
+	pgRepo := repo.NewMYSQLRepo(dbClient)
+	s3Service, err := newObjectScanner(context.Background(), cfg)
+	if err != nil {
+		log.Fatalf("error s3: %v", err)
+	}
+
+	app.RegisterCloser("s3", s3Service.Close)
+
+	cache, err := newCache(context.Background(), cfg)
+	if err != nil {
+		log.Fatalf("error cache: %v", err)
+	}
+
+	if closer, ok := cache.(interface{ Close() error }); ok {
+		app.RegisterCloser("cache", closer.Close)
+	}
+
+	opts := []service.Option{service.WithVerifyPolicy(service.VerifyPolicy(cfg.Checksum.Verify))}
+
+	ring, err := newKeyRing(cfg)
+	if err != nil {
+		log.Fatalf("error key ring: %v", err)
+	}
+
+	if ring != nil {
+		opts = append(opts, service.WithKeyRing(ring, cfg.SSE.Enabled))
+	}
+
+	programService := service.NewLinkDeps(pgRepo, s3Service, cache, opts...)
+
+	if cfg.Reconcile.Interval > 0 {
+		reconciler := reconcile.New(pgRepo, s3Service, cache, reconcile.Config{MinAge: cfg.Reconcile.MinAge})
+		app.Go("reconcile", reconciler.Every(cfg.Reconcile.Interval, !cfg.Reconcile.Delete))
+	}
+
+	if err := metrics.RegisterDB(dbClient, "backstreet"); err != nil {
+		log.Fatalf("error metrics: %v", err)
+	}
+
+	if statser, ok := cache.(service.CacheStatser); ok {
+		expvar.Publish("cache", expvar.Func(func() any {
+			return statser.Stats()
+		}))
+
+		err := metrics.RegisterCache(func() metrics.CacheCounters {
+			stats := statser.Stats()
+
+			return metrics.CacheCounters{
+				Hits:        stats.Hits,
+				Misses:      stats.Misses,
+				Collisions:  stats.Collisions,
+				Expirations: stats.Expirations,
+				Evictions:   stats.Evictions,
+				Entries:     stats.Entries,
+			}
+		})
+		if err != nil {
+			log.Fatalf("error metrics: %v", err)
+		}
+	}
+
+	checker := health.NewChecker(cfg.HTTP.HealthCheckTimeout)
+	checker.Add("mysql", dbClient.PingContext)
+	checker.Add("s3", s3Service.Ping)
+	if pinger, ok := cache.(interface{ Ping(context.Context) error }); ok {
+		checker.AddOptional("cache", pinger.Ping)
+	}
+
+	router := api.NewRouter(programService, api.RouterConfig{
+		Limits:      limits,
+		AdminAPIKey: cfg.AdminAPIKey,
+		Middlewares: []mux.MiddlewareFunc{
+			corsPolicy.Handler,
+			middleware.Recoverer,
+			limiter.Limit,
+		},
+	})
+
+	// these wrap the router rather than being mux middlewares so they see the requests no
+	// route matches too, the access log runs inside the trace to log its trace_id
+	handler := middleware.RequestID(middleware.Trace(middleware.AccessLog(proxies)(middleware.Metrics(router))))
+
+	server := &http.Server{
+		Addr:              ":" + cfg.Port,
+		ReadTimeout:       cfg.HTTP.ReadTimeout,
+		WriteTimeout:      cfg.HTTP.WriteTimeout,
+		IdleTimeout:       cfg.HTTP.IdleTimeout,
+		ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout,
+		MaxHeaderBytes:    cfg.HTTP.MaxHeaderBytes,
+		Handler:           rootHandler(handler, checker, metricsHandler(cfg.MetricsToken)),
+	}
+
+	go func() {
+		log.Println("currently listen and serve on port", cfg.Port)
+
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("cant start server: %v", err)
+		}
+	}()
+
+	// Shutdown stops accepting connections and waits for the in flight requests,
+	// uploads included, so it runs before the resources the handlers use
+	app.Register("http server", server.Shutdown)
+
+	reloads := &reloader{loader: loader, current: cfg, limiter: limiter, cors: corsPolicy, limits: limits}
+	app.Go("config reload", reloads.watch)
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT, os.Interrupt)
+
+	<-quit
+
+	// fail the readiness first and give the load balancer time to notice
+	checker.SetShuttingDown()
+	time.Sleep(cfg.HTTP.DrainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.HTTP.ShutdownTimeout)
+	defer cancel()
+
+	if err := app.Shutdown(ctx); err != nil {
+		log.Printf("shutting down error: %v", err)
+	}
+
+	return nil
+}
+
+// rootHandler serves the probes and the scrapes outside of the router so they skip the rate limiter
+// and the access log
+func rootHandler(router http.Handler, checker *health.Checker, metricsHandler http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", checker.Live())
+	mux.Handle("/readyz", checker.Ready())
+	mux.Handle("/metrics", metricsHandler)
+	mux.Handle("/", router)
+
+	return mux
+}
+
+// metricsHandler serves the scrapes outside the rate limiter, behind the token when there is one
+func metricsHandler(token string) http.Handler {
+	if token == "" {
+		return metrics.Handler()
+	}
+
+	return middleware.AdminOnly(token)(metrics.Handler())
+}